@@ -1,33 +1,271 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"io/fs"
 	"log"
 	"net"
+	"os"
+	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
 	"lightbaseEMRProxy/cmd/utils"
+	"lightbaseEMRProxy/internal/admin"
+	"lightbaseEMRProxy/internal/capture"
 	"lightbaseEMRProxy/internal/config"
+	"lightbaseEMRProxy/internal/conformance"
+	"lightbaseEMRProxy/internal/inspect"
+	"lightbaseEMRProxy/internal/logger"
+	"lightbaseEMRProxy/internal/normalize"
 	"lightbaseEMRProxy/internal/protocol/astm"
+	"lightbaseEMRProxy/internal/protocol/detect"
 	"lightbaseEMRProxy/internal/protocol/hl7"
+	"lightbaseEMRProxy/types"
 )
 
 func main() {
+	ackFile := flag.String("ack", "", "log the HL7 ACK for the message in `file` and exit (no network)")
+	pingAddr := flag.String("hl7-ping", "", "send a test HL7 message to `host:port`, report the ACK and exit")
+	diffFile := flag.String("diff", "", "compare the parsed capture in `file` with the capture given as the next argument and exit")
+	configFile := flag.String("config", "gateway.yaml", "load settings from the YAML or JSON `file`")
+	drainSpool := flag.Bool("drain-spool", false, "ask the running gateway to retry its spool now, report the result and exit")
+	replayFile := flag.String("replay", "", "feed the bytes instruments sent in capture `file` back through the parser, print each payload as JSON and exit")
+	conformanceMode := flag.Bool("conformance", false, "run the ASTM/HL7 conformance cases against the readers and parsers, report and exit")
+	flag.Parse()
+
+	loadConfig(*configFile)
+
+	if *drainSpool {
+		runDrainSpool()
+		return
+	}
+	if *conformanceMode {
+		runConformance()
+		return
+	}
+
+	if *ackFile != "" {
+		runACKTest(*ackFile)
+		return
+	}
+	if *pingAddr != "" {
+		runPing(*pingAddr)
+		return
+	}
+	if *diffFile != "" {
+		runDiff(*diffFile, flag.Arg(0))
+		return
+	}
+	if *replayFile != "" {
+		runReplay(*replayFile)
+		return
+	}
+
+	logger.Setup()
 	utils.CheckSubscription()
 	log.Println("🚀 Starting HL7 TCP/IP Server (Listening for LIS connections)")
 	log.Println(strings.Repeat("=", 60))
-	fullAddress := config.PCIP + ":" + config.ListenPort
+	cfg := config.Get()
+	fullAddress := cfg.PCIP + ":" + cfg.ListenPort
 	log.Printf("Listening on %s for incoming LIS connections...\n", fullAddress)
 
 	printLocalIPs()
 
-	// Start ASTM serial listener (non-blocking)
-	go astm.StartSerialListener()
+	// Ctrl-C or a service stop cancels ctx, which stops the listeners
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	// Re-queue results left undelivered by the previous run, ahead of new ones
+	hl7.RecoverQueue()
+
+	// Start result forwarder (non-blocking)
+	go hl7.StartForwarder()
+
+	// Retry spooled deliveries (non-blocking)
+	go hl7.StartSpoolRetry()
+
+	// Load and watch reference data for result enrichment (non-blocking)
+	if cfg.ReferenceDataFile != "" {
+		go normalize.WatchReferenceData()
+	}
+
+	if cfg.EnableASTM {
+		// Start ASTM serial listener (non-blocking)
+		go astm.StartSerialListener(ctx)
+
+		// Start ASTM TCP listener, or dial out to the analyzer (non-blocking)
+		if cfg.ASTMTCPDial != "" {
+			go astm.StartTCPDialer(ctx, cfg.ASTMTCPDial)
+		} else {
+			go astm.StartTCPListener(ctx)
+		}
+	}
+
+	// Start the protocol auto-detect listener (non-blocking)
+	if cfg.AutoDetectPort != "" {
+		go detect.StartListener(ctx, cfg.PCIP+":"+cfg.AutoDetectPort)
+	}
+
+	// Serve monitoring endpoints (non-blocking)
+	if cfg.AdminPort != "" {
+		go admin.StartServer(ctx, cfg.PCIP+":"+cfg.AdminPort)
+	}
+
+	// Start HL7 TCP server (blocks until shutdown)
+	hl7.StartServer(ctx, fullAddress)
+	shutdown(cfg.ShutdownGrace)
+}
+
+// shutdown lets instrument sessions in progress finish and the forwarder
+// empty its queue, giving up after grace; undelivered results stay on disk
+func shutdown(grace time.Duration) {
+	log.Printf("🛑 Shutting down — waiting up to %s for sessions in progress and queued results\n", grace)
+	deadline := time.Now().Add(grace)
+
+	if !astm.WaitSessions(time.Until(deadline)) {
+		log.Println("⚠️  ASTM sessions still running at shutdown")
+	}
+	if !hl7.WaitSessions(time.Until(deadline)) {
+		log.Println("⚠️  LIS connections still open at shutdown")
+	}
+	capture.Close()
+	if left := hl7.FlushQueue(time.Until(deadline)); left > 0 {
+		log.Printf("⚠️  %d deliveries still queued — they will be sent after the next start\n", left)
+	}
+	log.Println("👋 Shutdown complete")
+}
+
+// loadConfig makes the settings in path active. A missing default file
+// leaves the built-in defaults in place; a file named with -config must exist.
+func loadConfig(path string) {
+	explicit := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == "config" {
+			explicit = true
+		}
+	})
+
+	if _, err := os.Stat(path); errors.Is(err, fs.ErrNotExist) && !explicit {
+		log.Printf("ℹ️  No %s found, using built-in defaults\n", path)
+		return
+	}
+
+	cfg, err := config.LoadConfig(path)
+	if err != nil {
+		log.Fatal("❌ ", err)
+	}
+	config.Set(cfg)
+	log.Printf("⚙️  Loaded configuration from %s\n", path)
+}
+
+// runConformance plays canned instrument behaviour through the ASTM and
+// HL7 readers and parsers and reports which cases behave as specified
+func runConformance() {
+	log.SetOutput(io.Discard)
+	cases := append(astm.ConformanceCases(), hl7.ConformanceCases()...)
+	if !conformance.Report(os.Stdout, conformance.Run(cases)) {
+		os.Exit(1)
+	}
+}
+
+// runDrainSpool triggers an immediate spool drain on the running gateway
+// through its admin server
+func runDrainSpool() {
+	cfg := config.Get()
+	if cfg.AdminPort == "" {
+		log.Fatal("❌ -drain-spool needs admin_port set in the configuration")
+	}
+	result, err := admin.RequestSpoolDrain(cfg.PCIP + ":" + cfg.AdminPort)
+	if err != nil {
+		log.Fatal("❌ Spool drain failed: ", err)
+	}
+	log.Printf("✅ Spool drained: %d delivered, %d still spooled\n", result.Delivered, result.Remaining)
+}
+
+// runACKTest logs the ACK the server would send for a saved HL7 message
+func runACKTest(path string) {
+	raw, err := os.ReadFile(path)
+	if err != nil {
+		log.Fatal("❌ Could not read message file:", err)
+	}
+	if !hl7.LogACK(hl7.StripMLLP(raw)) {
+		os.Exit(1)
+	}
+}
+
+// runPing checks an HL7 peer answers a test message with an ACK
+func runPing(address string) {
+	log.Printf("🏓 Pinging HL7 peer %s...\n", address)
+	rtt, err := hl7.Ping(address, 10*time.Second)
+	if err != nil {
+		log.Printf("❌ HL7 ping failed after %s: %v\n", rtt.Round(time.Millisecond), err)
+		os.Exit(1)
+	}
+	log.Printf("✅ HL7 peer acknowledged in %s\n", rtt.Round(time.Millisecond))
+}
+
+// runDiff parses two captured messages and prints their field-level differences
+func runDiff(pathA, pathB string) {
+	if pathB == "" {
+		log.Fatal("❌ -diff needs two files: -diff a.bin b.bin")
+	}
+
+	captures := make([]inspect.Capture, 2)
+	for i, path := range []string{pathA, pathB} {
+		raw, err := os.ReadFile(path)
+		if err != nil {
+			log.Fatal("❌ Could not read capture:", err)
+		}
+		if captures[i], err = inspect.Parse(raw); err != nil {
+			log.Fatalf("❌ Could not parse %s: %v", path, err)
+		}
+	}
+
+	diffs := inspect.Diff(captures[0], captures[1])
+	log.Println(strings.Repeat("=", 60))
+	log.Printf("🔍 %s vs %s: %d difference(s)\n", pathA, pathB, len(diffs))
+	for _, d := range diffs {
+		log.Println("   " + d)
+	}
+}
+
+// runReplay pushes the bytes instruments sent in a capture file through
+// the framing and parsing of the protocol it was captured on, printing
+// each resulting payload as JSON; the gateway's own replies are skipped
+func runReplay(path string) {
+	protocol, chunks, err := capture.Read(path)
+	if err != nil {
+		log.Fatal("❌ Could not read capture: ", err)
+	}
+	cfg := *config.Get()
+	cfg.CaptureEnabled = false
+	config.Set(&cfg)
 
-	// Start ASTM TCP listener (non-blocking)
-	go astm.StartTCPListener()
+	emit := func(payload types.HL7Message) {
+		out, err := json.MarshalIndent(payload, "", "  ")
+		if err != nil {
+			log.Printf("❌ Could not encode payload [%s]: %v\n", payload.MessageID, err)
+			return
+		}
+		fmt.Println(string(out))
+	}
 
-	// Start HL7 TCP server (blocks)
-	hl7.StartServer(fullAddress)
+	sources, rx := capture.Received(chunks)
+	for _, source := range sources {
+		log.Printf("▶️  Replaying %d byte(s) %s sent\n", len(rx[source]), source)
+		if protocol == "astm" {
+			astm.Replay(rx[source], source, emit)
+		} else {
+			hl7.Replay(rx[source], source, emit)
+		}
+	}
 }
 
 func printLocalIPs() {
@@ -10,7 +10,7 @@ import (
 )
 
 func CheckSubscription() {
-	url := config.ExternalServerURL + "/subscription/get?slug=" + config.LABSLUG
+	url := config.Get().ExternalServerURL + "/subscription/get?slug=" + config.Get().LABSLUG
 
 	resp, err := http.Get(url)
 	if err != nil {
@@ -35,7 +35,7 @@ func CheckSubscription() {
 	}
 
 	if !result["active"] {
-		log.Println("No active subscription found for:", config.LABSLUG)
+		log.Println("No active subscription found for:", config.Get().LABSLUG)
 		os.Exit(1)
 	}
 
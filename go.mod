@@ -2,9 +2,15 @@ module lightbaseEMRProxy
 
 go 1.24.5
 
-require go.bug.st/serial v1.6.4
+require (
+	github.com/expr-lang/expr v1.17.8
+	go.bug.st/serial v1.6.4
+	gopkg.in/yaml.v3 v3.0.1
+	software.sslmate.com/src/go-pkcs12 v0.7.3
+)
 
 require (
 	github.com/creack/goselect v0.1.2 // indirect
+	golang.org/x/crypto v0.11.0 // indirect
 	golang.org/x/sys v0.19.0 // indirect
 )
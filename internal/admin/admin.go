@@ -0,0 +1,175 @@
+package admin
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"lightbaseEMRProxy/internal/config"
+	"lightbaseEMRProxy/internal/events"
+	"lightbaseEMRProxy/internal/metrics"
+	"lightbaseEMRProxy/internal/protocol/astm"
+	"lightbaseEMRProxy/internal/protocol/hl7"
+)
+
+// StartServer serves the monitoring endpoints on address until ctx is
+// canceled (blocks)
+func StartServer(ctx context.Context, address string) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/events", handleEvents)
+	mux.HandleFunc("/metrics", handleMetrics)
+	mux.HandleFunc("/spool/drain", authorized(handleSpoolDrain))
+	mux.HandleFunc("/healthz", handleHealth)
+	mux.HandleFunc("/readyz", handleReady)
+
+	server := &http.Server{Addr: address, Handler: mux}
+	// Event streams never go idle, so the server is closed rather than
+	// shut down gracefully
+	context.AfterFunc(ctx, func() { server.Close() })
+
+	log.Printf("📡 [ADMIN] Monitoring endpoints on http://%s\n", address)
+	if err := server.ListenAndServe(); err != nil && ctx.Err() == nil {
+		log.Printf("❌ [ADMIN] Could not serve %s: %v\n", address, err)
+	}
+}
+
+// DrainResult reports the outcome of a manual spool drain
+type DrainResult struct {
+	Delivered int `json:"delivered"`
+	Remaining int `json:"remaining"`
+}
+
+// authorized wraps an admin action so it needs the bearer token held in
+// config.Get().AdminTokenEnv; with no token set the action is disabled
+func authorized(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		token := os.Getenv(config.Get().AdminTokenEnv)
+		if token == "" {
+			http.Error(w, "admin actions disabled: no token configured", http.StatusForbidden)
+			return
+		}
+		given := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(given), []byte(token)) != 1 {
+			log.Printf("🚫 [ADMIN] Unauthorized %s %s from %s\n", r.Method, r.URL.Path, r.RemoteAddr)
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// handleSpoolDrain retries every spooled delivery now instead of waiting
+// for the next periodic pass
+func handleSpoolDrain(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "use POST", http.StatusMethodNotAllowed)
+		return
+	}
+
+	log.Println("🧹 [ADMIN] Manual spool drain requested")
+	delivered, remaining := hl7.RetrySpool()
+	log.Printf("🧹 [ADMIN] Spool drain delivered %d, %d still spooled\n", delivered, remaining)
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(DrainResult{Delivered: delivered, Remaining: remaining})
+}
+
+// handleHealth answers as long as the process is serving requests
+func handleHealth(w http.ResponseWriter, r *http.Request) {
+	fmt.Fprintln(w, "ok")
+}
+
+// handleReady reports 503 while the ASTM serial port is closed or has not
+// been read for config.Get().ReadySerialMaxIdle
+func handleReady(w http.ResponseWriter, r *http.Request) {
+	if config.Get().EnableASTM {
+		open, lastRead := astm.SerialStatus()
+		if !open {
+			http.Error(w, "serial port "+config.Get().ASTMComPort+" is not open", http.StatusServiceUnavailable)
+			return
+		}
+		if idle := time.Since(lastRead); idle > config.Get().ReadySerialMaxIdle {
+			http.Error(w, fmt.Sprintf("serial port %s not read for %s", config.Get().ASTMComPort, idle.Round(time.Second)), http.StatusServiceUnavailable)
+			return
+		}
+	}
+	fmt.Fprintln(w, "ready")
+}
+
+// handleMetrics serves the counters in the Prometheus text format
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+	if err := metrics.WritePrometheus(w); err != nil {
+		log.Println("❌ [ADMIN] Failed to write metrics:", err)
+	}
+}
+
+// handleEvents streams lifecycle events as server-sent events until the
+// client disconnects
+func handleEvents(w http.ResponseWriter, r *http.Request) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+
+	stream, unsubscribe := events.Subscribe(64)
+	defer unsubscribe()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Connection", "keep-alive")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e := <-stream:
+			data, err := json.Marshal(e)
+			if err != nil {
+				log.Println("❌ [ADMIN] Failed to marshal event:", err)
+				continue
+			}
+			if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, data); err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// RequestSpoolDrain asks the gateway's admin server at address to drain
+// the spool, authenticating with the configured admin token
+func RequestSpoolDrain(address string) (DrainResult, error) {
+	var result DrainResult
+	req, err := http.NewRequest(http.MethodPost, "http://"+address+"/spool/drain", nil)
+	if err != nil {
+		return result, err
+	}
+	req.Header.Set("Authorization", "Bearer "+os.Getenv(config.Get().AdminTokenEnv))
+
+	client := &http.Client{Timeout: 5 * time.Minute}
+	resp, err := client.Do(req)
+	if err != nil {
+		return result, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		body, _ := io.ReadAll(io.LimitReader(resp.Body, 512))
+		return result, fmt.Errorf("status %d: %s", resp.StatusCode, strings.TrimSpace(string(body)))
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+		return result, fmt.Errorf("failed to decode drain result: %w", err)
+	}
+	return result, nil
+}
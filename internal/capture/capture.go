@@ -0,0 +1,204 @@
+package capture
+
+import (
+	"encoding/hex"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"lightbaseEMRProxy/internal/config"
+)
+
+// Directions of captured traffic, from the gateway's point of view
+const (
+	RX = "RX"
+	TX = "TX"
+)
+
+// maxChunk is the most bytes held before a line is written
+const maxChunk = 4096
+
+// Recorder tees the raw traffic of one link into its protocol's capture
+// file. Consecutive bytes in one direction are written as one line:
+//
+//	<RFC 3339 time of the first byte> <RX|TX> <source> <hex bytes>
+//
+// Files are named <protocol>-<YYYYMMDD>.cap, so a new one starts each day.
+type Recorder struct {
+	mu       sync.Mutex
+	protocol string
+	source   string
+	dir      string
+	at       time.Time
+	pending  []byte
+}
+
+// New returns a recorder for traffic of protocol over source, or nil when
+// config.Get().CaptureEnabled is off; a nil recorder ignores everything
+func New(protocol, source string) *Recorder {
+	if !config.Get().CaptureEnabled {
+		return nil
+	}
+	return &Recorder{protocol: protocol, source: strings.ReplaceAll(source, " ", "_")}
+}
+
+// Record captures b travelling in direction
+func (r *Recorder) Record(direction string, b []byte) {
+	if r == nil || len(b) == 0 {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if direction != r.dir || len(r.pending)+len(b) > maxChunk {
+		r.flush()
+	}
+	if len(r.pending) == 0 {
+		r.dir, r.at = direction, time.Now()
+	}
+	r.pending = append(r.pending, b...)
+}
+
+// Flush writes any bytes still held, e.g. when the link closes
+func (r *Recorder) Flush() {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.flush()
+}
+
+func (r *Recorder) flush() {
+	if len(r.pending) == 0 {
+		return
+	}
+	line := fmt.Sprintf("%s %s %s %s\n", r.at.Format(time.RFC3339Nano), r.dir, r.source, hex.EncodeToString(r.pending))
+	r.pending = r.pending[:0]
+	write(r.protocol, r.at, line)
+}
+
+var (
+	filesMu sync.Mutex
+	files   = map[string]*os.File{} // open capture file per protocol
+)
+
+// write appends line to the capture file of protocol for the day of at,
+// moving on to a new file and pruning old ones when the day changes
+func write(protocol string, at time.Time, line string) {
+	filesMu.Lock()
+	defer filesMu.Unlock()
+
+	dir := config.Get().CaptureDir
+	path := filepath.Join(dir, protocol+"-"+at.Format("20060102")+".cap")
+	f := files[protocol]
+	if f == nil || f.Name() != path {
+		if f != nil {
+			f.Close()
+		}
+		if err := os.MkdirAll(dir, 0o755); err != nil {
+			log.Printf("❌ [CAPTURE] Could not create %s: %v\n", dir, err)
+			return
+		}
+		var err error
+		if f, err = os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600); err != nil {
+			log.Printf("❌ [CAPTURE] Could not open %s: %v\n", path, err)
+			delete(files, protocol)
+			return
+		}
+		files[protocol] = f
+		prune(dir, protocol, at)
+	}
+	if _, err := f.WriteString(line); err != nil {
+		log.Printf("❌ [CAPTURE] Could not write %s: %v\n", path, err)
+	}
+}
+
+// Close closes the open capture files; later traffic opens them again
+func Close() {
+	filesMu.Lock()
+	defer filesMu.Unlock()
+	for protocol, f := range files {
+		f.Close()
+		delete(files, protocol)
+	}
+}
+
+// prune removes capture files of protocol older than
+// config.Get().CaptureKeepDays days before now
+func prune(dir, protocol string, now time.Time) {
+	keep := config.Get().CaptureKeepDays
+	if keep <= 0 {
+		return
+	}
+	cutoff := now.AddDate(0, 0, -keep).Format("20060102")
+	names, _ := filepath.Glob(filepath.Join(dir, protocol+"-*.cap"))
+	for _, name := range names {
+		day := strings.TrimSuffix(strings.TrimPrefix(filepath.Base(name), protocol+"-"), ".cap")
+		if len(day) == 8 && day < cutoff {
+			if err := os.Remove(name); err == nil {
+				log.Printf("🧹 [CAPTURE] Removed old capture %s\n", name)
+			}
+		}
+	}
+}
+
+// Chunk is one line of a capture file: a run of bytes in one direction
+type Chunk struct {
+	At        time.Time
+	Direction string
+	Source    string
+	Bytes     []byte
+}
+
+// Read parses the capture file at path, returning the protocol named by
+// the file ("astm" or "hl7") and its chunks in order
+func Read(path string) (protocol string, chunks []Chunk, err error) {
+	protocol, _, _ = strings.Cut(filepath.Base(path), "-")
+	if protocol != "astm" && protocol != "hl7" {
+		return "", nil, fmt.Errorf("%s is not named like a capture file (astm-YYYYMMDD.cap or hl7-YYYYMMDD.cap)", path)
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", nil, err
+	}
+
+	for i, line := range strings.Split(string(data), "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		fields := strings.Fields(line)
+		if len(fields) != 4 || (fields[1] != RX && fields[1] != TX) {
+			return "", nil, fmt.Errorf("line %d: want time, RX or TX, source and hex bytes", i+1)
+		}
+		at, err := time.Parse(time.RFC3339Nano, fields[0])
+		if err != nil {
+			return "", nil, fmt.Errorf("line %d: %w", i+1, err)
+		}
+		b, err := hex.DecodeString(fields[3])
+		if err != nil {
+			return "", nil, fmt.Errorf("line %d: %w", i+1, err)
+		}
+		chunks = append(chunks, Chunk{At: at, Direction: fields[1], Source: fields[2], Bytes: b})
+	}
+	return protocol, chunks, nil
+}
+
+// Received returns the bytes each source sent, in order, ignoring what the
+// gateway sent back; sources are listed in the order they first appear
+func Received(chunks []Chunk) (sources []string, rx map[string][]byte) {
+	rx = map[string][]byte{}
+	for _, c := range chunks {
+		if c.Direction != RX {
+			continue
+		}
+		if _, ok := rx[c.Source]; !ok {
+			sources = append(sources, c.Source)
+		}
+		rx[c.Source] = append(rx[c.Source], c.Bytes...)
+	}
+	return sources, rx
+}
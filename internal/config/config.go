@@ -1,5 +1,10 @@
 package config
 
+import (
+	"sync/atomic"
+	"time"
+)
+
 // Control characters
 const (
 	VT = 0x0B // Start Block
@@ -19,15 +24,444 @@ const (
 	EOT = 0x04 // End of Transmission
 )
 
-// Server configuration
-const (
-	PCIP              = "192.168.1.193"
-	ListenPort        = "7007"
-	DebugMode         = true
-	LogToTerminal     = true
-	ASTMComPort       = "COM1"
-	ASTMBaudRate      = 115200
-	ASTMTCPPort       = "5000"
-	ExternalServerURL = "https://api-dev.lightbasemr.com"
-	LABSLUG           = "darlez-dev"
-)
+// Config holds every site-specific setting. It is loaded from gateway.yaml
+// at startup (see LoadConfig); fields omitted from the file keep the
+// defaults from Default.
+type Config struct {
+	// Server
+	PCIP               string        `yaml:"listen_ip"`
+	ListenPort         string        `yaml:"listen_port"`
+	DebugMode          bool          `yaml:"debug_mode"`       // shorthand for log_level: debug, used only when log_level is unset
+	LogLevel           string        `yaml:"log_level"`        // "debug", "info", "warn" or "error"; "" follows debug_mode
+	LogFormat          string        `yaml:"log_format"`       // "console" for readable lines, "json" for one JSON object per line
+	ControlTimeline    bool          `yaml:"control_timeline"` // log a per-session timeline of control characters (ENQ/STX/ETX/EOT/VT/FS/CR/LF)
+	LogToTerminal      bool          `yaml:"log_to_terminal"`
+	EnableASTM         bool          `yaml:"enable_astm"` // run the ASTM serial and TCP listeners
+	ASTMComPort        string        `yaml:"astm_com_port"`
+	ASTMBaudRate       int           `yaml:"astm_baud_rate"`
+	ASTMDataBits       int           `yaml:"astm_data_bits"`       // 5 to 8; older analyzers often use 7
+	ASTMParity         string        `yaml:"astm_parity"`          // "none", "even", "odd", "mark" or "space"
+	ASTMStopBits       string        `yaml:"astm_stop_bits"`       // "1", "1.5" or "2"
+	SerialWarmup       time.Duration `yaml:"serial_warmup"`        // after opening the serial port, discard bytes for this long or until ENQ (0 disables)
+	SerialReconnect    time.Duration `yaml:"serial_reconnect"`     // delay before reopening a failed serial port, doubled while it keeps failing to open
+	SerialReconnectMax time.Duration `yaml:"serial_reconnect_max"` // longest delay between attempts to reopen the serial port
+	ASTMTCPPort        string        `yaml:"astm_tcp_port"`
+	AutoDetectPort     string        `yaml:"auto_detect_port"`    // port accepting either ASTM or HL7, detected per connection ("" disables)
+	AutoDetectTimeout  time.Duration `yaml:"auto_detect_timeout"` // close auto-detect connections that send no session start within this time
+	ExternalServerURL  string        `yaml:"external_server_url"`
+	LABSLUG            string        `yaml:"lab_slug"`
+	MLLPTrailerCR      bool          `yaml:"mllp_trailer_cr"`       // end outbound MLLP blocks with FS+CR; false sends FS alone
+	HL7LenientResync   bool          `yaml:"hl7_lenient_resync"`    // on an FS with no preceding VT, parse buffered bytes from their MSH segment
+	ACKWriteTimeout    time.Duration `yaml:"ack_write_timeout"`     // give up on an ACK/NAK write the instrument is not reading
+	AdminPort          string        `yaml:"admin_port"`            // port serving monitoring endpoints such as /events ("" disables)
+	ReadySerialMaxIdle time.Duration `yaml:"ready_serial_max_idle"` // /readyz fails once the serial port has gone this long without a successful read
+	AdminTokenEnv      string        `yaml:"admin_token_env"`       // environment variable holding the bearer token for admin actions (unset disables them)
+
+	// Metrics exported at /metrics
+	MetricsNamespace string            `yaml:"metrics_namespace"` // prefix joined to every metric name with "_" ("" for none)
+	MetricsLabels    map[string]string `yaml:"metrics_labels"`    // static labels on every sample, e.g. environment and site
+
+	HL7AckAfterForward bool          `yaml:"hl7_ack_after_forward"` // ACK only once the result is forwarded (AE if forwarding fails)
+	HL7AckDeadline     time.Duration `yaml:"hl7_ack_deadline"`      // in ACK-after-forward mode, ACK by this deadline and finish forwarding in the background
+
+	SessionDedupWindow   time.Duration `yaml:"session_dedup_window"`    // suppress byte-identical sessions repeated within this window (0 disables)
+	ControlIDDedupWindow time.Duration `yaml:"control_id_dedup_window"` // suppress HL7 messages reusing a sender's MSH-10 within this window (0 disables)
+	ResultDedupWindow    time.Duration `yaml:"result_dedup_window"`     // drop results with the same sample, test, value and time forwarded within this window (0 disables)
+	ResultDedupSize      int           `yaml:"result_dedup_size"`       // most results remembered for result_dedup_window; the oldest are forgotten first (0 for no limit)
+
+	// Log privacy
+	RedactPHI      bool     `yaml:"redact_phi"`       // mask patient names, IDs and birth dates in log output
+	LogRawMessages bool     `yaml:"log_raw_messages"` // log raw messages and hex dumps (never while RedactPHI is on)
+	RedactFields   []string `yaml:"redact_fields"`    // PHI kinds masked when RedactPHI is on: "name", "id", "birth_date"
+
+	// Raw byte capture, one file per protocol per day. The files hold
+	// unredacted PHI, so keep CaptureDir access-controlled.
+	CaptureEnabled  bool   `yaml:"capture_enabled"`   // record every byte received (RX) and sent (TX) on instrument links
+	CaptureDir      string `yaml:"capture_dir"`       // directory the capture files are written to
+	CaptureKeepDays int    `yaml:"capture_keep_days"` // delete capture files older than this many days (0 keeps them all)
+
+	// ASTMRecordSeparators maps an instrument (ASTM H sender, "*" for any) to
+	// the separator between records inside its frames, for analyzers that do
+	// not use CR. It must not be the field or component delimiter.
+	ASTMRecordSeparators map[string]string `yaml:"astm_record_separators"`
+
+	// ASTM TCP client
+	ASTMTCPDial         string        `yaml:"astm_tcp_dial"`          // "host:port" of an analyzer that listens for the gateway; dial out instead of listening on ASTMTCPPort
+	ASTMDialMaxAttempts int           `yaml:"astm_dial_max_attempts"` // give up dialling after this many failed attempts (0 retries forever)
+	ASTMDialBackoffMin  time.Duration `yaml:"astm_dial_backoff_min"`  // delay after the first failed dial, doubled on each further failure
+	ASTMDialBackoffMax  time.Duration `yaml:"astm_dial_backoff_max"`  // longest delay between dial attempts
+
+	// ASTM parsing
+	ASTMReportAbsentFields bool          `yaml:"astm_report_absent_fields"` // list R-record fields missing from short records as absent_fields
+	ASTMUnknownRecords     string        `yaml:"astm_unknown_records"`      // unknown record types: "drop", "log", or "capture" into unknown_records
+	ASTMEOTGrace           time.Duration `yaml:"astm_eot_grace"`            // after EOT, still accept frames arriving within this window (0 disables)
+	ASTMSessionTimeout     time.Duration `yaml:"astm_session_timeout"`      // abandon a transmission, discarding its frames, after this long without a byte
+	ASTMVerifyChecksum     bool          `yaml:"astm_verify_checksum"`      // NAK frames whose trailing checksum does not match their content; direct (no-ENQ) transmissions are never ACKed or NAKed, so are not checked
+	ASTMCheckFrameNumbers  bool          `yaml:"astm_check_frame_numbers"`  // NAK frames numbered out of sequence; ACK and discard a repeated frame
+	ASTMNAKUnparseable     bool          `yaml:"astm_nak_unparseable"`      // NAK frames that open with no recognisable record so the analyzer retransmits them
+	ASTMNAKRetryLimit      int           `yaml:"astm_nak_retry_limit"`      // NAKs sent for one frame before it is accepted anyway, so a bad frame cannot loop forever
+	ASTMSendRetryLimit     int           `yaml:"astm_send_retry_limit"`     // when sending to the instrument, times a NAKed frame is resent before the transmission is aborted with EOT
+
+	// Forwarding
+	HL7Endpoint     string `yaml:"hl7_endpoint"`     // path on ExternalServerURL receiving HL7 results
+	ASTMEndpoint    string `yaml:"astm_endpoint"`    // path on ExternalServerURL receiving ASTM results
+	MergeResults    bool   `yaml:"merge_results"`    // send both protocols to UnifiedEndpoint instead of their own paths
+	UnifiedEndpoint string `yaml:"unified_endpoint"` // path receiving merged ASTM and HL7 results
+
+	ForwardPriority      bool   `yaml:"forward_priority"`        // send STAT/critical results ahead of routine ones when the queue backs up
+	RouteSuspectToReview bool   `yaml:"route_suspect_to_review"` // send implausible results to ReviewEndpoint instead of the main endpoint
+	ReviewEndpoint       string `yaml:"review_endpoint"`         // path on ExternalServerURL receiving suspect results
+	SanitizeMode         string `yaml:"sanitize_mode"`           // "strip" drops control characters, "escape" writes them as \xNN
+	DryRun               bool   `yaml:"dry_run"`                 // log each payload as pretty-printed JSON instead of sending it; instruments are still ACKed
+	ForwardMode          string `yaml:"forward_mode"`            // "json" posts each payload; "ndjson" streams payloads over one chunked request; "form" posts each result form-encoded
+	NDJSONEndpoint       string `yaml:"ndjson_endpoint"`         // path on ExternalServerURL accepting the results stream; routed, review, fan-out and large-object endpoints get streams of their own
+	ForwardCompression   string `yaml:"forward_compression"`     // "off", "gzip", or "negotiate" to gzip only if CapabilitiesEndpoint lists it
+	CapabilitiesEndpoint string `yaml:"capabilities_endpoint"`   // path serving {"content_encodings": [...]} for negotiation
+	ForwardMaxBytes      int    `yaml:"forward_max_bytes"`       // largest JSON body sent in one request (0 disables the limit)
+	OversizeMode         string `yaml:"oversize_mode"`           // oversize payloads: "split" across requests per result, or "route" to LargeObjectEndpoint
+	LargeObjectEndpoint  string `yaml:"large_object_endpoint"`   // path on ExternalServerURL receiving oversize payloads in "route" mode
+
+	NDJSONCheckpoint   int           `yaml:"ndjson_checkpoint"`    // lines after which a stream is ended so the server's response confirms them; unconfirmed lines are spooled if the stream fails
+	NDJSONWriteTimeout time.Duration `yaml:"ndjson_write_timeout"` // give up on a stream the server has stopped reading
+
+	ClientPKCS12File        string `yaml:"client_pkcs12_file"`         // .p12/.pfx client identity presented for mutual TLS ("" disables)
+	ClientPKCS12PasswordEnv string `yaml:"client_pkcs12_password_env"` // environment variable holding the bundle password
+
+	ServerCAFile             string `yaml:"server_ca_file"`              // PEM bundle of CAs trusted for the external server, added to the system roots ("" trusts the system roots only)
+	ClientCertFile           string `yaml:"client_cert_file"`            // PEM client certificate presented for mutual TLS, with ClientKeyFile ("" disables)
+	ClientKeyFile            string `yaml:"client_key_file"`             // PEM private key of ClientCertFile
+	ServerInsecureSkipVerify bool   `yaml:"server_insecure_skip_verify"` // accept any server certificate; for lab testing only
+
+	ServerAuthScheme   string `yaml:"server_auth_scheme"`    // "none", "bearer" to send Authorization: Bearer <token>, or "header" to send ServerAuthHeader: <token>
+	ServerAuthHeader   string `yaml:"server_auth_header"`    // header carrying the token in "header" mode
+	ServerAuthTokenEnv string `yaml:"server_auth_token_env"` // environment variable holding the token sent to the external server
+
+	EmbedSchemaVersion bool `yaml:"embed_schema_version"` // add schema_version to every forwarded payload
+
+	// NestResultsByOrder forwards each OBR as an entry in orders carrying its
+	// own OBX results, instead of one flat results list
+	NestResultsByOrder bool `yaml:"nest_results_by_order"`
+
+	// TimestampFormat renders forwarded timestamps: "rfc3339", "epoch_millis",
+	// or a Go time layout such as "2006-01-02 15:04:05". Timestamps stay JSON
+	// strings in every format, so epoch_millis is sent as "1700000000000"
+	TimestampFormat string `yaml:"timestamp_format"`
+
+	// A delivery failing with a network error or 5xx answer is retried this
+	// many times in all, waiting ForwardRetryBackoff (doubling each time, up
+	// to ForwardRetryMaxBackoff, plus jitter) in between, before it is spooled
+	ForwardRetryAttempts   int           `yaml:"forward_retry_attempts"`
+	ForwardRetryBackoff    time.Duration `yaml:"forward_retry_backoff"`
+	ForwardRetryMaxBackoff time.Duration `yaml:"forward_retry_max_backoff"`
+
+	// With ForwardBatchSize above 1, json-mode deliveries to the same
+	// endpoint are posted together as one JSON array of up to that many
+	// payloads, waiting at most ForwardBatchWindow for the batch to fill
+	ForwardBatchSize   int           `yaml:"forward_batch_size"`
+	ForwardBatchWindow time.Duration `yaml:"forward_batch_window"`
+
+	// ForwardWorkers deliveries run at once; a sample's deliveries still go
+	// one at a time, in order. Past ForwardQueueLimit queued deliveries (0
+	// for no limit), new ones are spooled for the retry loop instead.
+	ForwardWorkers    int `yaml:"forward_workers"`
+	ForwardQueueLimit int `yaml:"forward_queue_limit"`
+
+	ForwardMaxAge time.Duration `yaml:"forward_max_age"` // dead-letter results still unsent this long after receipt (0 disables)
+	DeadLetterDir string        `yaml:"dead_letter_dir"` // directory holding results that will not be forwarded
+
+	FileDropDir  string `yaml:"file_drop_dir"`  // also write each result set as an HL7 ORU file into this directory ("" disables)
+	FileDropName string `yaml:"file_drop_name"` // drop file name; {sample}, {message_id}, {instrument}, {patient_id}, {timestamp}
+
+	ShutdownGrace time.Duration `yaml:"shutdown_grace"` // on SIGINT/SIGTERM, how long to let sessions in progress finish and the queue drain
+
+	QueueDir           string        `yaml:"queue_dir"`            // queued deliveries are also kept here until sent, so a restart does not lose them ("" disables)
+	SpoolDir           string        `yaml:"spool_dir"`            // failed deliveries are kept here, one subdirectory per endpoint, until retried
+	SpoolRetryInterval time.Duration `yaml:"spool_retry_interval"` // how often spooled deliveries are retried
+
+	ReferenceDataFile    string        `yaml:"reference_data_file"`    // JSON file of test code → {long_name, department} used to enrich results ("" disables)
+	ReferenceDataRefresh time.Duration `yaml:"reference_data_refresh"` // how often the reference file is checked for changes
+
+	// FanOutEndpoints receive a copy of every forwarded payload in addition to
+	// its normal endpoint; each is a path on ExternalServerURL or an absolute URL
+	FanOutEndpoints []string `yaml:"fan_out_endpoints"`
+
+	// InstrumentRoutes sends the results of a sender (HL7 MSH-3, or the
+	// sender name in the ASTM H record) to its own endpoint, a path on
+	// ExternalServerURL or an absolute URL, in place of the default one
+	InstrumentRoutes map[string]string `yaml:"instrument_routes"`
+
+	// FormFields maps form keys to the flattened result keys (test_code, value,
+	// patient_id, ...) sent in "form" forward mode; empty sends every key as is
+	FormFields map[string]string `yaml:"form_fields"`
+
+	// HL7AcceptedMessageTypes lists the MSH-9 message types that are parsed
+	// and forwarded: a code ("ORU") accepts every trigger event, a code and
+	// trigger ("ORU^R01") only that one. Other messages are rejected with AR.
+	HL7AcceptedMessageTypes []string `yaml:"hl7_accepted_message_types"`
+
+	// HL7ValidateProfile dead-letters accepted messages that do not match
+	// HL7SegmentProfiles, replying AR instead of forwarding them
+	HL7ValidateProfile bool `yaml:"hl7_validate_profile"`
+
+	// HL7SegmentProfiles maps an MSH-9 message code to the segments it must
+	// contain, in the order they must first appear
+	HL7SegmentProfiles map[string][]string `yaml:"hl7_segment_profiles"`
+
+	// HL7 result queries
+	HL7AnswerQueries bool          `yaml:"hl7_answer_queries"` // answer QBP queries for a sample's results with RSP^K11
+	QueryEndpoint    string        `yaml:"query_endpoint"`     // path on ExternalServerURL returning a sample's results (?sample_id=)
+	QueryTimeout     time.Duration `yaml:"query_timeout"`      // how long to wait for the server before answering AE
+	QueryCacheTTL    time.Duration `yaml:"query_cache_ttl"`    // answer queries from recently received results this long (0 disables the cache)
+
+	// Order download
+	ASTMAnswerQueries bool   `yaml:"astm_answer_queries"` // answer ASTM Q records with the sample's pending orders
+	OrdersEndpoint    string `yaml:"orders_endpoint"`     // path on ExternalServerURL returning a sample's pending orders (?sample_id=)
+
+	HL7SendOrders      bool          `yaml:"hl7_send_orders"`       // answer QRY order queries with the sample's pending orders as ORM^O01
+	HL7OrderACKTimeout time.Duration `yaml:"hl7_order_ack_timeout"` // how long to wait for the instrument to ACK an ORM^O01
+
+	// KeepaliveBytes are link-check bytes some instruments send between
+	// sessions; they never start a session or enter a message buffer
+	KeepaliveBytes []byte `yaml:"keepalive_bytes"`
+
+	// KeepaliveACK answers each ASTM keepalive byte with ACK, for instruments that expect it
+	KeepaliveACK bool `yaml:"keepalive_ack"`
+
+	// ResultTransforms maps an instrument (MSH-3 / ASTM H sender, "*" for any)
+	// to an expr-lang expression evaluated per result before forwarding
+	ResultTransforms map[string]string `yaml:"result_transforms"`
+
+	// TransformTimeout bounds how long a single result transform may run;
+	// an expression that exceeds it is not run again until restart
+	TransformTimeout time.Duration `yaml:"transform_timeout"`
+
+	// SanitizeFields lists the result fields cleaned of control characters before forwarding
+	SanitizeFields []string `yaml:"sanitize_fields"`
+
+	// QualitativeValues maps raw qualitative results (matched case-insensitively,
+	// keys upper case) to the canonical value forwarded; the raw value is kept
+	// alongside as raw_value
+	QualitativeValues map[string]string `yaml:"qualitative_values"`
+
+	// ResultCountBounds keyed by instrument (MSH-3 / ASTM H sender, "*" for any);
+	// sessions outside the range raise an alert but are still forwarded
+	ResultCountBounds map[string]ResultCountBound `yaml:"result_count_bounds"`
+
+	// AlertWebhookURL receives alerts as JSON POSTs ("" logs them only)
+	AlertWebhookURL string `yaml:"alert_webhook_url"`
+
+	// TrimNumericPadding strips leading zeros and padding from numeric result
+	// values, keeping the instrument's value as raw_value
+	TrimNumericPadding bool `yaml:"trim_numeric_padding"`
+
+	// ParseNumericValues adds value_numeric, and comparator for values such
+	// as ">10.0", to results whose value is a number
+	ParseNumericValues bool `yaml:"parse_numeric_values"`
+
+	// ReferenceRanges keyed by test code; the first rule matching the
+	// patient's sex and age fills in a missing range, or replaces the
+	// instrument's when the rule sets override
+	ReferenceRanges map[string][]ReferenceRangeRule `yaml:"reference_ranges"`
+
+	// PlausibilityBounds keyed by test code; numeric values outside are flagged suspect
+	PlausibilityBounds map[string]PlausibilityBound `yaml:"plausibility_bounds"`
+
+	// TestCodeMap keyed by instrument (MSH-3 / ASTM H sender, "*" for any)
+	// maps the instrument's test codes to the LIS codes forwarded instead;
+	// an instrument's own entry for a code wins over the "*" one
+	TestCodeMap map[string]map[string]string `yaml:"test_code_map"`
+
+	// UnitMap keyed by instrument like TestCodeMap maps units as sent to the
+	// units forwarded
+	UnitMap map[string]map[string]string `yaml:"unit_map"`
+}
+
+// ResultCountBound is the range of results an instrument normally sends
+// per session; Max 0 means no upper limit
+type ResultCountBound struct {
+	Min int `yaml:"min"`
+	Max int `yaml:"max"`
+}
+
+// ReferenceRangeRule is an authoritative reference range for a test. Sex
+// ("M"/"F", empty for any) and the age range in years narrow who it applies
+// to; MaxAge 0 means no upper limit. Rules with an age range never match
+// patients of unknown age.
+type ReferenceRangeRule struct {
+	Range    string `yaml:"range"`
+	Sex      string `yaml:"sex"`
+	MinAge   int    `yaml:"min_age"`
+	MaxAge   int    `yaml:"max_age"`
+	Override bool   `yaml:"override"` // replace a range the instrument did send
+}
+
+// PlausibilityBound is the range of values a test can physically produce.
+// It is a sanity check for instrument faults, not a reference range.
+type PlausibilityBound struct {
+	Min float64 `yaml:"min"`
+	Max float64 `yaml:"max"`
+}
+
+// Default returns the settings used for anything a config file leaves out
+func Default() *Config {
+	return &Config{
+		PCIP:               "192.168.1.193",
+		ListenPort:         "7007",
+		DebugMode:          true,
+		LogFormat:          "console",
+		LogToTerminal:      true,
+		EnableASTM:         true,
+		ASTMComPort:        "COM1",
+		ASTMBaudRate:       115200,
+		ASTMDataBits:       8,
+		ASTMParity:         "none",
+		ASTMStopBits:       "1",
+		SerialReconnect:    1 * time.Second,
+		SerialReconnectMax: 30 * time.Second,
+		ASTMTCPPort:        "5000",
+		AutoDetectTimeout:  30 * time.Second,
+		ExternalServerURL:  "https://api-dev.lightbasemr.com",
+		LABSLUG:            "darlez-dev",
+		MLLPTrailerCR:      true,
+		HL7LenientResync:   true,
+		ACKWriteTimeout:    5 * time.Second,
+
+		AdminTokenEnv:      "LIGHTBASE_ADMIN_TOKEN",
+		ReadySerialMaxIdle: 30 * time.Second,
+
+		MetricsNamespace: "lightbase_gateway",
+		MetricsLabels:    map[string]string{},
+
+		HL7AckDeadline: 5 * time.Second,
+
+		SessionDedupWindow: 10 * time.Minute,
+		ResultDedupWindow:  5 * time.Minute,
+		ResultDedupSize:    10000,
+
+		RedactFields:         []string{"name", "id", "birth_date"},
+		ASTMRecordSeparators: map[string]string{},
+
+		CaptureDir:      "capture",
+		CaptureKeepDays: 14,
+
+		ASTMDialBackoffMin: 1 * time.Second,
+		ASTMDialBackoffMax: 60 * time.Second,
+
+		ASTMReportAbsentFields: true,
+		ASTMUnknownRecords:     "log",
+		ASTMVerifyChecksum:     true,
+		ASTMCheckFrameNumbers:  true,
+		ASTMSessionTimeout:     10 * time.Second,
+		ASTMNAKRetryLimit:      3,
+		ASTMSendRetryLimit:     6,
+
+		HL7Endpoint:     "/hl7/receive",
+		ASTMEndpoint:    "/hl7/receives",
+		UnifiedEndpoint: "/results/receive",
+
+		ForwardPriority:      true,
+		ReviewEndpoint:       "/hl7/review",
+		SanitizeMode:         "strip",
+		ForwardMode:          "json",
+		NDJSONEndpoint:       "/hl7/stream",
+		ForwardCompression:   "off",
+		CapabilitiesEndpoint: "/capabilities",
+		OversizeMode:         "split",
+		LargeObjectEndpoint:  "/hl7/large",
+
+		NDJSONCheckpoint:   100,
+		NDJSONWriteTimeout: 10 * time.Second,
+
+		ClientPKCS12PasswordEnv: "LIGHTBASE_P12_PASS",
+
+		ServerAuthScheme:   "none",
+		ServerAuthHeader:   "X-API-Key",
+		ServerAuthTokenEnv: "LIGHTBASE_SERVER_TOKEN",
+
+		EmbedSchemaVersion: true,
+		TimestampFormat:    "rfc3339",
+
+		ForwardRetryAttempts:   3,
+		ForwardRetryBackoff:    time.Second,
+		ForwardRetryMaxBackoff: 30 * time.Second,
+
+		ForwardBatchWindow: 500 * time.Millisecond,
+
+		ForwardWorkers:    4,
+		ForwardQueueLimit: 10000,
+
+		ForwardMaxAge: 24 * time.Hour,
+		DeadLetterDir: "deadletter",
+
+		FileDropName: "{sample}_{timestamp}.hl7",
+
+		ShutdownGrace: 15 * time.Second,
+
+		QueueDir:           "queue",
+		SpoolDir:           "spool",
+		SpoolRetryInterval: 30 * time.Second,
+
+		ReferenceDataRefresh: 5 * time.Minute,
+
+		FanOutEndpoints: []string{},
+		FormFields:      map[string]string{},
+
+		InstrumentRoutes: map[string]string{},
+
+		HL7AcceptedMessageTypes: []string{"ORU"},
+		HL7SegmentProfiles: map[string][]string{
+			"ORU": {"MSH", "PID", "OBR", "OBX"},
+		},
+
+		QueryEndpoint: "/hl7/results",
+		QueryTimeout:  5 * time.Second,
+		QueryCacheTTL: 30 * time.Minute,
+
+		OrdersEndpoint:     "/orders/pending",
+		HL7OrderACKTimeout: 10 * time.Second,
+
+		KeepaliveBytes:   []byte{0x00},
+		ResultTransforms: map[string]string{},
+		TransformTimeout: 50 * time.Millisecond,
+		SanitizeFields:   []string{"test_code", "test_name", "value", "units", "reference_range", "abnormal_flags"},
+		QualitativeValues: map[string]string{
+			"POSITIVE":     "POSITIVE",
+			"POS":          "POSITIVE",
+			"+":            "POSITIVE",
+			"REACTIVE":     "POSITIVE",
+			"DETECTED":     "POSITIVE",
+			"NEGATIVE":     "NEGATIVE",
+			"NEG":          "NEGATIVE",
+			"-":            "NEGATIVE",
+			"NON-REACTIVE": "NEGATIVE",
+			"NONREACTIVE":  "NEGATIVE",
+			"NOT DETECTED": "NEGATIVE",
+		},
+		ResultCountBounds:  map[string]ResultCountBound{},
+		ReferenceRanges:    map[string][]ReferenceRangeRule{},
+		TrimNumericPadding: true,
+		ParseNumericValues: true,
+		PlausibilityBounds: map[string]PlausibilityBound{
+			"GLU": {Min: 0, Max: 2000},
+		},
+
+		TestCodeMap: map[string]map[string]string{},
+		UnitMap:     map[string]map[string]string{},
+	}
+}
+
+var current atomic.Pointer[Config]
+
+func init() {
+	current.Store(Default())
+}
+
+// Get returns the active configuration
+func Get() *Config {
+	return current.Load()
+}
+
+// Set makes cfg the active configuration
+func Set(cfg *Config) {
+	current.Store(cfg)
+}
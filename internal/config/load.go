@@ -0,0 +1,159 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+)
+
+// LoadConfig reads the YAML (or JSON) config file at path over the
+// defaults and validates the result
+func LoadConfig(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read config: %w", err)
+	}
+
+	cfg := Default()
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	if err := decoder.Decode(cfg); err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("failed to parse %s: %w", path, err)
+	}
+
+	if err := cfg.Validate(); err != nil {
+		return nil, fmt.Errorf("invalid config %s: %w", path, err)
+	}
+	return cfg, nil
+}
+
+// Validate checks that required settings are present and well formed
+func (c *Config) Validate() error {
+	var problems []string
+	check := func(ok bool, format string, args ...any) {
+		if !ok {
+			problems = append(problems, fmt.Sprintf(format, args...))
+		}
+	}
+
+	check(validPort(c.ListenPort), "listen_port %q is not a port number", c.ListenPort)
+	check(!c.EnableASTM || validPort(c.ASTMTCPPort), "astm_tcp_port %q is not a port number", c.ASTMTCPPort)
+	check(c.AdminPort == "" || validPort(c.AdminPort), "admin_port %q is not a port number", c.AdminPort)
+	check(c.AutoDetectPort == "" || validPort(c.AutoDetectPort), "auto_detect_port %q is not a port number", c.AutoDetectPort)
+	check(!c.EnableASTM || c.ASTMComPort != "", "astm_com_port is required when enable_astm is set")
+	check(!c.EnableASTM || c.ASTMBaudRate > 0, "astm_baud_rate must be positive")
+	check(c.ASTMDataBits >= 5 && c.ASTMDataBits <= 8, "astm_data_bits %d must be 5 to 8", c.ASTMDataBits)
+	check(oneOf(c.ASTMParity, "none", "even", "odd", "mark", "space"), "astm_parity %q must be none, even, odd, mark or space", c.ASTMParity)
+	check(oneOf(c.ASTMStopBits, "1", "1.5", "2"), "astm_stop_bits %q must be 1, 1.5 or 2", c.ASTMStopBits)
+	check(c.ASTMStopBits != "1.5" || c.ASTMDataBits == 5, "astm_stop_bits 1.5 is only valid with 5 data bits")
+	check(c.ASTMStopBits != "2" || c.ASTMDataBits != 5, "astm_stop_bits 2 is not valid with 5 data bits; use 1.5")
+	check(c.SerialReconnect > 0 && c.SerialReconnectMax >= c.SerialReconnect, "serial_reconnect must be positive and not above serial_reconnect_max")
+
+	u, err := url.Parse(c.ExternalServerURL)
+	check(err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != "", "external_server_url %q must be an http(s) URL", c.ExternalServerURL)
+	check(c.LABSLUG != "", "lab_slug is required")
+
+	for name, path := range map[string]string{
+		"hl7_endpoint":          c.HL7Endpoint,
+		"astm_endpoint":         c.ASTMEndpoint,
+		"unified_endpoint":      c.UnifiedEndpoint,
+		"review_endpoint":       c.ReviewEndpoint,
+		"ndjson_endpoint":       c.NDJSONEndpoint,
+		"capabilities_endpoint": c.CapabilitiesEndpoint,
+		"large_object_endpoint": c.LargeObjectEndpoint,
+		"query_endpoint":        c.QueryEndpoint,
+		"orders_endpoint":       c.OrdersEndpoint,
+	} {
+		check(strings.HasPrefix(path, "/"), "%s %q must be a path starting with /", name, path)
+	}
+	for sender, endpoint := range c.InstrumentRoutes {
+		u, err := url.Parse(endpoint)
+		check(strings.HasPrefix(endpoint, "/") || (err == nil && (u.Scheme == "http" || u.Scheme == "https") && u.Host != ""),
+			"instrument_routes[%s] %q must be a path starting with / or an http(s) URL", sender, endpoint)
+	}
+
+	check(oneOf(c.LogLevel, "", "debug", "info", "warn", "error"), "log_level %q must be debug, info, warn or error", c.LogLevel)
+	check(oneOf(c.LogFormat, "console", "json"), "log_format %q must be console or json", c.LogFormat)
+	check(oneOf(c.ForwardMode, "json", "ndjson", "form"), "forward_mode %q must be json, ndjson or form", c.ForwardMode)
+	check(c.NDJSONCheckpoint >= 1, "ndjson_checkpoint must be at least 1")
+	check(c.NDJSONWriteTimeout > 0, "ndjson_write_timeout must be positive")
+	check(oneOf(c.SanitizeMode, "strip", "escape"), "sanitize_mode %q must be strip or escape", c.SanitizeMode)
+	check(oneOf(c.ForwardCompression, "off", "gzip", "negotiate"), "forward_compression %q must be off, gzip or negotiate", c.ForwardCompression)
+	check(oneOf(c.ServerAuthScheme, "none", "bearer", "header"), "server_auth_scheme %q must be none, bearer or header", c.ServerAuthScheme)
+	check(c.ServerAuthScheme != "header" || c.ServerAuthHeader != "", "server_auth_header must be set when server_auth_scheme is header")
+	check((c.ClientCertFile == "") == (c.ClientKeyFile == ""), "client_cert_file and client_key_file must be set together")
+	check(c.ClientCertFile == "" || c.ClientPKCS12File == "", "client_cert_file and client_pkcs12_file cannot both be set")
+	check(oneOf(c.OversizeMode, "split", "route"), "oversize_mode %q must be split or route", c.OversizeMode)
+	check(oneOf(c.ASTMUnknownRecords, "drop", "log", "capture"), "astm_unknown_records %q must be drop, log or capture", c.ASTMUnknownRecords)
+	check(c.MetricsNamespace == "" || metricName.MatchString(c.MetricsNamespace), "metrics_namespace %q is not a valid metric name", c.MetricsNamespace)
+	for name := range c.MetricsLabels {
+		check(labelName.MatchString(name) && !strings.HasPrefix(name, "__"), "metrics_labels name %q is not a valid label name", name)
+	}
+	check(validTimestampFormat(c.TimestampFormat), "timestamp_format %q must be rfc3339, epoch_millis or a Go time layout", c.TimestampFormat)
+	check(c.ASTMSessionTimeout > 0, "astm_session_timeout must be positive")
+	check(c.ASTMNAKRetryLimit >= 0, "astm_nak_retry_limit must not be negative")
+	check(c.ASTMSendRetryLimit >= 0, "astm_send_retry_limit must not be negative")
+	check(c.ResultDedupSize >= 0, "result_dedup_size must not be negative")
+	check(!c.CaptureEnabled || c.CaptureDir != "", "capture_dir must be set when capture_enabled is on")
+	check(c.CaptureKeepDays >= 0, "capture_keep_days must not be negative")
+	check(!c.HL7SendOrders || c.HL7OrderACKTimeout > 0, "hl7_order_ack_timeout must be positive when hl7_send_orders is on")
+	check(c.ForwardRetryAttempts >= 1, "forward_retry_attempts must be at least 1")
+	check(c.ForwardRetryBackoff >= 0 && c.ForwardRetryMaxBackoff >= c.ForwardRetryBackoff, "forward_retry_backoff must not be negative or above forward_retry_max_backoff")
+	check(c.ForwardBatchSize >= 0, "forward_batch_size must not be negative")
+	check(c.ForwardBatchSize <= 1 || c.ForwardMode == "json", "forward_batch_size needs forward_mode json")
+	check(c.ForwardBatchSize <= 1 || c.ForwardBatchWindow > 0, "forward_batch_window must be positive when batching")
+	check(c.ForwardWorkers >= 1, "forward_workers must be at least 1")
+	check(c.ForwardQueueLimit >= 0, "forward_queue_limit must not be negative")
+	check(c.ReadySerialMaxIdle > 0, "ready_serial_max_idle must be positive")
+	check(c.ShutdownGrace >= 0, "shutdown_grace must not be negative")
+	check(c.SpoolRetryInterval > 0, "spool_retry_interval must be positive")
+	check(c.ReferenceDataRefresh > 0, "reference_data_refresh must be positive")
+
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// Prometheus metric and label name syntax
+var (
+	metricName = regexp.MustCompile(`^[a-zA-Z_:][a-zA-Z0-9_:]*$`)
+	labelName  = regexp.MustCompile(`^[a-zA-Z_][a-zA-Z0-9_]*$`)
+)
+
+// validTimestampFormat accepts the named formats, or a Go layout that
+// renders a time it can parse back with at least a date
+func validTimestampFormat(format string) bool {
+	if format == "rfc3339" || format == "epoch_millis" {
+		return true
+	}
+	if !strings.Contains(format, "2006") || !strings.Contains(format, "02") {
+		return false
+	}
+	ref := time.Date(2024, 3, 15, 13, 4, 5, 0, time.UTC)
+	_, err := time.Parse(format, ref.Format(format))
+	return err == nil
+}
+
+func validPort(port string) bool {
+	n, err := strconv.Atoi(port)
+	return err == nil && n > 0 && n < 65536
+}
+
+func oneOf(value string, allowed ...string) bool {
+	for _, a := range allowed {
+		if value == a {
+			return true
+		}
+	}
+	return false
+}
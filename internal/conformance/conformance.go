@@ -0,0 +1,54 @@
+package conformance
+
+import (
+	"fmt"
+	"io"
+
+	"lightbaseEMRProxy/internal/config"
+)
+
+// Case is one canned instrument behaviour and the gateway's specified
+// response to it
+type Case struct {
+	Protocol string // "astm" or "hl7"
+	Name     string
+	Expect   string       // the specified behaviour, for the report
+	Run      func() error // nil when the gateway behaved as specified
+}
+
+// Result is the outcome of running a case
+type Result struct {
+	Case
+	Err error
+}
+
+// Run executes cases in order against the built-in default settings, so
+// the report describes the gateway rather than one site's configuration
+func Run(cases []Case) []Result {
+	saved := config.Get()
+	defer config.Set(saved)
+
+	results := make([]Result, len(cases))
+	for i, c := range cases {
+		cfg := config.Default()
+		cfg.QueueDir = "" // nothing is forwarded, so keep no copies on disk
+		config.Set(cfg)
+		results[i] = Result{Case: c, Err: c.Run()}
+	}
+	return results
+}
+
+// Report writes one pass/fail line per result and reports whether all passed
+func Report(w io.Writer, results []Result) bool {
+	passed := 0
+	for _, r := range results {
+		if r.Err == nil {
+			passed++
+			fmt.Fprintf(w, "PASS  %-5s %-28s %s\n", r.Protocol, r.Name, r.Expect)
+		} else {
+			fmt.Fprintf(w, "FAIL  %-5s %-28s %s\n      %v\n", r.Protocol, r.Name, r.Expect, r.Err)
+		}
+	}
+	fmt.Fprintf(w, "\n%d/%d conformance cases passed\n", passed, len(results))
+	return passed == len(results)
+}
@@ -0,0 +1,87 @@
+package dedup
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"sync"
+	"time"
+)
+
+// Cache remembers keys for a fixed window so repeats can be suppressed
+type Cache struct {
+	mu     sync.Mutex
+	window func() time.Duration
+	size   func() int
+	seen   map[string]time.Time
+	order  []entry // keys as recorded, oldest first; may include forgotten keys
+}
+
+type entry struct {
+	key string
+	at  time.Time
+}
+
+// New creates a cache that forgets keys after the duration window returns;
+// a zero window disables deduplication. The window is read on every check so
+// caches created at package init follow the loaded configuration.
+func New(window func() time.Duration) *Cache {
+	return &Cache{window: window, seen: make(map[string]time.Time)}
+}
+
+// NewLimited creates a cache like New that also holds at most the number
+// of keys size returns, forgetting the oldest first; zero means no limit
+func NewLimited(window func() time.Duration, size func() int) *Cache {
+	return &Cache{window: window, size: size, seen: make(map[string]time.Time)}
+}
+
+// Seen records key and reports whether it was already recorded within the window
+func (c *Cache) Seen(key string) bool {
+	window := c.window()
+	if window <= 0 {
+		return false
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	// Keys are recorded in time order, so the expired ones are at the front
+	now := time.Now()
+	for len(c.order) > 0 && now.Sub(c.order[0].at) > window {
+		c.dropOldest()
+	}
+
+	if _, ok := c.seen[key]; ok {
+		return true
+	}
+	if c.size != nil && c.size() > 0 {
+		for len(c.seen) >= c.size() {
+			c.dropOldest()
+		}
+	}
+	c.seen[key] = now
+	c.order = append(c.order, entry{key: key, at: now})
+	return false
+}
+
+// dropOldest forgets the key recorded longest ago, unless it was already
+// forgotten (and possibly recorded again since)
+func (c *Cache) dropOldest() {
+	oldest := c.order[0]
+	c.order = c.order[1:]
+	if at, ok := c.seen[oldest.key]; ok && at.Equal(oldest.at) {
+		delete(c.seen, oldest.key)
+	}
+}
+
+// Forget removes key so its next occurrence is not treated as a repeat
+func (c *Cache) Forget(key string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	delete(c.seen, key)
+}
+
+// Hash returns a stable hex key for raw content
+func Hash(raw string) string {
+	sum := sha256.Sum256([]byte(raw))
+	return hex.EncodeToString(sum[:])
+}
@@ -0,0 +1,78 @@
+package events
+
+import (
+	"log/slog"
+	"sync"
+	"time"
+
+	"lightbaseEMRProxy/internal/metrics"
+)
+
+// Event types, in the order a session normally produces them
+const (
+	SessionStart   = "session_start"   // ENQ (ASTM) or VT (HL7) received
+	FrameReceived  = "frame_received"  // ASTM frame ACKed or HL7 MLLP block closed
+	SessionEnd     = "session_end"     // EOT (ASTM) or HL7 message processed
+	SessionTimeout = "session_timeout" // ASTM transmission abandoned after astm_session_timeout of silence
+	Forwarded      = "forwarded"       // payload delivered to an endpoint
+	Failed         = "failed"          // delivery to an endpoint failed
+)
+
+// Event is one step in the life of an instrument session
+type Event struct {
+	Type      string    `json:"type"`
+	Protocol  string    `json:"protocol,omitempty"`   // "astm" or "hl7"
+	Source    string    `json:"source,omitempty"`     // remote address or serial port
+	MessageID string    `json:"message_id,omitempty"` // set once the session has been parsed
+	Detail    string    `json:"detail,omitempty"`
+	Bytes     int       `json:"bytes,omitempty"` // size of the frame or message, for frame_received
+	At        time.Time `json:"at"`
+}
+
+// dropped counts events a slow subscriber had no room for
+var dropped = metrics.NewCounter("events_dropped_total", "Lifecycle events dropped because a subscriber fell behind")
+
+var (
+	mu          sync.Mutex
+	subscribers = map[chan Event]struct{}{}
+)
+
+// Publish logs e and sends it to every subscriber. It never blocks: a
+// subscriber whose buffer is full misses the event rather than stalling the
+// instrument link.
+func Publish(e Event) {
+	if e.At.IsZero() {
+		e.At = time.Now()
+	}
+	slog.Info("lifecycle", "event", e.Type, "protocol", e.Protocol, "source", e.Source,
+		"message_id", e.MessageID, "detail", e.Detail, "bytes", e.Bytes)
+
+	mu.Lock()
+	defer mu.Unlock()
+	for ch := range subscribers {
+		select {
+		case ch <- e:
+		default:
+			dropped.Inc()
+		}
+	}
+}
+
+// Subscribe returns a channel receiving every event published from now on,
+// buffering up to buffer of them, and a function that ends the subscription
+func Subscribe(buffer int) (<-chan Event, func()) {
+	ch := make(chan Event, buffer)
+	mu.Lock()
+	subscribers[ch] = struct{}{}
+	mu.Unlock()
+
+	var once sync.Once
+	return ch, func() {
+		once.Do(func() {
+			mu.Lock()
+			delete(subscribers, ch)
+			mu.Unlock()
+			close(ch)
+		})
+	}
+}
@@ -0,0 +1,171 @@
+package inspect
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+
+	"lightbaseEMRProxy/internal/config"
+	"lightbaseEMRProxy/internal/protocol/astm"
+	"lightbaseEMRProxy/internal/protocol/hl7"
+	"lightbaseEMRProxy/types"
+)
+
+// Capture is the parsed view of a raw captured message
+type Capture struct {
+	Protocol   string // "hl7" or "astm"
+	Delimiters string // MSH-1/MSH-2 or the ASTM H-record delimiter definition
+	Segments   []string
+	Payload    types.HL7Message
+}
+
+// volatileFields change on every parse and are left out of diffs
+var volatileFields = map[string]bool{
+	"received_at": true,
+	"created_at":  true,
+	"transport":   true,
+}
+
+// Parse detects the protocol of raw captured bytes, strips transport
+// framing and parses the message without forwarding it
+func Parse(raw []byte) (Capture, error) {
+	text := string(raw)
+
+	if strings.Contains(text, "MSH") {
+		message := hl7.StripMLLP(firstMLLPBlock(raw))
+		start := strings.Index(message, "MSH")
+		message = message[start:]
+		payload := hl7.BuildPayload(message, types.Transport{})
+		payload.Transport = nil
+		return Capture{
+			Protocol:   "hl7",
+			Delimiters: prefix(message, 3, 8),
+			Segments:   segmentTypes(message, "|"),
+			Payload:    payload,
+		}, nil
+	}
+
+	message := astm.Deframe(raw)
+	if strings.HasPrefix(message, "H") || strings.HasPrefix(message, "S03") {
+		payload, _ := astm.BuildPayload(message, types.Transport{})
+		payload.Transport = nil
+		separator := "|"
+		if strings.HasPrefix(message, "H") && len(message) > 1 {
+			separator = message[1:2]
+		}
+		return Capture{
+			Protocol:   "astm",
+			Delimiters: prefix(message, 1, 5),
+			Segments:   segmentTypes(message, separator),
+			Payload:    payload,
+		}, nil
+	}
+
+	return Capture{}, fmt.Errorf("no HL7 MSH segment or ASTM H record found")
+}
+
+// Diff reports the differences between two captures, one line per
+// differing delimiter set, segment sequence or payload field
+func Diff(a, b Capture) []string {
+	var diffs []string
+	if a.Protocol != b.Protocol {
+		diffs = append(diffs, fmt.Sprintf("protocol: %s → %s", a.Protocol, b.Protocol))
+	}
+	if a.Delimiters != b.Delimiters {
+		diffs = append(diffs, fmt.Sprintf("delimiters: %q → %q", a.Delimiters, b.Delimiters))
+	}
+	if sa, sb := strings.Join(a.Segments, " "), strings.Join(b.Segments, " "); sa != sb {
+		diffs = append(diffs, fmt.Sprintf("segments: %s → %s", sa, sb))
+	}
+
+	fa, fb := flatten(a.Payload), flatten(b.Payload)
+	keys := map[string]bool{}
+	for k := range fa {
+		keys[k] = true
+	}
+	for k := range fb {
+		keys[k] = true
+	}
+	sorted := make([]string, 0, len(keys))
+	for k := range keys {
+		sorted = append(sorted, k)
+	}
+	sort.Strings(sorted)
+
+	for _, k := range sorted {
+		va, oka := fa[k]
+		vb, okb := fb[k]
+		switch {
+		case !oka:
+			diffs = append(diffs, fmt.Sprintf("%s: (absent) → %s", k, vb))
+		case !okb:
+			diffs = append(diffs, fmt.Sprintf("%s: %s → (absent)", k, va))
+		case va != vb:
+			diffs = append(diffs, fmt.Sprintf("%s: %s → %s", k, va, vb))
+		}
+	}
+	return diffs
+}
+
+// flatten turns a payload into path → JSON value pairs, e.g. results[0].value
+func flatten(payload types.HL7Message) map[string]string {
+	data, _ := json.Marshal(payload)
+	var tree any
+	json.Unmarshal(data, &tree)
+
+	out := map[string]string{}
+	var walk func(path string, v any)
+	walk = func(path string, v any) {
+		switch node := v.(type) {
+		case map[string]any:
+			for k, child := range node {
+				if path == "" && volatileFields[k] {
+					continue
+				}
+				walk(strings.TrimPrefix(path+"."+k, "."), child)
+			}
+		case []any:
+			for i, child := range node {
+				walk(fmt.Sprintf("%s[%d]", path, i), child)
+			}
+		default:
+			encoded, _ := json.Marshal(node)
+			out[path] = string(encoded)
+		}
+	}
+	walk("", tree)
+	return out
+}
+
+// firstMLLPBlock returns the first VT...FS block in raw, or raw itself when unframed
+func firstMLLPBlock(raw []byte) []byte {
+	start := strings.IndexByte(string(raw), config.VT)
+	if start < 0 {
+		return raw
+	}
+	end := strings.IndexByte(string(raw[start:]), config.FS)
+	if end < 0 {
+		return raw[start:]
+	}
+	return raw[start : start+end]
+}
+
+func segmentTypes(message, separator string) []string {
+	var types []string
+	for _, segment := range strings.Split(message, "\r") {
+		segment = strings.TrimSpace(segment)
+		if segment == "" {
+			continue
+		}
+		types = append(types, strings.SplitN(segment, separator, 2)[0])
+	}
+	return types
+}
+
+func prefix(s string, from, to int) string {
+	if len(s) < to {
+		return ""
+	}
+	return s[from:to]
+}
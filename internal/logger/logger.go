@@ -4,52 +4,50 @@ import (
 	"encoding/json"
 	"log"
 	"strings"
+
+	"lightbaseEMRProxy/types"
 )
 
-// LogResults logs lab results to the terminal
-func LogResults(results []map[string]interface{}) {
+// LogResults logs the lab results of payload to the terminal
+func LogResults(payload types.HL7Message) {
 	log.Println("\n" + strings.Repeat("*", 60))
 	log.Println("*** LAB RESULTS - TERMINAL OUTPUT ***")
 	log.Println(strings.Repeat("*", 60))
 
-	for i, result := range results {
+	for i, result := range payload.Results {
 		log.Printf("\n📋 Result #%d:\n", i+1)
 		log.Println(strings.Repeat("-", 60))
 		log.Println("👤 PATIENT INFORMATION:")
-		log.Printf("   Patient ID:       %v\n", result["patient_id"])
-		log.Printf("   Patient Name:     %v\n", result["patient_name"])
-		if accNum, ok := result["accession_number"]; ok {
-			log.Printf("   Accession Number: %v\n", accNum)
-		}
-		if orderID, ok := result["order_id"]; ok {
-			log.Printf("   Order ID:         %v\n", orderID)
+		log.Printf("   Patient ID:       %s\n", Redact(PHIID, payload.Patient.ID))
+		log.Printf("   Patient Name:     %s\n", Redact(PHIName, payload.Patient.Name))
+		if accNum := result.AccessionNumber; accNum != "" {
+			log.Printf("   Accession Number: %s\n", accNum)
+		} else if orderID := payload.Order.AccessionNumber; orderID != "" {
+			log.Printf("   Order ID:         %s\n", orderID)
 		}
 		log.Println("\n🧪 TEST INFORMATION:")
-		log.Printf("   Test Code:        %v\n", result["test_code"])
-		log.Printf("   Test Name:        %v\n", result["test_name"])
-		log.Printf("   Value:            %v %v\n", result["value"], result["units"])
-		log.Printf("   Reference Range:  %v\n", result["reference_range"])
-		log.Printf("   Abnormal Flags:   %v\n", result["abnormal_flags"])
-		log.Printf("   Result Status:    %v\n", result["result_status"])
+		log.Printf("   Test Code:        %s\n", result.TestCode)
+		log.Printf("   Test Name:        %s\n", result.TestName)
+		log.Printf("   Value:            %s %s\n", result.Value, result.Units)
+		log.Printf("   Reference Range:  %s\n", result.ReferenceRange)
+		log.Printf("   Abnormal Flags:   %s\n", result.AbnormalFlags)
+		log.Printf("   Result Status:    %s\n", result.Status)
 		log.Println("\n📨 MESSAGE INFORMATION:")
-		if msgID, ok := result["message_id"]; ok {
-			log.Printf("   Message ID:       %v\n", msgID)
-		}
-		if obsID, ok := result["observation_id"]; ok {
-			log.Printf("   Observation ID:   %v\n", obsID)
+		if msgID := payload.MessageID; msgID != "" {
+			log.Printf("   Message ID:       %s\n", msgID)
 		}
-		if valType, ok := result["value_type"]; ok {
-			log.Printf("   Value Type:       %v\n", valType)
+		if obsID := result.ObservationID; obsID != "" {
+			log.Printf("   Observation ID:   %s\n", obsID)
 		}
-		if protocol, ok := result["protocol"]; ok {
-			log.Printf("   Protocol:         %v\n", protocol)
+		if protocol := payload.Protocol; protocol != "" {
+			log.Printf("   Protocol:         %s\n", protocol)
 		}
-		log.Printf("   Timestamp:        %v\n", result["timestamp"])
+		log.Printf("   Timestamp:        %s\n", result.Timestamp)
 		log.Println(strings.Repeat("-", 60))
 	}
 
 	log.Println("\n📄 JSON FORMAT:")
-	jsonData, err := json.MarshalIndent(results, "", "  ")
+	jsonData, err := json.MarshalIndent(payload.Results, "", "  ")
 	if err == nil {
 		log.Println(string(jsonData))
 	}
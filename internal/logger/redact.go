@@ -0,0 +1,57 @@
+package logger
+
+import (
+	"strings"
+
+	"lightbaseEMRProxy/internal/config"
+)
+
+// PHI kinds understood by Redact and listed in config.Get().RedactFields
+const (
+	PHIName      = "name"
+	PHIID        = "id"
+	PHIBirthDate = "birth_date"
+)
+
+// Redact masks value for logging when PHI redaction is on and kind is one
+// of config.Get().RedactFields. IDs keep their last four characters, names their
+// initials and birth dates their year, which is usually enough to match a
+// log line to a sample.
+func Redact(kind, value string) string {
+	if !config.Get().RedactPHI || value == "" || !redacted(kind) {
+		return value
+	}
+
+	switch kind {
+	case PHIID:
+		if len(value) <= 4 {
+			return strings.Repeat("*", len(value))
+		}
+		return strings.Repeat("*", len(value)-4) + value[len(value)-4:]
+	case PHIName:
+		var initials []string
+		for _, part := range strings.FieldsFunc(value, func(r rune) bool { return r == ' ' || r == '^' || r == ',' }) {
+			initials = append(initials, string([]rune(part)[:1])+".")
+		}
+		return strings.Join(initials, " ")
+	case PHIBirthDate:
+		if len(value) >= 4 {
+			return value[:4] + strings.Repeat("*", len(value)-4)
+		}
+	}
+	return strings.Repeat("*", len(value))
+}
+
+func redacted(kind string) bool {
+	for _, k := range config.Get().RedactFields {
+		if k == kind {
+			return true
+		}
+	}
+	return false
+}
+
+// RawAllowed reports whether raw message content may be written to the log
+func RawAllowed() bool {
+	return config.Get().LogRawMessages && !config.Get().RedactPHI
+}
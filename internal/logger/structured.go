@@ -0,0 +1,35 @@
+package logger
+
+import (
+	"context"
+	"log/slog"
+	"os"
+
+	"lightbaseEMRProxy/internal/config"
+)
+
+// Setup configures the structured logger from config.Get().LogLevel and
+// LogFormat. DebugMode only stands in for log_level: debug when no level
+// is set. In "json" mode every line, including the plain log.Printf ones,
+// is written as a JSON object; "console" keeps the readable output.
+func Setup() {
+	level := slog.LevelInfo
+	switch {
+	case config.Get().LogLevel != "":
+		level.UnmarshalText([]byte(config.Get().LogLevel))
+	case config.Get().DebugMode:
+		level = slog.LevelDebug
+	}
+
+	if config.Get().LogFormat == "json" {
+		slog.SetDefault(slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: level})))
+		return
+	}
+	slog.SetLogLoggerLevel(level)
+}
+
+// Debugging reports whether debug output is enabled, for callers that
+// would otherwise do expensive work (e.g. hex dumps) to build it
+func Debugging() bool {
+	return slog.Default().Enabled(context.Background(), slog.LevelDebug)
+}
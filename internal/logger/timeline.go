@@ -0,0 +1,43 @@
+package logger
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+)
+
+// Timeline records the control characters seen during a session with
+// their offset from the first one, giving a compact protocol-level view
+// that is much quieter than per-byte debug logging
+type Timeline struct {
+	label  string
+	start  time.Time
+	events []string
+}
+
+// NewTimeline creates an empty timeline whose log lines are tagged with label
+func NewTimeline(label string) *Timeline {
+	return &Timeline{label: label}
+}
+
+// Add records a control character by name; a nil timeline ignores it
+func (t *Timeline) Add(name string) {
+	if t == nil {
+		return
+	}
+	now := time.Now()
+	if len(t.events) == 0 {
+		t.start = now
+	}
+	t.events = append(t.events, fmt.Sprintf("+%dms %s", now.Sub(t.start).Milliseconds(), name))
+}
+
+// Flush logs the recorded sequence on one line and starts a new one
+func (t *Timeline) Flush() {
+	if t == nil || len(t.events) == 0 {
+		return
+	}
+	log.Printf("🕒 [%s] Control timeline: %s\n", t.label, strings.Join(t.events, " → "))
+	t.events = t.events[:0]
+}
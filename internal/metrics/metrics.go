@@ -0,0 +1,171 @@
+package metrics
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+
+	"lightbaseEMRProxy/internal/config"
+)
+
+// Counter is a monotonically increasing count
+type Counter struct {
+	name  string
+	help  string
+	value atomic.Uint64
+}
+
+var (
+	registryMu sync.Mutex
+	registry   []*Counter
+	histograms []*Histogram
+)
+
+// NewCounter creates and registers a counter
+func NewCounter(name, help string) *Counter {
+	c := &Counter{name: name, help: help}
+	registryMu.Lock()
+	registry = append(registry, c)
+	registryMu.Unlock()
+	return c
+}
+
+// Inc adds one to the counter and returns the new value
+func (c *Counter) Inc() uint64 { return c.value.Add(1) }
+
+// Add adds n to the counter and returns the new value
+func (c *Counter) Add(n uint64) uint64 { return c.value.Add(n) }
+
+// Value returns the current count
+func (c *Counter) Value() uint64 { return c.value.Load() }
+
+// Name returns the counter's registered name
+func (c *Counter) Name() string { return c.name }
+
+// Help returns the counter's description
+func (c *Counter) Help() string { return c.help }
+
+// All returns every registered counter, sorted by name
+func All() []*Counter {
+	registryMu.Lock()
+	defer registryMu.Unlock()
+	out := append([]*Counter(nil), registry...)
+	sort.Slice(out, func(i, j int) bool { return out[i].name < out[j].name })
+	return out
+}
+
+// Histogram counts observations into cumulative buckets
+type Histogram struct {
+	name    string
+	help    string
+	mu      sync.Mutex
+	bounds  []float64 // upper bounds, ascending
+	buckets []uint64  // observations <= each bound
+	count   uint64
+	sum     float64
+}
+
+// NewHistogram creates and registers a histogram with the given ascending
+// bucket upper bounds
+func NewHistogram(name, help string, bounds []float64) *Histogram {
+	h := &Histogram{name: name, help: help, bounds: bounds, buckets: make([]uint64, len(bounds))}
+	registryMu.Lock()
+	histograms = append(histograms, h)
+	registryMu.Unlock()
+	return h
+}
+
+// Observe records one value
+func (h *Histogram) Observe(v float64) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	for i, bound := range h.bounds {
+		if v <= bound {
+			h.buckets[i]++
+		}
+	}
+	h.count++
+	h.sum += v
+}
+
+// write renders the histogram as name_bucket, name_sum and name_count
+func (h *Histogram) write(w io.Writer, name string, labels map[string]string) error {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s histogram\n", name, h.help, name); err != nil {
+		return err
+	}
+	bucketLabels := make(map[string]string, len(labels)+1)
+	for k, v := range labels {
+		bucketLabels[k] = v
+	}
+	for i, bound := range h.bounds {
+		bucketLabels["le"] = strconv.FormatFloat(bound, 'g', -1, 64)
+		if _, err := fmt.Fprintf(w, "%s_bucket%s %d\n", name, formatLabels(bucketLabels), h.buckets[i]); err != nil {
+			return err
+		}
+	}
+	bucketLabels["le"] = "+Inf"
+	set := formatLabels(labels)
+	_, err := fmt.Fprintf(w, "%s_bucket%s %d\n%s_sum%s %g\n%s_count%s %d\n",
+		name, formatLabels(bucketLabels), h.count, name, set, h.sum, name, set, h.count)
+	return err
+}
+
+// WritePrometheus writes every counter and histogram in the Prometheus
+// text exposition format, named with config.Get().MetricsNamespace as a
+// prefix and carrying config.Get().MetricsLabels on every sample
+func WritePrometheus(w io.Writer) error {
+	cfg := config.Get()
+	labels := formatLabels(cfg.MetricsLabels)
+	for _, c := range All() {
+		name := c.name
+		if cfg.MetricsNamespace != "" {
+			name = cfg.MetricsNamespace + "_" + name
+		}
+		if _, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s counter\n%s%s %d\n", name, c.help, name, name, labels, c.Value()); err != nil {
+			return err
+		}
+	}
+
+	registryMu.Lock()
+	hs := append([]*Histogram(nil), histograms...)
+	registryMu.Unlock()
+	sort.Slice(hs, func(i, j int) bool { return hs[i].name < hs[j].name })
+	for _, h := range hs {
+		name := h.name
+		if cfg.MetricsNamespace != "" {
+			name = cfg.MetricsNamespace + "_" + name
+		}
+		if err := h.write(w, name, cfg.MetricsLabels); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// labelEscaper escapes label values as the exposition format requires
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// formatLabels renders labels as a sorted {name="value",...} label set
+func formatLabels(labels map[string]string) string {
+	if len(labels) == 0 {
+		return ""
+	}
+	names := make([]string, 0, len(labels))
+	for name := range labels {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	pairs := make([]string, len(names))
+	for i, name := range names {
+		pairs[i] = fmt.Sprintf(`%s="%s"`, name, labelEscaper.Replace(labels[name]))
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
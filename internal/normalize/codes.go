@@ -0,0 +1,56 @@
+package normalize
+
+import (
+	"log"
+
+	"lightbaseEMRProxy/internal/config"
+	"lightbaseEMRProxy/types"
+)
+
+// MapCodes translates test codes and units with the tables configured for
+// the payload's instrument, falling back to the "*" table, keeping what the
+// instrument sent in RawTestCode and RawUnits. A test code missing from a
+// table that applies is left unchanged and logged, since the LIS will
+// likely not recognise it.
+func MapCodes(payload *types.HL7Message) {
+	codes := mappingTables(config.Get().TestCodeMap, payload.Instrument)
+	units := mappingTables(config.Get().UnitMap, payload.Instrument)
+	if len(codes) == 0 && len(units) == 0 {
+		return
+	}
+
+	for i := range payload.Results {
+		r := &payload.Results[i]
+		if len(codes) > 0 {
+			if code, ok := lookup(codes, r.TestCode); !ok {
+				log.Printf("⚠️  [MAP] No LIS code mapped for %s test code %q — forwarded unchanged\n", payload.Instrument, r.TestCode)
+			} else if code != r.TestCode {
+				r.RawTestCode, r.TestCode = r.TestCode, code
+			}
+		}
+		if unit, ok := lookup(units, r.Units); ok && unit != r.Units {
+			r.RawUnits, r.Units = r.Units, unit
+		}
+	}
+}
+
+// mappingTables returns the tables that apply to instrument, its own first
+func mappingTables(tables map[string]map[string]string, instrument string) []map[string]string {
+	var applied []map[string]string
+	if table, ok := tables[instrument]; ok && instrument != "*" {
+		applied = append(applied, table)
+	}
+	if table, ok := tables["*"]; ok {
+		applied = append(applied, table)
+	}
+	return applied
+}
+
+func lookup(tables []map[string]string, key string) (string, bool) {
+	for _, table := range tables {
+		if value, ok := table[key]; ok {
+			return value, true
+		}
+	}
+	return "", false
+}
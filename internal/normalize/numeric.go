@@ -0,0 +1,83 @@
+package normalize
+
+import (
+	"regexp"
+	"strconv"
+	"strings"
+
+	"lightbaseEMRProxy/internal/config"
+	"lightbaseEMRProxy/types"
+)
+
+// paddedNumber matches a plain decimal number with optional sign
+var paddedNumber = regexp.MustCompile(`^([+-]?)(\d*)(\.\d+)?$`)
+
+// TrimNumericPadding removes fixed-width padding from numeric result
+// values ("00005.6" → "5.6", "  12.0 " → "12.0"), keeping the value the
+// instrument sent in RawValue. Trailing zeros are significant and kept.
+func TrimNumericPadding(payload *types.HL7Message) {
+	if !config.Get().TrimNumericPadding {
+		return
+	}
+	for i := range payload.Results {
+		r := &payload.Results[i]
+		trimmed, ok := trimNumber(r.Value)
+		if !ok || trimmed == r.Value {
+			continue
+		}
+		if r.RawValue == "" {
+			r.RawValue = r.Value
+		}
+		r.Value = trimmed
+	}
+}
+
+func trimNumber(value string) (string, bool) {
+	m := paddedNumber.FindStringSubmatch(strings.TrimSpace(value))
+	if m == nil || m[2]+m[3] == "" {
+		return "", false
+	}
+	sign, whole, fraction := m[1], strings.TrimLeft(m[2], "0"), m[3]
+	if whole == "" {
+		whole = "0"
+	}
+	return sign + whole + fraction, true
+}
+
+// comparatorNumber matches a number with an optional leading comparator,
+// allowing a comma as the decimal separator
+var comparatorNumber = regexp.MustCompile(`^(<=|>=|<|>)?\s*([+-]?(?:\d+(?:[.,]\d*)?|[.,]\d+))$`)
+
+// ParseNumericValues sets ValueNumeric, and Comparator for values such as
+// ">10.0" or "<0.5", on every result whose value is a number, reading a
+// decimal comma ("5,6") as a point. Value itself is left as sent, and
+// non-numeric values ("POSITIVE") are skipped.
+func ParseNumericValues(payload *types.HL7Message) {
+	if !config.Get().ParseNumericValues {
+		return
+	}
+	for i := range payload.Results {
+		setNumeric(&payload.Results[i])
+	}
+}
+
+// setNumeric sets ValueNumeric and Comparator from r.Value, clearing them
+// when the value is not a number
+func setNumeric(r *types.HL7Result) {
+	r.Comparator, r.ValueNumeric = "", nil
+	if comparator, number, ok := parseNumeric(r.Value); ok {
+		r.Comparator, r.ValueNumeric = comparator, &number
+	}
+}
+
+func parseNumeric(value string) (comparator string, number float64, ok bool) {
+	m := comparatorNumber.FindStringSubmatch(strings.TrimSpace(value))
+	if m == nil {
+		return "", 0, false
+	}
+	number, err := strconv.ParseFloat(strings.Replace(m[2], ",", ".", 1), 64)
+	if err != nil {
+		return "", 0, false
+	}
+	return m[1], number, true
+}
@@ -0,0 +1,51 @@
+package normalize
+
+import (
+	"log"
+	"strconv"
+	"strings"
+
+	"lightbaseEMRProxy/internal/config"
+	"lightbaseEMRProxy/types"
+)
+
+// FlagImplausible marks results whose numeric value falls outside the
+// configured plausibility bounds for their test code as suspect, and
+// reports whether any result was flagged
+func FlagImplausible(payload *types.HL7Message) bool {
+	flagged := false
+	for i := range payload.Results {
+		r := &payload.Results[i]
+		bounds, ok := config.Get().PlausibilityBounds[r.TestCode]
+		if !ok {
+			continue
+		}
+		value, err := strconv.ParseFloat(strings.TrimSpace(r.Value), 64)
+		if err != nil {
+			continue
+		}
+		if value < bounds.Min || value > bounds.Max {
+			r.Suspect = true
+			r.Warn(types.WarningImplausibleValue)
+			flagged = true
+			log.Printf("⚠️  [CHECK] Implausible %s value %s (allowed %g..%g) [%s]\n",
+				r.TestCode, r.Value, bounds.Min, bounds.Max, payload.MessageID)
+		}
+	}
+	return flagged
+}
+
+// SplitSuspect separates suspect results into their own payload, leaving
+// the remaining results in the original
+func SplitSuspect(payload types.HL7Message) (clean, suspect types.HL7Message) {
+	clean, suspect = payload, payload
+	clean.Results, suspect.Results = nil, nil
+	for _, r := range payload.Results {
+		if r.Suspect {
+			suspect.Results = append(suspect.Results, r)
+		} else {
+			clean.Results = append(clean.Results, r)
+		}
+	}
+	return clean, suspect
+}
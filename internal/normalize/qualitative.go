@@ -0,0 +1,23 @@
+package normalize
+
+import (
+	"strings"
+
+	"lightbaseEMRProxy/internal/config"
+	"lightbaseEMRProxy/types"
+)
+
+// CoerceQualitative replaces qualitative result values listed in
+// config.Get().QualitativeValues with their canonical form, keeping the value
+// the instrument sent in RawValue
+func CoerceQualitative(payload *types.HL7Message) {
+	for i := range payload.Results {
+		r := &payload.Results[i]
+		canonical, ok := config.Get().QualitativeValues[strings.ToUpper(strings.TrimSpace(r.Value))]
+		if !ok || canonical == r.Value {
+			continue
+		}
+		r.RawValue = r.Value
+		r.Value = canonical
+	}
+}
@@ -0,0 +1,93 @@
+package normalize
+
+import (
+	"encoding/json"
+	"log"
+	"os"
+	"sync"
+	"time"
+
+	"lightbaseEMRProxy/internal/config"
+	"lightbaseEMRProxy/types"
+)
+
+// ReferenceEntry is the reference data known for one test code
+type ReferenceEntry struct {
+	LongName   string `json:"long_name"`
+	Department string `json:"department"`
+}
+
+var (
+	referenceMu    sync.RWMutex
+	referenceTable map[string]ReferenceEntry
+	referenceMod   time.Time
+)
+
+// LoadReferenceData replaces the in-memory reference table with the
+// contents of a JSON file mapping test codes to entries
+func LoadReferenceData(path string) error {
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	table := map[string]ReferenceEntry{}
+	if err := json.Unmarshal(data, &table); err != nil {
+		return err
+	}
+
+	referenceMu.Lock()
+	referenceTable = table
+	referenceMod = info.ModTime()
+	referenceMu.Unlock()
+
+	log.Printf("📚 [REF] Loaded %d reference entries from %s\n", len(table), path)
+	return nil
+}
+
+// WatchReferenceData loads the configured reference file and reloads it
+// whenever it changes on disk (blocks)
+func WatchReferenceData() {
+	path := config.Get().ReferenceDataFile
+	if err := LoadReferenceData(path); err != nil {
+		log.Printf("❌ [REF] Could not load %s: %v\n", path, err)
+	}
+
+	for range time.Tick(config.Get().ReferenceDataRefresh) {
+		info, err := os.Stat(path)
+		if err != nil {
+			continue
+		}
+		referenceMu.RLock()
+		changed := info.ModTime().After(referenceMod)
+		referenceMu.RUnlock()
+		if !changed {
+			continue
+		}
+		if err := LoadReferenceData(path); err != nil {
+			log.Printf("❌ [REF] Could not reload %s: %v\n", path, err)
+		}
+	}
+}
+
+// Enrich fills each result's long name and department from the reference table
+func Enrich(payload *types.HL7Message) {
+	referenceMu.RLock()
+	defer referenceMu.RUnlock()
+
+	if len(referenceTable) == 0 {
+		return
+	}
+	for i := range payload.Results {
+		r := &payload.Results[i]
+		entry, ok := referenceTable[r.TestCode]
+		if !ok {
+			continue
+		}
+		r.TestLongName = entry.LongName
+		r.Department = entry.Department
+	}
+}
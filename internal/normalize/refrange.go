@@ -0,0 +1,54 @@
+package normalize
+
+import (
+	"log"
+	"strings"
+
+	"lightbaseEMRProxy/internal/config"
+	"lightbaseEMRProxy/types"
+)
+
+// ApplyReferenceRanges fills in missing reference ranges from
+// config.Get().ReferenceRanges, and replaces the instrument's range where the
+// matching rule says to override it, keeping the original in RawReferenceRange
+func ApplyReferenceRanges(payload *types.HL7Message) {
+	for i := range payload.Results {
+		r := &payload.Results[i]
+		rule, ok := matchReferenceRange(config.Get().ReferenceRanges[r.TestCode], payload.Patient)
+		if !ok || rule.Range == r.ReferenceRange {
+			continue
+		}
+
+		if r.ReferenceRange == "" {
+			r.ReferenceRange = rule.Range
+			continue
+		}
+		if !rule.Override {
+			continue
+		}
+		log.Printf("📏 [NORM] %s reference range %q replaced with %q [%s]\n", r.TestCode, r.ReferenceRange, rule.Range, payload.MessageID)
+		r.RawReferenceRange = r.ReferenceRange
+		r.ReferenceRange = rule.Range
+		r.Warn(types.WarningReferenceRangeReplaced)
+	}
+}
+
+// matchReferenceRange returns the first rule applying to patient
+func matchReferenceRange(rules []config.ReferenceRangeRule, patient types.HL7Patient) (config.ReferenceRangeRule, bool) {
+	for _, rule := range rules {
+		if rule.Sex != "" && !strings.EqualFold(rule.Sex, patient.Sex) {
+			continue
+		}
+		if rule.MinAge > 0 || rule.MaxAge > 0 {
+			if patient.AgeYears == nil {
+				continue
+			}
+			age := *patient.AgeYears
+			if age < rule.MinAge || (rule.MaxAge > 0 && age > rule.MaxAge) {
+				continue
+			}
+		}
+		return rule, true
+	}
+	return config.ReferenceRangeRule{}, false
+}
@@ -0,0 +1,62 @@
+package normalize
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"lightbaseEMRProxy/internal/config"
+	"lightbaseEMRProxy/types"
+)
+
+// Sanitize strips or escapes non-printable characters from the result
+// fields listed in config.Get().SanitizeFields
+func Sanitize(payload *types.HL7Message) {
+	for i := range payload.Results {
+		r := &payload.Results[i]
+		for _, name := range config.Get().SanitizeFields {
+			if field := resultField(r, name); field != nil {
+				*field = sanitizeString(*field)
+			}
+		}
+	}
+}
+
+func resultField(r *types.HL7Result, name string) *string {
+	switch name {
+	case "test_code":
+		return &r.TestCode
+	case "test_name":
+		return &r.TestName
+	case "value":
+		return &r.Value
+	case "units":
+		return &r.Units
+	case "reference_range":
+		return &r.ReferenceRange
+	case "abnormal_flags":
+		return &r.AbnormalFlags
+	case "status":
+		return &r.Status
+	}
+	return nil
+}
+
+func sanitizeString(s string) string {
+	if strings.IndexFunc(s, isControl) < 0 {
+		return s
+	}
+	var b strings.Builder
+	for _, c := range s {
+		if !isControl(c) {
+			b.WriteRune(c)
+		} else if config.Get().SanitizeMode == "escape" {
+			fmt.Fprintf(&b, "\\x%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func isControl(c rune) bool {
+	return !unicode.IsPrint(c) && c != ' '
+}
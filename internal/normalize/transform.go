@@ -0,0 +1,165 @@
+package normalize
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/expr-lang/expr"
+	"github.com/expr-lang/expr/vm"
+
+	"lightbaseEMRProxy/internal/config"
+	"lightbaseEMRProxy/types"
+)
+
+var (
+	programsMu sync.Mutex
+	programs   = map[string]*compiledTransform{}
+)
+
+// compiledTransform is a compiled expression. The expr VM cannot be
+// stopped once running, so an expression that overruns TransformTimeout is
+// marked runaway and not run again: it leaves one goroutine behind rather
+// than one per result.
+type compiledTransform struct {
+	program *vm.Program
+	runaway atomic.Bool
+}
+
+// transformBudget caps what one evaluation may allocate, which also bounds
+// the iterations of ranges and builtins such as map and filter
+const transformBudget = 1_000_000
+
+// ApplyTransforms runs the expression configured for the payload's
+// instrument (or the "*" fallback) against every result. The expression
+// sees the result fields by their JSON names and returns:
+//   - false or nil to drop the result
+//   - true to keep it unchanged
+//   - a map whose keys overwrite result fields; unknown keys become extra fields
+func ApplyTransforms(payload *types.HL7Message) {
+	source, ok := config.Get().ResultTransforms[payload.Instrument]
+	if !ok {
+		source, ok = config.Get().ResultTransforms["*"]
+	}
+	if !ok || source == "" {
+		return
+	}
+
+	transform, err := compileTransform(source)
+	if err != nil {
+		log.Printf("❌ [TRANSFORM] Invalid expression for %q: %v\n", payload.Instrument, err)
+		return
+	}
+
+	kept := payload.Results[:0]
+	for _, r := range payload.Results {
+		out, err := runTransform(transform, transformEnv(payload, r))
+		if err != nil {
+			log.Printf("⚠️  [TRANSFORM] %s (%s): %v — result left unchanged\n", r.TestCode, payload.MessageID, err)
+			kept = append(kept, r)
+			continue
+		}
+		switch v := out.(type) {
+		case nil:
+			log.Printf("🗑️  [TRANSFORM] Dropped %s [%s]\n", r.TestCode, payload.MessageID)
+		case bool:
+			if v {
+				kept = append(kept, r)
+			} else {
+				log.Printf("🗑️  [TRANSFORM] Dropped %s [%s]\n", r.TestCode, payload.MessageID)
+			}
+		case map[string]any:
+			applyOverrides(&r, v)
+			kept = append(kept, r)
+		default:
+			log.Printf("⚠️  [TRANSFORM] %s: unexpected %T result — result left unchanged\n", r.TestCode, out)
+			kept = append(kept, r)
+		}
+	}
+	payload.Results = kept
+}
+
+func compileTransform(source string) (*compiledTransform, error) {
+	programsMu.Lock()
+	defer programsMu.Unlock()
+
+	if t, ok := programs[source]; ok {
+		return t, nil
+	}
+	p, err := expr.Compile(source, expr.MaxNodes(1000))
+	if err != nil {
+		return nil, err
+	}
+	t := &compiledTransform{program: p}
+	programs[source] = t
+	return t, nil
+}
+
+// runTransform evaluates t within transformBudget, giving up after
+// config.Get().TransformTimeout and marking t runaway
+func runTransform(t *compiledTransform, env map[string]any) (any, error) {
+	if t.runaway.Load() {
+		return nil, errors.New("expression disabled after exceeding transform_timeout")
+	}
+
+	type outcome struct {
+		out any
+		err error
+	}
+	done := make(chan outcome, 1)
+	go func() {
+		machine := vm.VM{MemoryBudget: transformBudget}
+		out, err := machine.Run(t.program, env)
+		done <- outcome{out, err}
+	}()
+
+	select {
+	case o := <-done:
+		return o.out, o.err
+	case <-time.After(config.Get().TransformTimeout):
+		t.runaway.Store(true)
+		return nil, fmt.Errorf("expression exceeded %s and is disabled until restart", config.Get().TransformTimeout)
+	}
+}
+
+func transformEnv(payload *types.HL7Message, r types.HL7Result) map[string]any {
+	env := map[string]any{
+		"instrument":      payload.Instrument,
+		"patient_id":      payload.Patient.ID,
+		"test_code":       r.TestCode,
+		"test_name":       r.TestName,
+		"value":           r.Value,
+		"units":           r.Units,
+		"reference_range": r.ReferenceRange,
+		"abnormal_flags":  r.AbnormalFlags,
+		"status":          r.Status,
+		"timestamp":       r.Timestamp,
+	}
+	for k, v := range r.Extra {
+		env[k] = v
+	}
+	return env
+}
+
+// applyOverrides writes overrides onto r. A new value (e.g. after a unit
+// conversion) has its value_numeric and comparator parsed again, so they
+// never disagree with what is forwarded.
+func applyOverrides(r *types.HL7Result, overrides map[string]any) {
+	for k, v := range overrides {
+		value := fmt.Sprint(v)
+		if field := resultField(r, k); field != nil {
+			*field = value
+			continue
+		}
+		if r.Extra == nil {
+			r.Extra = map[string]string{}
+		}
+		r.Extra[k] = value
+	}
+	if _, ok := overrides["value"]; ok && config.Get().ParseNumericValues {
+		setNumeric(r)
+	}
+}
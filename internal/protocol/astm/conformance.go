@@ -0,0 +1,378 @@
+package astm
+
+import (
+	"bytes"
+	"context"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"lightbaseEMRProxy/internal/capture"
+	"lightbaseEMRProxy/internal/config"
+	"lightbaseEMRProxy/internal/conformance"
+	"lightbaseEMRProxy/types"
+
+	"go.bug.st/serial"
+)
+
+// play runs script through the port handler and returns the replies sent
+// and the transmissions passed on for processing
+func play(script ...string) (replies string, messages []string) {
+	port := &scriptedPort{in: bytes.NewReader([]byte(joinScript(script)))}
+	return playPort(port, &port.out)
+}
+
+// playStalled is play with the instrument going silent after each part
+// of the script until the session read times out
+func playStalled(parts ...string) (replies string, messages []string) {
+	port := &stallingPort{scriptedPort: scriptedPort{in: bytes.NewReader(nil)}, parts: parts}
+	return playPort(port, &port.out)
+}
+
+// playPort runs a session on port, returning what was written to out and
+// the transmissions processed
+func playPort(port Port, out *bytes.Buffer) (replies string, messages []string) {
+	saved := processMessage
+	defer func() { processMessage = saved }()
+	processMessage = func(message string, source types.Transport) {
+		messages = append(messages, message)
+	}
+
+	HandlePort(context.Background(), port, types.Transport{Kind: "conformance", Address: "scripted", ConnectedAt: time.Now()})
+	return out.String(), messages
+}
+
+// stallingPort plays back parts one after another; the read after each
+// part returns nothing, as when a read times out on a silent link
+type stallingPort struct {
+	scriptedPort
+	parts []string
+}
+
+func (p *stallingPort) Read(b []byte) (int, error) {
+	if p.in.Len() == 0 {
+		if len(p.parts) == 0 {
+			return 0, io.EOF
+		}
+		p.in = bytes.NewReader([]byte(p.parts[0]))
+		p.parts = p.parts[1:]
+		return 0, nil
+	}
+	return p.in.Read(b)
+}
+
+// playQuery has the instrument query sample S1 and ACK the host's ENQ and
+// the frames of the answer; pending is what the server has for the sample
+func playQuery(pending types.PendingOrders, answerFrames int) (replies string, messages []string) {
+	saved := lookupOrders
+	defer func() { lookupOrders = saved }()
+	lookupOrders = func(sampleID string) (types.PendingOrders, bool, error) {
+		return pending, sampleID == "S1" && len(pending.Orders) > 0, nil
+	}
+	cfg := *config.Get()
+	cfg.ASTMAnswerQueries = true
+	config.Set(&cfg)
+
+	ack := string(rune(config.ACK))
+	return play(string(rune(config.ENQ)), frame('1', "H|\\^&|||Conformance^1.0^SN1\r", config.ETX),
+		frame('2', "Q|1|^S1||ALL||||||||O\r", config.ETX), frame('3', "L|1|N\r", config.ETX), string(rune(config.EOT)),
+		ack+strings.Repeat(ack, answerFrames))
+}
+
+func joinScript(parts []string) string {
+	var b bytes.Buffer
+	for _, p := range parts {
+		b.WriteString(p)
+	}
+	return b.String()
+}
+
+// expect compares replies and transmissions with what the case specifies
+func expect(replies string, messages []string, wantReplies string, wantMessages ...string) error {
+	if replies != wantReplies {
+		return fmt.Errorf("replies %s, want %s", describe(replies), describe(wantReplies))
+	}
+	if len(messages) != len(wantMessages) {
+		return fmt.Errorf("%d transmission(s) processed, want %d", len(messages), len(wantMessages))
+	}
+	for i := range messages {
+		if messages[i] != wantMessages[i] {
+			return fmt.Errorf("transmission %d is %q, want %q", i+1, messages[i], wantMessages[i])
+		}
+	}
+	return nil
+}
+
+func describe(replies string) string {
+	var b bytes.Buffer
+	for i := 0; i < len(replies); i++ {
+		if i > 0 {
+			b.WriteByte(' ')
+		}
+		b.WriteString(byteDesc(replies[i]))
+	}
+	if b.Len() == 0 {
+		return "(none)"
+	}
+	return b.String()
+}
+
+// ConformanceCases returns the ASTM reader and parser conformance battery
+func ConformanceCases() []conformance.Case {
+	const (
+		enq    = string(rune(config.ENQ))
+		eot    = string(rune(config.EOT))
+		ack    = string(rune(config.ACK))
+		nak    = string(rune(config.NAK))
+		header = "H|\\^&|||Conformance^1.0^SN1\r"
+		result = "R|1|GLU^Glucose|5.2|mmol/L|3.9-5.5|N||F\r"
+		end    = "L|1|N\r"
+	)
+
+	return []conformance.Case{
+		{Protocol: "astm", Name: "good_frames", Expect: "every frame ACKed, one transmission", Run: func() error {
+			replies, messages := play(enq, frame('1', header, config.ETX), frame('2', result, config.ETX), frame('3', end, config.ETX), eot)
+			return expect(replies, messages, ack+ack+ack+ack, header+result+end)
+		}},
+		{Protocol: "astm", Name: "bad_checksum", Expect: "corrupt frame NAKed, retransmission accepted", Run: func() error {
+			bad := frame('1', header, config.ETX)
+			bad = bad[:len(bad)-4] + "00\r\n"
+			replies, messages := play(enq, bad, frame('1', header, config.ETX), frame('2', end, config.ETX), eot)
+			return expect(replies, messages, ack+nak+ack+ack, header+end)
+		}},
+		{Protocol: "astm", Name: "out_of_order_frame", Expect: "frame out of sequence NAKed", Run: func() error {
+			replies, messages := play(enq, frame('1', header, config.ETX), frame('3', end, config.ETX), frame('2', result, config.ETX), eot)
+			return expect(replies, messages, ack+ack+nak+ack, header+result)
+		}},
+		{Protocol: "astm", Name: "repeated_frame", Expect: "frame sent twice ACKed, kept once", Run: func() error {
+			replies, messages := play(enq, frame('1', header, config.ETX), frame('1', header, config.ETX), frame('2', end, config.ETX), eot)
+			return expect(replies, messages, ack+ack+ack+ack, header+end)
+		}},
+		{Protocol: "astm", Name: "etb_continuation", Expect: "record split over ETB frames reassembled", Run: func() error {
+			replies, messages := play(enq, frame('1', header, config.ETX), frame('2', result[:12], config.ETB), frame('3', result[12:], config.ETX), eot)
+			return expect(replies, messages, ack+ack+ack+ack, header+result)
+		}},
+		{Protocol: "astm", Name: "partial_message", Expect: "link lost before EOT, nothing processed", Run: func() error {
+			replies, messages := play(enq, frame('1', header, config.ETX), frame('2', result, config.ETX))
+			return expect(replies, messages, ack+ack+ack)
+		}},
+		{Protocol: "astm", Name: "stalled_session", Expect: "silent instrument's half-built frame discarded, next transmission clean", Run: func() error {
+			stalled := frame('1', header, config.ETX)
+			replies, messages := playStalled(enq+stalled[:len(stalled)/2], enq+frame('1', header, config.ETX)+frame('2', end, config.ETX)+eot)
+			return expect(replies, messages, ack+ack+ack+ack, header+end)
+		}},
+		{Protocol: "astm", Name: "serial_mode", Expect: "7E1 and 5-bit 1.5-stop settings mapped to the serial line mode", Run: func() error {
+			cfg := *config.Get()
+			cfg.ASTMDataBits, cfg.ASTMParity, cfg.ASTMStopBits = 7, "even", "1"
+			if err := cfg.Validate(); err != nil {
+				return err
+			}
+			if mode := serialMode(&cfg); mode.DataBits != 7 || mode.Parity != serial.EvenParity || mode.StopBits != serial.OneStopBit || frameFormat(&cfg) != "7E1" {
+				return fmt.Errorf("7E1 opened as %+v (%s)", *mode, frameFormat(&cfg))
+			}
+			cfg.ASTMDataBits, cfg.ASTMParity, cfg.ASTMStopBits = 5, "mark", "1.5"
+			if mode := serialMode(&cfg); mode.Parity != serial.MarkParity || mode.StopBits != serial.OnePointFiveStopBits {
+				return fmt.Errorf("5M1.5 opened as %+v", *mode)
+			}
+			cfg.ASTMDataBits = 7
+			if cfg.Validate() == nil {
+				return fmt.Errorf("1.5 stop bits with 7 data bits accepted")
+			}
+			return nil
+		}},
+		{Protocol: "astm", Name: "link_check", Expect: "ENQ then EOT ACKed, nothing processed", Run: func() error {
+			replies, messages := play(enq, eot)
+			return expect(replies, messages, ack)
+		}},
+		{Protocol: "astm", Name: "send_nak_retransmit", Expect: "frame NAKed by the instrument is sent again", Run: func() error {
+			port := &scriptedPort{in: bytes.NewReader([]byte(ack + nak + ack + ack))}
+			if err := transmit(port, []string{header, end}); err != nil {
+				return err
+			}
+			return expectSent(port.out.String(), enq+frame('1', header, config.ETX)+frame('1', header, config.ETX)+frame('2', end, config.ETX)+eot)
+		}},
+		{Protocol: "astm", Name: "send_retry_limit", Expect: "frame NAKed past the retry limit aborted with EOT", Run: func() error {
+			naks := strings.Repeat(nak, config.Get().ASTMSendRetryLimit+1)
+			port := &scriptedPort{in: bytes.NewReader([]byte(ack + naks))}
+			if err := transmit(port, []string{header, end}); err == nil {
+				return fmt.Errorf("transmission succeeded, want it aborted")
+			}
+			return expectSent(port.out.String(), enq+strings.Repeat(frame('1', header, config.ETX), config.Get().ASTMSendRetryLimit+1)+eot)
+		}},
+		{Protocol: "astm", Name: "query_response", Expect: "Q record answered with H/P/O/L, frame numbers wrapping 7 to 0", Run: func() error {
+			pending := types.PendingOrders{Patient: types.HL7Patient{ID: "PAT1", LastName: "DOE", FirstName: "JANE"}}
+			want := []string{"H|\\^&|||LightbaseGateway\r", "P|1|PAT1|||DOE^JANE\r"}
+			for i := 1; i <= 7; i++ {
+				pending.Orders = append(pending.Orders, types.OrderRequest{AccessionNumber: fmt.Sprintf("S%d", i), Tests: []string{"GLU", "HBA1C"}})
+				want = append(want, fmt.Sprintf("O|%d|S%d||^^^GLU\\^^^HBA1C|R||||||N||||||||||||||O\r", i, i))
+			}
+			want = append(want, "L|1|N\r")
+			replies, messages := playQuery(pending, len(want))
+			sent := ack + ack + ack + ack + enq
+			number := byte(0)
+			for _, record := range want {
+				number = nextFrameNumber(number)
+				sent += frame(number, record, config.ETX)
+			}
+			return expect(replies, messages, sent+eot)
+		}},
+		{Protocol: "astm", Name: "query_no_orders", Expect: "Q record for an unknown sample answered with L termination I", Run: func() error {
+			replies, messages := playQuery(types.PendingOrders{}, 2)
+			return expect(replies, messages, ack+ack+ack+ack+enq+frame('1', "H|\\^&|||LightbaseGateway\r", config.ETX)+frame('2', "L|1|I\r", config.ETX)+eot)
+		}},
+		{Protocol: "astm", Name: "byte_capture", Expect: "bytes received and ACKs sent recorded as RX/TX lines", Run: func() error {
+			dir, err := os.MkdirTemp("", "capture")
+			if err != nil {
+				return err
+			}
+			defer os.RemoveAll(dir)
+			cfg := *config.Get()
+			cfg.CaptureEnabled, cfg.CaptureDir = true, dir
+			config.Set(&cfg)
+
+			play(enq, frame('1', header, config.ETX), eot)
+			capture.Close()
+			files, _ := filepath.Glob(filepath.Join(dir, "astm-*.cap"))
+			if len(files) != 1 {
+				return fmt.Errorf("%d capture files written, want 1", len(files))
+			}
+			data, err := os.ReadFile(files[0])
+			if err != nil {
+				return err
+			}
+			var got []string
+			for _, line := range strings.Split(strings.TrimSpace(string(data)), "\n") {
+				fields := strings.Fields(line)
+				if len(fields) != 4 {
+					return fmt.Errorf("capture line %q, want time, direction, source and bytes", line)
+				}
+				raw, _ := hex.DecodeString(fields[3])
+				got = append(got, fields[1]+" "+describe(string(raw)))
+			}
+			// The frame is ACKed on its CR, so its LF is read after the ACK
+			sent := frame('1', header, config.ETX)
+			want := []string{"RX ENQ", "TX ACK", "RX " + describe(strings.TrimSuffix(sent, "\n")), "TX ACK", "RX LF EOT"}
+			if strings.Join(got, "\n") != strings.Join(want, "\n") {
+				return fmt.Errorf("captured %q, want %q", got, want)
+			}
+			return nil
+		}},
+		{Protocol: "astm", Name: "capture_replay", Expect: "captured session replayed through the parser, TX bytes ignored", Run: func() error {
+			dir, err := os.MkdirTemp("", "capture")
+			if err != nil {
+				return err
+			}
+			defer os.RemoveAll(dir)
+			line := func(direction, data string) string {
+				return time.Now().Format(time.RFC3339Nano) + " " + direction + " COM1 " + hex.EncodeToString([]byte(data)) + "\n"
+			}
+			path := filepath.Join(dir, "astm-20261015.cap")
+			script := line(capture.RX, enq) + line(capture.TX, ack) +
+				line(capture.RX, frame('1', header, config.ETX)) + line(capture.TX, ack) +
+				line(capture.RX, frame('2', result, config.ETX)) + line(capture.TX, ack) +
+				line(capture.RX, frame('3', end, config.ETX)) + line(capture.TX, ack) + line(capture.RX, eot)
+			if err := os.WriteFile(path, []byte(script), 0o600); err != nil {
+				return err
+			}
+
+			protocol, chunks, err := capture.Read(path)
+			if err != nil {
+				return err
+			}
+			if protocol != "astm" {
+				return fmt.Errorf("capture read as %s, want astm", protocol)
+			}
+			sources, rx := capture.Received(chunks)
+			if len(sources) != 1 {
+				return fmt.Errorf("%d sources replayed, want 1", len(sources))
+			}
+			var payloads []types.HL7Message
+			Replay(rx[sources[0]], sources[0], func(payload types.HL7Message) { payloads = append(payloads, payload) })
+			if len(payloads) != 1 {
+				return fmt.Errorf("%d payloads replayed, want 1", len(payloads))
+			}
+			return expectResult(payloads[0], "GLU", "5.2")
+		}},
+		{Protocol: "astm", Name: "custom_delimiters", Expect: "delimiters declared in H record honoured", Run: func() error {
+			payload, _ := BuildPayload("H!@#$!!!Conformance#1.0#SN1\rR!1!GLU#Glucose!5.2!mmol/L\rL!1", types.Transport{})
+			return expectResult(payload, "GLU", "5.2")
+		}},
+		{Protocol: "astm", Name: "unusable_delimiters", Expect: "bad H delimiter definition falls back to |\\^&", Run: func() error {
+			payload, _ := BuildPayload("H||||\rR|1|GLU^Glucose|5.2|mmol/L\rL|1", types.Transport{})
+			return expectResult(payload, "GLU", "5.2")
+		}},
+		{Protocol: "astm", Name: "record_separators", Expect: "instrument's own record separator preferred over \"*\"", Run: func() error {
+			cfg := *config.Get()
+			cfg.ASTMRecordSeparators = map[string]string{"*": "\n", "D10": "~", "C501": "!"}
+			config.Set(&cfg)
+			// Map order varies between runs, so check repeatedly
+			for range 20 {
+				for message, want := range map[string]string{
+					"H|\\^&|||D10~P|1~L|1":     "~",
+					"H|\\^&|||OTHER\nP|1\nL|1": "\n",
+				} {
+					if got := RecordSeparator(message); got != want {
+						return fmt.Errorf("separator %q for %q, want %q", got, message, want)
+					}
+				}
+			}
+			return nil
+		}},
+		{Protocol: "astm", Name: "result_fields", Expect: "every E1394 R-record field of an analyzer frame parsed", Run: func() error {
+			replies, messages := play(enq, frame('1', header, config.ETX), frame('2', "R|1|^^^GLU^1|5.2|mmol/L|3.9-5.5|H||F||OPERATOR||20240101120000|c501\r", config.ETX), eot)
+			if err := expect(replies, messages, ack+ack+ack, header+"R|1|^^^GLU^1|5.2|mmol/L|3.9-5.5|H||F||OPERATOR||20240101120000|c501\r"); err != nil {
+				return err
+			}
+			payload, _ := BuildPayload(messages[0], types.Transport{})
+			if err := expectResult(payload, "GLU", "5.2"); err != nil {
+				return err
+			}
+			r := payload.Results[0]
+			got := strings.Join([]string{r.Units, r.ReferenceRange, r.AbnormalFlags, r.Status, r.Timestamp}, " ")
+			if want := "mmol/L 3.9-5.5 H F 2024-01-01T12:00:00Z"; got != want {
+				return fmt.Errorf("parsed units, range, flags, status and time %q, want %q", got, want)
+			}
+			return nil
+		}},
+		{Protocol: "astm", Name: "multiple_orders", Expect: "each R attached to the O before it, reset by P", Run: func() error {
+			payload, _ := BuildPayload("H|\\^&\rP|1||PAT1\rO|1|S1\rR|1|GLU|5.2\rO|2|S2\rR|1|HBA1C|6.1\rR|2|CHOL|4.8\rP|2||PAT2\rR|1|NA|140\rL|1", types.Transport{})
+			var got []string
+			for _, r := range payload.Results {
+				got = append(got, r.TestCode+"@"+r.AccessionNumber)
+			}
+			if want := "GLU@S1 HBA1C@S2 CHOL@S2 NA@"; strings.Join(got, " ") != want {
+				return fmt.Errorf("results %s, want %s", strings.Join(got, " "), want)
+			}
+			return nil
+		}},
+		{Protocol: "astm", Name: "attending_physician", Expect: "P-14 ID kept apart from the physician's name", Run: func() error {
+			payload, _ := BuildPayload("H|\\^&\rP|1||PAT1||||||||||DR42^SMITH^JOHN\rR|1|GLU|5.2\rL|1", types.Transport{})
+			if p := payload.Patient; p.PhysicianID != "DR42" || p.Physician != "SMITH JOHN" {
+				return fmt.Errorf("physician parsed as ID %q name %q", p.PhysicianID, p.Physician)
+			}
+			return nil
+		}},
+	}
+}
+
+// expectSent compares what the gateway sent to the instrument with want
+func expectSent(sent, want string) error {
+	if sent != want {
+		return fmt.Errorf("sent %q, want %q", sent, want)
+	}
+	return nil
+}
+
+func expectResult(payload types.HL7Message, code, value string) error {
+	if len(payload.Results) != 1 {
+		return fmt.Errorf("%d result(s) parsed, want 1", len(payload.Results))
+	}
+	if r := payload.Results[0]; r.TestCode != code || r.Value != value {
+		return fmt.Errorf("parsed %s=%s, want %s=%s", r.TestCode, r.Value, code, value)
+	}
+	return nil
+}
@@ -2,31 +2,79 @@ package astm
 
 import (
 	"log"
+	"sort"
 	"strings"
 	"time"
 
 	"lightbaseEMRProxy/internal/config"
+	"lightbaseEMRProxy/internal/dedup"
+	"lightbaseEMRProxy/internal/logger"
+	"lightbaseEMRProxy/internal/normalize"
 	"lightbaseEMRProxy/internal/protocol/hl7"
 	"lightbaseEMRProxy/types"
 )
 
-func ProcessMessage(message string) {
-	log.Println("📦 [ASTM] Raw message received:")
-	log.Println(message)
-	log.Println(strings.Repeat("-", 60))
+// clock is the time source for parsing; replaceable for deterministic runs
+var clock = time.Now
 
+// processMessage handles each complete transmission; replaceable so the
+// conformance suite can capture transmissions instead of forwarding them
+var processMessage = ProcessMessage
+
+// sessions remembers recently received messages for duplicate-session suppression
+var sessions = dedup.New(func() time.Duration { return config.Get().SessionDedupWindow })
+
+// ProcessMessage parses a complete ASTM transmission received over source and queues it for forwarding
+func ProcessMessage(message string, source types.Transport) {
+	log.Println("📦 [ASTM] Message received")
+	if logger.RawAllowed() {
+		log.Println(message)
+		log.Println(strings.Repeat("-", 60))
+	}
+
+	if sessions.Seen(dedup.Hash(message)) {
+		log.Println("♻️  [ASTM] Duplicate session suppressed (identical transmission already received)")
+		return
+	}
+
+	payload, path := BuildPayload(message, source)
+
+	log.Printf("📦 [ASTM] Queueing for API: Order=%s Patient=%s Results=%d\n", payload.Order.AccessionNumber, logger.Redact(logger.PHIID, payload.Patient.ID), len(payload.Results))
+
+	hl7.Enqueue(payload, hl7.ResultsEndpoint(path))
+}
+
+// BuildPayload parses a complete ASTM transmission received over source
+// into the forwarding payload, returning it with the results path it is
+// posted to
+func BuildPayload(message string, source types.Transport) (types.HL7Message, string) {
 	// Check if this is Bio-Rad D-10 proprietary format
 	if strings.HasPrefix(message, "S03") {
-		processBioRadD10Message(message)
-		return
+		// The D-10 payload mirrors the HL7 shape and has always gone to the HL7 path
+		payload := parseBioRadD10Message(message, source)
+		normalize.MapCodes(&payload)
+		normalize.CoerceQualitative(&payload)
+		normalize.TrimNumericPadding(&payload)
+		normalize.ParseNumericValues(&payload)
+		return payload, config.Get().HL7Endpoint
 	}
 
 	// Standard ASTM processing
-	// Split by CR (0x0D) to get individual records
-	records := strings.Split(message, "\r")
-	results := []map[string]interface{}{}
-
-	var patientID, patientName, orderID string
+	// The H record declares the delimiters used by every record after it
+	delims := headerDelimiters(message)
+	// Split by CR (0x0D), or the instrument's configured separator, to get individual records
+	records := splitRecords(message)
+	var results []types.HL7Result
+	var unknown []types.RawRecord
+
+	var instrument, instrumentSerial, patientID, patientName, physician, physicianID, location, birthDate, sex, orderID, priority string
+
+	// C records annotate the record before them; parent tracks which one
+	var parent string
+	// currentOrder is the specimen ID of the O record results belong to:
+	// the closest one before them under the same P record
+	var currentOrder string
+	var patientComments, orderComments []string
 
 	for _, record := range records {
 		record = strings.TrimSpace(record)
@@ -36,7 +84,7 @@ func ProcessMessage(message string) {
 
 		log.Printf("[ASTM] Processing record: %s\n", record)
 
-		fields := strings.Split(record, "|")
+		fields := strings.Split(record, delims.field)
 		if len(fields) == 0 {
 			continue
 		}
@@ -45,32 +93,57 @@ func ProcessMessage(message string) {
 		switch recordType {
 		case "H":
 			// Header record - extract instrument info
+			// Field 4: Sender name or ID (name^software version^serial number)
 			instrumentInfo := getField(fields, 4)
-			log.Printf("[ASTM] Header: Instrument=%s\n", instrumentInfo)
+			instrument = delims.parseComponent(instrumentInfo, 0)
+			instrumentSerial = delims.parseComponent(instrumentInfo, 2)
+			log.Printf("[ASTM] Header: Instrument=%s Serial=%s Delimiters=%s\n", instrument, instrumentSerial, delims)
 		case "P":
 			// Patient record - field 2 is usually patient ID
 			patientID = getField(fields, 2)
+			// Field 5: Name (last^first^middle^suffix^title)
 			patientName = getField(fields, 5)
 			if patientID == "" {
 				patientID = getField(fields, 3)
 			}
-			log.Printf("[ASTM] Patient: ID=%s Name=%s\n", patientID, patientName)
+			// Field 7: Birthdate
+			birthDate = getField(fields, 7)
+			// Field 8: Sex (M/F/U)
+			sex = getField(fields, 8)
+			// Field 13: Attending physician (ID^last^first^...)
+			attending := getField(fields, 13)
+			physicianID = delims.parseComponent(attending, 0)
+			_, attendingName, _ := strings.Cut(attending, delims.component)
+			physician = delims.parseName(attendingName)
+			// Field 25: Patient location (ward/room/bed)
+			location = getField(fields, 25)
+			currentOrder = ""
+			log.Printf("[ASTM] Patient: ID=%s Name=%s Physician=%s Location=%s\n", logger.Redact(logger.PHIID, patientID), logger.Redact(logger.PHIName, patientName), physician, location)
+			parent = "P"
 		case "O":
 			// Order record - field 2 contains specimen ID
 			specimenID := getField(fields, 2)
 			// Extract the first part before ^
-			orderID = parseComponent(specimenID, 0)
-			log.Printf("[ASTM] Order: ID=%s\n", orderID)
+			orderID = delims.parseComponent(specimenID, 0)
+			currentOrder = orderID
+			// Field 5: Priority (S=STAT, A=ASAP, R=routine)
+			priority = getField(fields, 5)
+			log.Printf("[ASTM] Order: ID=%s Priority=%s\n", orderID, priority)
+			parent = "O"
 		case "R":
 			// Result record
-			// Field 2: Test ID (format: code^name^type)
+			// Field 2: Universal test ID (code^name^type^manufacturer's code);
+			// most analyzers leave the universal code empty and send ^^^code
 			testInfo := getField(fields, 2)
-			testCode := parseComponent(testInfo, 0)
-			testName := parseComponent(testInfo, 1)
+			testCode := delims.parseComponent(testInfo, 0)
+			if testCode == "" {
+				testCode = delims.parseComponent(testInfo, 3)
+			}
+			testName := delims.parseComponent(testInfo, 1)
 
 			// Field 3: Result value (may contain range like 0.003^4.000)
 			resultValue := getField(fields, 3)
-			value := parseComponent(resultValue, 0)
+			value := delims.parseComponent(resultValue, 0)
 
 			// Field 4: Units
 			units := getField(fields, 4)
@@ -85,66 +158,110 @@ func ProcessMessage(message string) {
 			resultStatus := getField(fields, 8)
 
 			// Field 12: Analysis timestamp
-			timestamp := parseDateTime(getField(fields, 12))
-
-			result := map[string]interface{}{
-				"test_code":       testCode,
-				"test_name":       testName,
-				"value":           value,
-				"units":           units,
-				"reference_range": refRange,
-				"abnormal_flags":  abnormalFlags,
-				"result_status":   resultStatus,
-				"timestamp":       timestamp,
+			timestamp, fallback := parseDateTime(getField(fields, 12))
+
+			result := types.HL7Result{
+				AccessionNumber: currentOrder,
+				TestCode:        testCode,
+				TestName:        testName,
+				Value:           value,
+				Units:           units,
+				ReferenceRange:  refRange,
+				AbnormalFlags:   abnormalFlags,
+				Status:          resultStatus,
+				Timestamp:       timestamp,
+			}
+			if fallback {
+				result.Warnings = append(result.Warnings, types.WarningTimestampFallback)
+			}
+			if absent := absentFields(fields, resultFieldIndexes); len(absent) > 0 {
+				result.Warnings = append(result.Warnings, types.WarningFieldsAbsent)
+				if config.Get().ASTMReportAbsentFields {
+					result.AbsentFields = absent
+				}
 			}
 			results = append(results, result)
 			log.Printf("[ASTM] Result added: %s (%s) = %s %s\n", testName, testCode, value, units)
+			parent = "R"
+		case "C":
+			// Comment record - field 3 is the text, which may be split into components
+			comment := delims.parseName(getField(fields, 3))
+			if comment == "" {
+				continue
+			}
+			switch parent {
+			case "R":
+				last := &results[len(results)-1]
+				last.Comments = append(last.Comments, comment)
+			case "O":
+				orderComments = append(orderComments, comment)
+			case "P":
+				patientComments = append(patientComments, comment)
+			default:
+				log.Printf("[ASTM] Comment with no patient, order or result before it ignored\n")
+				continue
+			}
+			log.Printf("[ASTM] Comment on %s record: %s\n", parent, comment)
 		case "L":
 			// Terminator record
 			log.Printf("[ASTM] Terminator record received\n")
+		default:
+			switch config.Get().ASTMUnknownRecords {
+			case "log":
+				log.Printf("[ASTM] Unknown record type %q ignored\n", recordType)
+			case "capture":
+				log.Printf("[ASTM] Unknown record type %q captured\n", recordType)
+				unknown = append(unknown, types.RawRecord{Type: recordType, Fields: fields[1:]})
+			}
 		}
 	}
 
 	// Send to API even if no results (for debugging)
-	now := time.Now().Format(time.RFC3339)
+	now := clock().Format(time.RFC3339)
 	payload := types.HL7Message{
-		Source:     "astm_bridge",
-		MessageID:  orderID,
-		ReceivedAt: now,
-		CreatedAt:  now,
+		Source:           "astm_bridge",
+		Protocol:         "astm",
+		Instrument:       instrument,
+		InstrumentSerial: instrumentSerial,
+		MessageID:        orderID,
+		ReceivedAt:       now,
+		CreatedAt:        now,
 		Patient: types.HL7Patient{
-			ID:   patientID,
-			Name: patientName,
+			ID:          patientID,
+			Name:        patientName,
+			LastName:    delims.parseComponent(patientName, 0),
+			FirstName:   delims.parseComponent(patientName, 1),
+			MiddleName:  delims.parseComponent(patientName, 2),
+			Physician:   physician,
+			PhysicianID: physicianID,
+			Location:    location,
+			Sex:         sex,
+			Comments:    patientComments,
 		},
 		Order: types.HL7Order{
 			AccessionNumber: orderID,
+			Priority:        priority,
+			Comments:        orderComments,
 		},
+		Results:        results,
+		Transport:      source.Stamp(),
+		UnknownRecords: unknown,
 	}
-
-	for _, r := range results {
-		payload.Results = append(payload.Results, types.HL7Result{
-			ObservationID:  "",
-			TestCode:       r["test_code"].(string),
-			TestName:       r["test_name"].(string),
-			Value:          r["value"].(string),
-			Units:          r["units"].(string),
-			ReferenceRange: r["reference_range"].(string),
-			AbnormalFlags:  r["abnormal_flags"].(string),
-			Status:         r["result_status"].(string),
-			Timestamp:      r["timestamp"].(string),
-		})
+	if dob, ok := parseBirthDate(birthDate); ok {
+		payload.Patient.BirthDate = dob.Format("2006-01-02")
+		age := ageAt(dob, resultTime(results))
+		payload.Patient.AgeYears = &age
 	}
 
-	log.Printf("📦 [ASTM] Sending to API: Order=%s Patient=%s Results=%d\n", orderID, patientID, len(results))
-
-	if err := hl7.SendToExternalSaver(payload, config.ExternalServerURL+"/hl7/receives"); err != nil {
-		log.Printf("❌ [ASTM] Forward failed [%s]: %v\n", orderID, err)
-	} else {
-		log.Printf("✅ [ASTM] Data forwarded successfully [%s]\n", orderID)
-	}
+	normalize.MapCodes(&payload)
+	normalize.CoerceQualitative(&payload)
+	normalize.TrimNumericPadding(&payload)
+	normalize.ParseNumericValues(&payload)
+	normalize.ApplyReferenceRanges(&payload)
+	return payload, config.Get().ASTMEndpoint
 }
 
-func processBioRadD10Message(message string) {
+func parseBioRadD10Message(message string, source types.Transport) types.HL7Message {
 	log.Println("🔬 [ASTM] Detected Bio-Rad D-10 HbA1c format")
 
 	// Extract header information
@@ -194,7 +311,7 @@ func processBioRadD10Message(message string) {
 	}
 
 	results := []types.HL7Result{}
-	now := time.Now().Format(time.RFC3339)
+	now := clock().Format(time.RFC3339)
 
 	// Map numeric values to peak names
 	for i, peakName := range peakNames {
@@ -244,7 +361,9 @@ func processBioRadD10Message(message string) {
 	}
 
 	payload := types.HL7Message{
-		Source:     config.LABSLUG,
+		Source:     config.Get().LABSLUG,
+		Protocol:   "astm",
+		Instrument: "Bio-Rad D-10",
 		MessageID:  sampleID,
 		ReceivedAt: now,
 		CreatedAt:  now,
@@ -255,16 +374,114 @@ func processBioRadD10Message(message string) {
 		Order: types.HL7Order{
 			AccessionNumber: sampleID,
 		},
-		Results: results,
+		Results:   results,
+		Transport: source.Stamp(),
+	}
+
+	log.Printf("🔬 [ASTM] Bio-Rad D-10 data: Sample=%s Results=%d\n", sampleID, len(results))
+
+	return payload
+}
+
+// recordField names an output field and its index within a record
+type recordField struct {
+	name  string
+	index int
+}
+
+// resultFieldIndexes maps R-record output names to their field index
+var resultFieldIndexes = []recordField{
+	{"value", 3},
+	{"units", 4},
+	{"reference_range", 5},
+	{"abnormal_flags", 6},
+	{"result_status", 8},
+	{"timestamp", 12},
+}
+
+// absentFields lists the output names whose fields were cut off the end
+// of a short record, as opposed to being present but empty
+func absentFields(fields []string, indexes []recordField) []string {
+	var absent []string
+	for _, f := range indexes {
+		if f.index >= len(fields) {
+			absent = append(absent, f.name)
+		}
+	}
+	return absent
+}
+
+// RecordSeparator returns the record separator for message: the one
+// configured for the instrument named in its H record, else the "*" one,
+// else CR. A separator that collides with the field or component
+// delimiter declared in the H record is ignored.
+func RecordSeparator(message string) string {
+	if !strings.HasPrefix(message, "H") || len(message) < 5 {
+		return "\r"
+	}
+	delims := headerDelimiters(message)
+	separators := config.Get().ASTMRecordSeparators
+	usable := func(instrument, sep string) bool {
+		if sep == "" || sep == "\r" {
+			return false
+		}
+		if delims.contains(sep) {
+			log.Printf("⚠️  [ASTM] Record separator %q for %s collides with the H-record delimiters — ignored\n", sep, instrument)
+			return false
+		}
+		return true
+	}
+
+	// Where the H record ends depends on the separator, so each
+	// instrument's own separator is tried in turn to read its name
+	instruments := make([]string, 0, len(separators))
+	for instrument := range separators {
+		if instrument != "*" {
+			instruments = append(instruments, instrument)
+		}
+	}
+	sort.Strings(instruments)
+	for _, instrument := range instruments {
+		sep := separators[instrument]
+		if !usable(instrument, sep) {
+			continue
+		}
+		header := strings.SplitN(splitAfterDelimiters(message, sep)[0], "\r", 2)[0]
+		if delims.parseComponent(getField(strings.Split(header, delims.field), 4), 0) == instrument {
+			return sep
+		}
 	}
 
-	log.Printf("📦 [ASTM] Sending Bio-Rad D-10 data: Sample=%s Results=%d\n", sampleID, len(results))
+	if sep, ok := separators["*"]; ok && usable("*", sep) {
+		return sep
+	}
+	return "\r"
+}
+
+// splitRecords splits message into records on its record separator. CR
+// still ends a record when a custom separator is in use, since frames end
+// with one.
+func splitRecords(message string) []string {
+	sep := RecordSeparator(message)
+	if sep == "\r" {
+		return strings.Split(message, "\r")
+	}
+	var records []string
+	for _, part := range splitAfterDelimiters(message, sep) {
+		records = append(records, strings.Split(part, "\r")...)
+	}
+	return records
+}
 
-	if err := hl7.SendToExternalSaver(payload, config.ExternalServerURL+"/hl7/receive"); err != nil {
-		log.Printf("❌ [ASTM] Forward failed [%s]: %v\n", sampleID, err)
-	} else {
-		log.Printf("✅ [ASTM] Bio-Rad D-10 data forwarded successfully [%s]\n", sampleID)
+// splitAfterDelimiters splits message on sep or CR, leaving the H-record
+// delimiter definition (e.g. "|\^&") intact since sep may be one of them
+func splitAfterDelimiters(message, sep string) []string {
+	if len(message) < 5 {
+		return strings.Split(message, sep)
 	}
+	parts := strings.Split(message[5:], sep)
+	parts[0] = message[:5] + parts[0]
+	return parts
 }
 
 func getField(fields []string, index int) string {
@@ -274,33 +491,147 @@ func getField(fields []string, index int) string {
 	return strings.TrimSpace(fields[index])
 }
 
-func parseComponent(field string, componentIndex int) string {
-	components := strings.Split(field, "^")
-	if componentIndex >= len(components) {
+// delimiters are the separators an ASTM message declares in its H record
+type delimiters struct {
+	field, repeat, component, escape string
+}
+
+// standardDelimiters are the delimiters of "H|\^&", used when a message
+// has no usable H record
+var standardDelimiters = delimiters{field: "|", repeat: "\\", component: "^", escape: "&"}
+
+// headerDelimiters reads the delimiter definition from the H record that
+// opens message: the field delimiter right after "H", then the repeat,
+// component and escape delimiters. A definition that is missing, repeats a
+// character or uses a letter, digit or CR falls back to the standard set.
+func headerDelimiters(message string) delimiters {
+	if !strings.HasPrefix(message, "H") || len(message) < 5 {
+		return standardDelimiters
+	}
+	def := message[1:5]
+	for i := 0; i < len(def); i++ {
+		c := def[i]
+		if c == config.CR || c == config.LF || c == ' ' || ('0' <= c && c <= '9') || ('A' <= c && c <= 'Z') || ('a' <= c && c <= 'z') || strings.IndexByte(def[i+1:], c) >= 0 {
+			log.Printf("⚠️  [ASTM] Unusable H-record delimiter definition %q — using standard delimiters\n", def)
+			return standardDelimiters
+		}
+	}
+	return delimiters{field: def[0:1], repeat: def[1:2], component: def[2:3], escape: def[3:4]}
+}
+
+func (d delimiters) String() string {
+	return d.field + d.repeat + d.component + d.escape
+}
+
+// contains reports whether s is one of the delimiters
+func (d delimiters) contains(s string) bool {
+	return s == d.field || s == d.repeat || s == d.component || s == d.escape
+}
+
+// parseComponent returns the index'th component of field
+func (d delimiters) parseComponent(field string, index int) string {
+	components := strings.Split(field, d.component)
+	if index >= len(components) {
 		return ""
 	}
-	return strings.TrimSpace(components[componentIndex])
+	return strings.TrimSpace(components[index])
 }
 
-func parseDateTime(dateTime string) string {
+// parseName joins the non-empty components of a component-delimited field
+// (e.g. "1234^SMITH^JOHN") into a single readable string.
+func (d delimiters) parseName(field string) string {
+	var parts []string
+	for _, c := range strings.Split(field, d.component) {
+		if c = strings.TrimSpace(c); c != "" {
+			parts = append(parts, c)
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// birthDateLayouts are the birthdate formats seen from instruments, most specific first
+var birthDateLayouts = []string{"20060102150405", "200601021504", "20060102", "2006-01-02", "02/01/2006", "02.01.2006"}
+
+func parseBirthDate(value string) (time.Time, bool) {
+	value = strings.TrimSpace(value)
+	for _, layout := range birthDateLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// resultTime is the analysis time of the first result, or now when there is none
+func resultTime(results []types.HL7Result) time.Time {
+	if len(results) > 0 {
+		if t, err := time.Parse(time.RFC3339, results[0].Timestamp); err == nil {
+			return t
+		}
+	}
+	return clock()
+}
+
+// ageAt returns the age in whole years of someone born on dob at time at
+func ageAt(dob, at time.Time) int {
+	age := at.Year() - dob.Year()
+	if at.Month() < dob.Month() || (at.Month() == dob.Month() && at.Day() < dob.Day()) {
+		age--
+	}
+	return age
+}
+
+// parseDateTime converts an ASTM timestamp to RFC 3339, falling back to the
+// current time (and reporting fallback) when it is missing or unparseable
+func parseDateTime(dateTime string) (formatted string, fallback bool) {
 	dateTime = strings.TrimSpace(dateTime)
 	if len(dateTime) < 8 {
-		return time.Now().Format(time.RFC3339)
+		return clock().Format(time.RFC3339), true
 	}
 
 	layout := "20060102150405"
 	if len(dateTime) >= 14 {
 		t, err := time.Parse(layout, dateTime[:14])
 		if err == nil {
-			return t.Format(time.RFC3339)
+			return t.Format(time.RFC3339), false
 		}
 	}
 
 	layout = "20060102"
 	t, err := time.Parse(layout, dateTime[:8])
 	if err == nil {
-		return t.Format(time.RFC3339)
+		return t.Format(time.RFC3339), false
 	}
 
-	return time.Now().Format(time.RFC3339)
+	return clock().Format(time.RFC3339), true
+}
+
+// Deframe extracts the message text from raw ASTM bytes as captured off
+// the wire: the contents of each STX...ETX/ETB frame without frame
+// numbers or checksums. Input with no frames is returned as plain text
+// with line endings normalised to CR.
+func Deframe(raw []byte) string {
+	var message strings.Builder
+	inFrame, sawFrame, skipFrameNumber := false, false, false
+
+	for _, b := range raw {
+		switch {
+		case b == config.STX:
+			inFrame, sawFrame, skipFrameNumber = true, true, true
+		case !inFrame:
+		case b == config.ETX || b == config.ETB:
+			inFrame = false
+		case skipFrameNumber:
+			skipFrameNumber = false
+		default:
+			message.WriteByte(b)
+		}
+	}
+
+	if !sawFrame {
+		text := strings.Trim(string(raw), string([]byte{config.ENQ, config.EOT, config.CR, config.LF}))
+		text = strings.ReplaceAll(text, "\r\n", "\r")
+		return strings.ReplaceAll(text, "\n", "\r")
+	}
+	return message.String()
 }
@@ -0,0 +1,117 @@
+package astm
+
+import (
+	"log"
+	"strconv"
+	"strings"
+
+	"lightbaseEMRProxy/internal/protocol/hl7"
+	"lightbaseEMRProxy/types"
+)
+
+// lookupOrders fetches a sample's pending orders; replaceable so the
+// conformance suite can answer queries without a server
+var lookupOrders = hl7.LookupOrders
+
+// queriedSamples returns the specimen IDs asked for by the Q records of
+// message. Q-3 carries "patient ID^specimen ID" and may repeat; a range
+// without a specimen component is taken as the specimen ID itself.
+func queriedSamples(message string) []string {
+	d := headerDelimiters(message)
+	var ids []string
+	for _, record := range splitRecords(message) {
+		fields := strings.Split(record, d.field)
+		if fields[0] != "Q" {
+			continue
+		}
+		for _, rng := range strings.Split(getField(fields, 2), d.repeat) {
+			id := d.parseComponent(rng, 1)
+			if id == "" {
+				id = d.parseComponent(rng, 0)
+			}
+			if id != "" && id != "ALL" {
+				ids = append(ids, id)
+			}
+		}
+	}
+	return ids
+}
+
+// answerQuery downloads the pending orders for each queried sample to the
+// instrument as H, P, O and L records. The L record's termination code is
+// N when orders were sent, I when the server has none and Q when the
+// lookup failed.
+func answerQuery(port Port, message string, sampleIDs []string) {
+	d := headerDelimiters(message)
+	records := []string{queryRecord(d, "H", d.repeat+d.component+d.escape, "", "", "LightbaseGateway")}
+
+	termination := "I"
+	patients := 0
+	for _, id := range sampleIDs {
+		pending, ok, err := lookupOrders(id)
+		if err != nil {
+			log.Printf("❌ [ASTM] Could not look up orders for %s: %v\n", id, err)
+			termination = "Q"
+			continue
+		}
+		if !ok {
+			log.Printf("🔎 [ASTM] No pending orders for %s\n", id)
+			continue
+		}
+		patients++
+		records = append(records, patientRecord(d, patients, pending.Patient))
+		for i, order := range pending.Orders {
+			records = append(records, orderRecord(d, i+1, order))
+		}
+		if termination == "I" {
+			termination = "N"
+		}
+	}
+	records = append(records, queryRecord(d, "L", "1", termination))
+
+	if err := transmit(port, records); err != nil {
+		log.Printf("❌ [ASTM] Order download failed: %v\n", err)
+		return
+	}
+	log.Printf("📤 [ASTM] Answered query for %s: %d patient(s), termination %s\n", strings.Join(sampleIDs, ", "), patients, termination)
+}
+
+// queryRecord joins fields with the field delimiter, dropping trailing
+// empty fields
+func queryRecord(d delimiters, fields ...string) string {
+	for len(fields) > 1 && fields[len(fields)-1] == "" {
+		fields = fields[:len(fields)-1]
+	}
+	return strings.Join(fields, d.field) + "\r"
+}
+
+func patientRecord(d delimiters, seq int, patient types.HL7Patient) string {
+	name := patient.Name
+	if patient.LastName != "" || patient.FirstName != "" {
+		name = strings.TrimRight(strings.Join([]string{patient.LastName, patient.FirstName, patient.MiddleName}, d.component), d.component)
+	}
+	var dob string
+	if t, ok := parseBirthDate(patient.BirthDate); ok {
+		dob = t.Format("20060102")
+	}
+	// P-3 practice patient ID, P-6 name, P-8 birthdate, P-9 sex
+	return queryRecord(d, "P", strconv.Itoa(seq), patient.ID, "", "", name, "", dob, patient.Sex)
+}
+
+func orderRecord(d delimiters, seq int, order types.OrderRequest) string {
+	tests := make([]string, len(order.Tests))
+	for i, code := range order.Tests {
+		tests[i] = strings.Repeat(d.component, 3) + code
+	}
+	priority := strings.ToUpper(order.Priority)
+	if priority != "S" && priority != "A" {
+		priority = "R"
+	}
+	fields := make([]string, 26)
+	fields[0], fields[1], fields[2] = "O", strconv.Itoa(seq), order.AccessionNumber
+	fields[4] = strings.Join(tests, d.repeat)
+	fields[5] = priority
+	fields[11] = "N" // action code: new order
+	fields[25] = "O" // report type: order record
+	return queryRecord(d, fields...)
+}
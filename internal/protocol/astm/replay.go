@@ -0,0 +1,42 @@
+package astm
+
+import (
+	"bytes"
+	"context"
+	"io"
+	"time"
+
+	"lightbaseEMRProxy/types"
+)
+
+// scriptedPort plays back bytes an instrument would send and records the
+// gateway's replies; the end of the script reads as a closed link
+type scriptedPort struct {
+	in  *bytes.Reader
+	out bytes.Buffer
+}
+
+func (p *scriptedPort) Read(b []byte) (int, error) {
+	if p.in.Len() == 0 {
+		return 0, io.EOF
+	}
+	return p.in.Read(b)
+}
+
+func (p *scriptedPort) Write(b []byte) (int, error)          { return p.out.Write(b) }
+func (p *scriptedPort) SetReadTimeout(t time.Duration) error { return nil }
+
+// Replay runs bytes an instrument sent over source through the same
+// session handling as a live port and passes each transmission's parsed
+// payload to emit instead of forwarding it
+func Replay(rx []byte, source string, emit func(types.HL7Message)) {
+	saved := processMessage
+	defer func() { processMessage = saved }()
+	processMessage = func(message string, source types.Transport) {
+		payload, _ := BuildPayload(message, source)
+		emit(payload)
+	}
+
+	port := &scriptedPort{in: bytes.NewReader(rx)}
+	HandlePort(context.Background(), port, types.Transport{Kind: "replay", Address: source, ConnectedAt: time.Now()})
+}
@@ -2,12 +2,22 @@ package astm
 
 import (
 	"bytes"
+	"context"
 	"fmt"
 	"log"
+	"log/slog"
 	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 
+	"lightbaseEMRProxy/internal/capture"
 	"lightbaseEMRProxy/internal/config"
+	"lightbaseEMRProxy/internal/events"
+	"lightbaseEMRProxy/internal/logger"
+	"lightbaseEMRProxy/internal/metrics"
+	"lightbaseEMRProxy/internal/session"
+	"lightbaseEMRProxy/types"
 
 	"go.bug.st/serial"
 )
@@ -19,39 +29,167 @@ type Port interface {
 	SetReadTimeout(t time.Duration) error
 }
 
-// StartSerialListener starts the ASTM serial port listener
-func StartSerialListener() {
-	mode := &serial.Mode{
-		BaudRate: config.ASTMBaudRate,
-		DataBits: 8,
-		Parity:   serial.NoParity,
-		StopBits: serial.OneStopBit,
+// framesReceived counts frames accepted from instruments
+var framesReceived = metrics.NewCounter("astm_frames_total", "ASTM frames accepted from instruments")
+
+// active counts instrument links with a session handler running, so
+// shutdown can wait for transmissions in progress to finish
+var active session.Group
+
+// WaitSessions waits up to timeout for every running ASTM session to
+// finish, reporting whether they all did
+func WaitSessions(timeout time.Duration) bool {
+	return active.Wait(timeout)
+}
+
+// sleep pauses for d, returning false if ctx is canceled first
+func sleep(ctx context.Context, d time.Duration) bool {
+	select {
+	case <-ctx.Done():
+		return false
+	case <-time.After(d):
+		return true
 	}
+}
 
-	log.Printf("📡 [ASTM] Opening %s at %d baud...\n", config.ASTMComPort, config.ASTMBaudRate)
+// Serial port state reported by SerialStatus
+var (
+	serialOpen     atomic.Bool
+	serialLastRead atomic.Int64 // UnixNano of the last read that did not fail
+)
 
-	for {
-		port, err := serial.Open(config.ASTMComPort, mode)
+// SerialStatus reports whether the serial port is open and when it was last
+// read without error; idle reads that time out count, so an open port with
+// a silent instrument stays fresh
+func SerialStatus() (open bool, lastRead time.Time) {
+	return serialOpen.Load(), time.Unix(0, serialLastRead.Load())
+}
+
+// statusPort records successful reads for SerialStatus
+type statusPort struct {
+	Port
+}
+
+func (p *statusPort) Read(b []byte) (int, error) {
+	n, err := p.Port.Read(b)
+	if err == nil {
+		serialLastRead.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
+
+// openedPort is a Port that can be closed, as returned by openPort
+type openedPort interface {
+	Port
+	Close() error
+}
+
+// openPort opens the serial port; a variable so an unplugged adapter can be
+// simulated
+var openPort = func(name string, mode *serial.Mode) (openedPort, error) {
+	return serial.Open(name, mode)
+}
+
+// serialParity and serialStopBits map the astm_parity and astm_stop_bits
+// settings to their serial package values
+var (
+	serialParity = map[string]serial.Parity{
+		"none":  serial.NoParity,
+		"even":  serial.EvenParity,
+		"odd":   serial.OddParity,
+		"mark":  serial.MarkParity,
+		"space": serial.SpaceParity,
+	}
+	serialStopBits = map[string]serial.StopBits{
+		"1":   serial.OneStopBit,
+		"1.5": serial.OnePointFiveStopBits,
+		"2":   serial.TwoStopBits,
+	}
+)
+
+// serialMode is the line setting of the ASTM serial port; cfg has been
+// validated, so every setting is one the maps know
+func serialMode(cfg *config.Config) *serial.Mode {
+	return &serial.Mode{
+		BaudRate: cfg.ASTMBaudRate,
+		DataBits: cfg.ASTMDataBits,
+		Parity:   serialParity[cfg.ASTMParity],
+		StopBits: serialStopBits[cfg.ASTMStopBits],
+	}
+}
+
+// frameFormat is the conventional short form of the line setting, e.g. 8N1 or 7E1
+func frameFormat(cfg *config.Config) string {
+	return fmt.Sprintf("%d%s%s", cfg.ASTMDataBits, strings.ToUpper(cfg.ASTMParity[:1]), cfg.ASTMStopBits)
+}
+
+// StartSerialListener starts the ASTM serial port listener and returns once
+// ctx is canceled and the port is closed. A port that fails, e.g. a USB
+// adapter being unplugged, is closed and reopened with backoff.
+func StartSerialListener(ctx context.Context) {
+	mode := serialMode(config.Get())
+
+	log.Printf("📡 [ASTM] Opening %s at %d baud, %s...\n", config.Get().ASTMComPort, mode.BaudRate, frameFormat(config.Get()))
+
+	delay := config.Get().SerialReconnect
+	for ctx.Err() == nil {
+		port, err := openPort(config.Get().ASTMComPort, mode)
 		if err != nil {
-			log.Printf("❌ [ASTM] Could not open %s: %v — retrying in 5s\n", config.ASTMComPort, err)
-			time.Sleep(5 * time.Second)
+			log.Printf("❌ [ASTM] Could not open %s: %v — retrying in %s\n", config.Get().ASTMComPort, err, delay)
+			sleep(ctx, delay)
+			delay = min(delay*2, config.Get().SerialReconnectMax)
 			continue
 		}
+		opened := time.Now()
+		serialOpen.Store(true)
+		serialLastRead.Store(opened.UnixNano())
 
-		log.Printf("✅ [ASTM] %s open — waiting for ENQ from instrument...\n", config.ASTMComPort)
-		HandlePort(port)
+		log.Printf("✅ [ASTM] %s open — waiting for ENQ from instrument...\n", config.Get().ASTMComPort)
+		var p Port = &statusPort{Port: port}
+		if config.Get().SerialWarmup > 0 {
+			p = &warmupPort{Port: p, until: clock().Add(config.Get().SerialWarmup)}
+		}
+		active.Add()
+		HandlePort(ctx, p, types.Transport{Kind: "serial", Address: config.Get().ASTMComPort, ConnectedAt: time.Now()})
 		port.Close()
-		log.Printf("⚠️  [ASTM] Session ended, reopening %s...\n", config.ASTMComPort)
-		time.Sleep(1 * time.Second)
+		serialOpen.Store(false)
+		active.Done()
+		if ctx.Err() != nil {
+			log.Printf("🛑 [ASTM] %s closed\n", config.Get().ASTMComPort)
+			return
+		}
+		// A port that fails again straight after reopening keeps backing off
+		if time.Since(opened) > config.Get().SerialReconnectMax {
+			delay = config.Get().SerialReconnect
+		}
+		log.Printf("⚠️  [ASTM] Port closed, reopening %s in %s...\n", config.Get().ASTMComPort, delay)
+		sleep(ctx, delay)
+		delay = min(delay*2, config.Get().SerialReconnectMax)
 	}
 }
 
-// HandlePort handles ASTM communication on a port
-func HandlePort(port Port) {
+// idlePoll is how long an idle link is read before checking for shutdown
+const idlePoll = time.Second
+
+// HandlePort handles ASTM communication on a port until it fails or ctx is
+// canceled; a session in progress is finished first. source describes the
+// link and is attached to every forwarded message.
+func HandlePort(ctx context.Context, port Port, source types.Transport) {
+	var timeline *logger.Timeline
+	if config.Get().ControlTimeline {
+		timeline = logger.NewTimeline("ASTM")
+		port = &timelinePort{Port: port, timeline: timeline}
+	}
+	defer timeline.Flush()
+	if recorder := capture.New("astm", source.Address); recorder != nil {
+		port = &capturePort{Port: port, recorder: recorder}
+		defer recorder.Flush()
+	}
+
 	buf := make([]byte, 1)
 
-	for {
-		port.SetReadTimeout(30 * time.Second)
+	for ctx.Err() == nil {
+		port.SetReadTimeout(idlePoll)
 		n, err := port.Read(buf)
 		if err != nil {
 			log.Printf("⚠️  [ASTM] Port error: %v — closing port\n", err)
@@ -62,23 +200,35 @@ func HandlePort(port Port) {
 		}
 
 		b := buf[0]
-		log.Printf("[ASTM] Byte received: 0x%02X (%s)\n", b, byteDesc(b))
+		if isKeepalive(b) {
+			handleKeepalive(port, b)
+			continue
+		}
+		// Printable bytes are message content, so they are not traced while redacting
+		if !config.Get().RedactPHI || b < 32 {
+			slog.Debug("byte received", "protocol", "astm", "byte", fmt.Sprintf("0x%02X", b), "desc", byteDesc(b))
+		}
 
 		if b == config.ENQ {
 			log.Println("📥 [ASTM] ENQ received — starting transmission")
-			if _, err := port.Write([]byte{config.ACK}); err != nil {
+			if err := writeWithTimeout(port, []byte{config.ACK}); err != nil {
 				log.Println("❌ [ASTM] Failed to send ACK:", err)
 				return
 			}
-			handleSession(port)
+			publish(events.SessionStart, source, "")
+			handleSession(port, source)
+			timeline.Flush()
 		} else if b == config.STX {
 			log.Println("📥 [ASTM] STX received — starting direct transmission (no ENQ)")
-			handleSessionDirect(port, b)
+			publish(events.SessionStart, source, "direct")
+			handleSessionDirect(port, b, source)
+			publish(events.SessionEnd, source, "")
+			timeline.Flush()
 		}
 	}
 }
 
-func handleSession(port Port) {
+func handleSession(port Port, source types.Transport) {
 	type state int
 	const (
 		idle state = iota
@@ -88,49 +238,150 @@ func handleSession(port Port) {
 
 	var fullMessage strings.Builder
 	var frame bytes.Buffer
+	var trailer bytes.Buffer
 	frameCount := 0
-	tailCount := 0
 	cur := idle
 	buf := make([]byte, 1)
 
+	// pending holds the data of the frame awaiting ACK/NAK and checksummed
+	// the bytes the checksum covers; continued is set while the previous
+	// frame ended with ETB, so pending resumes a record
+	var pending, checksummed string
+	hasPending, continued, frameEnd := false, false, byte(0)
+	naks := 0
+	var lastFrameNumber byte // frame number of the last accepted frame, 0 before the first
+
 	readByte := func() (byte, bool) {
-		port.SetReadTimeout(10 * time.Second)
+		port.SetReadTimeout(config.Get().ASTMSessionTimeout)
 		n, err := port.Read(buf)
 		if err != nil {
 			log.Printf("⚠️  [ASTM] Session read error: %v\n", err)
 			return 0, false
 		}
 		if n == 0 {
-			log.Println("⚠️  [ASTM] Session timed out — no data for 10s")
+			sessionTimedOut(source, frameCount)
 			return 0, false
 		}
 		return buf[0], true
 	}
 
 	ackFrame := func() bool {
-		if _, err := port.Write([]byte{config.ACK}); err != nil {
+		if hasPending && config.Get().ASTMVerifyChecksum && !validChecksum(checksummed, trailer.String()) {
+			hasPending = false
+			if err := writeWithTimeout(port, []byte{config.NAK}); err != nil {
+				log.Println("❌ [ASTM] Failed to NAK frame:", err)
+				return false
+			}
+			log.Printf("🔁 [ASTM] Frame checksum mismatch (expected %s, trailer %q) — NAKed for retransmission\n", frameChecksum(checksummed), trailer.String())
+			return true
+		}
+
+		if hasPending && config.Get().ASTMCheckFrameNumbers {
+			number := checksummed[0]
+			if number == lastFrameNumber {
+				// The analyzer missed our ACK and sent the frame again
+				hasPending = false
+				if err := writeWithTimeout(port, []byte{config.ACK}); err != nil {
+					log.Println("❌ [ASTM] Failed to ACK frame:", err)
+					return false
+				}
+				log.Printf("♻️  [ASTM] Frame %c received twice — ACKed and discarded\n", number)
+				return true
+			}
+			if want := nextFrameNumber(lastFrameNumber); number != want {
+				hasPending = false
+				if err := writeWithTimeout(port, []byte{config.NAK}); err != nil {
+					log.Println("❌ [ASTM] Failed to NAK frame:", err)
+					return false
+				}
+				log.Printf("🔁 [ASTM] Frame number %q out of sequence (expected %c) — NAKed\n", number, want)
+				return true
+			}
+		}
+
+		if hasPending && config.Get().ASTMNAKUnparseable && !continued && !startsWithRecord(pending) {
+			if naks < config.Get().ASTMNAKRetryLimit {
+				naks++
+				hasPending = false
+				if err := writeWithTimeout(port, []byte{config.NAK}); err != nil {
+					log.Println("❌ [ASTM] Failed to NAK frame:", err)
+					return false
+				}
+				log.Printf("🔁 [ASTM] Unparseable frame NAKed for retransmission (%d/%d)\n", naks, config.Get().ASTMNAKRetryLimit)
+				return true
+			}
+			log.Printf("⚠️  [ASTM] Frame still unparseable after %d retransmission(s) — accepting it\n", naks)
+		}
+
+		if err := writeWithTimeout(port, []byte{config.ACK}); err != nil {
 			log.Println("❌ [ASTM] Failed to ACK frame:", err)
 			return false
 		}
+		if hasPending {
+			fullMessage.WriteString(pending)
+			frameCount++
+			framesReceived.Inc()
+			log.Printf("📦 [ASTM] Frame %d collected (%d bytes)\n", frameCount, len(pending))
+			events.Publish(events.Event{Type: events.FrameReceived, Protocol: "astm", Source: source.Address,
+				Detail: fmt.Sprintf("frame %d, %d bytes", frameCount, len(pending)), Bytes: len(pending)})
+			continued = frameEnd == config.ETB
+			lastFrameNumber = checksummed[0]
+			hasPending = false
+		}
+		naks = 0
 		log.Println("✅ [ASTM] Frame ACKed")
 		return true
 	}
 
+	// Every return ends the session, normally at EOT
+	defer func() { publish(events.SessionEnd, source, fmt.Sprintf("%d frame(s)", frameCount)) }()
+
 	handleIdleByte := func(b byte) bool {
 		switch b {
 		case config.STX:
 			frame.Reset()
 			cur = inFrame
 		case config.EOT:
+			if frameCount == 0 {
+				// ENQ/EOT with no frames is a link check, not an empty result
+				log.Println("🔁 [ASTM] Link check (ENQ then EOT, no frames)")
+				return false
+			}
 			log.Println("📭 [ASTM] Transmission complete — processing message")
+			if config.Get().ASTMAnswerQueries {
+				// The instrument waits for the answer, so no late frames are expected
+				if sampleIDs := queriedSamples(fullMessage.String()); len(sampleIDs) > 0 {
+					answerQuery(port, fullMessage.String(), sampleIDs)
+					return false
+				}
+			}
+			late, reopened := readLateFrames(port)
+			for _, data := range late {
+				fullMessage.WriteString(data)
+			}
 			if fullMessage.Len() > 0 {
-				ProcessMessage(fullMessage.String())
+				processMessage(fullMessage.String(), source)
 			} else {
 				log.Println("⚠️  [ASTM] No data collected")
 			}
-			return false
+			if !reopened {
+				return false
+			}
+			// The analyzer opened its next session inside the grace window
+			publish(events.SessionEnd, source, fmt.Sprintf("%d frame(s)", frameCount))
+			publish(events.SessionStart, source, "")
+			fullMessage.Reset()
+			frameCount = 0
+			lastFrameNumber = 0
+			if err := writeWithTimeout(port, []byte{config.ACK}); err != nil {
+				log.Println("❌ [ASTM] Failed to send ACK:", err)
+				return false
+			}
+			cur = idle
 		case config.ENQ:
-			port.Write([]byte{config.ACK})
+			if err := writeWithTimeout(port, []byte{config.ACK}); err != nil {
+				log.Println("❌ [ASTM] Failed to send ACK:", err)
+			}
 			cur = idle
 		}
 		return true
@@ -142,10 +393,17 @@ func handleSession(port Port) {
 			return
 		}
 
-		log.Printf("[ASTM] State=%d Byte=0x%02X (%s)\n", cur, b, byteDesc(b))
+		// Printable bytes are message content, so they are not traced while redacting
+		if !config.Get().RedactPHI || b < 32 {
+			slog.Debug("byte received", "protocol", "astm", "state", cur, "byte", fmt.Sprintf("0x%02X", b), "desc", byteDesc(b))
+		}
 
 		switch cur {
 		case idle:
+			if isKeepalive(b) {
+				handleKeepalive(port, b)
+				continue
+			}
 			if !handleIdleByte(b) {
 				return
 			}
@@ -154,20 +412,16 @@ func handleSession(port Port) {
 			if b == config.ETX || b == config.ETB {
 				frameData := frame.String()
 				if len(frameData) > 1 {
-					data := frameData[1:]
-					fullMessage.WriteString(data)
-					frameCount++
-					log.Printf("📦 [ASTM] Frame %d collected (%d bytes)\n", frameCount, len(data))
+					pending, hasPending, frameEnd = frameData[1:], true, b
+					checksummed = frameData + string(b)
 				}
-				tailCount = 0
+				trailer.Reset()
 				cur = tail
 			} else {
 				frame.WriteByte(b)
 			}
 
 		case tail:
-			tailCount++
-
 			if b == config.CR {
 				if !ackFrame() {
 					return
@@ -189,30 +443,126 @@ func handleSession(port Port) {
 				if !handleIdleByte(b) {
 					return
 				}
+			} else if b != config.LF {
+				trailer.WriteByte(b)
 			}
 		}
 	}
 }
 
-func handleSessionDirect(port Port, firstByte byte) {
+// frameChecksum returns the ASTM checksum of a frame: the modulo-256 sum of
+// every byte from the frame number through ETX/ETB, as two upper-case hex digits
+func frameChecksum(frame string) string {
+	var sum byte
+	for i := 0; i < len(frame); i++ {
+		sum += frame[i]
+	}
+	return fmt.Sprintf("%02X", sum)
+}
+
+// validChecksum reports whether the trailer following a frame (the two
+// checksum characters, before CR LF) matches the frame's checksum
+func validChecksum(frame, trailer string) bool {
+	return len(trailer) >= 2 && strings.EqualFold(trailer[:2], frameChecksum(frame))
+}
+
+// nextFrameNumber returns the frame number expected after last: frames
+// count 1 to 7 and then wrap to 0
+func nextFrameNumber(last byte) byte {
+	if last < '0' || last > '7' {
+		return '1'
+	}
+	return '0' + (last-'0'+1)%8
+}
+
+// startsWithRecord reports whether frame data opens with a known ASTM
+// record type (or the Bio-Rad D-10 header), as every frame that does not
+// continue an ETB-split record should
+func startsWithRecord(data string) bool {
+	if strings.HasPrefix(data, "S03") {
+		return true
+	}
+	return len(data) >= 2 && strings.IndexByte("HPOCRQLMS", data[0]) >= 0 && data[1] == '|'
+}
+
+// readLateFrames waits up to config.Get().ASTMEOTGrace after EOT for frames the
+// analyzer sends late, ACKing each and returning its data so it joins the
+// closing session. It stops early, reporting reopened, on an ENQ that
+// starts the next session.
+func readLateFrames(port Port) (late []string, reopened bool) {
+	if config.Get().ASTMEOTGrace <= 0 {
+		return nil, false
+	}
+
+	deadline := clock().Add(config.Get().ASTMEOTGrace)
+	buf := make([]byte, 1)
+	var frame bytes.Buffer
+	inFrame, inTail := false, false
+
+	for {
+		remaining := deadline.Sub(clock())
+		if remaining <= 0 {
+			return late, false
+		}
+		port.SetReadTimeout(remaining)
+		n, err := port.Read(buf)
+		if err != nil || n == 0 {
+			return late, false
+		}
+		b := buf[0]
+
+		switch {
+		case inFrame && (b == config.ETX || b == config.ETB):
+			if frame.Len() > 1 {
+				late = append(late, frame.String()[1:])
+			}
+			inFrame, inTail = false, true
+		case inFrame:
+			frame.WriteByte(b)
+		case inTail && b == config.CR:
+			inTail = false
+			if err := writeWithTimeout(port, []byte{config.ACK}); err != nil {
+				log.Println("❌ [ASTM] Failed to ACK late frame:", err)
+				return late, false
+			}
+			log.Printf("⏱️  [ASTM] Late frame after EOT accepted into session (%d so far)\n", len(late))
+			// Allow for a further late frame after this one
+			deadline = clock().Add(config.Get().ASTMEOTGrace)
+		case b == config.STX:
+			frame.Reset()
+			inFrame = true
+		case b == config.ENQ:
+			return late, true
+		}
+	}
+}
+
+// handleSessionDirect reads a transmission an analyzer starts with STX and
+// no ENQ. Such analyzers take no part in the ACK/NAK handshake, so frames
+// cannot be refused and astm_verify_checksum does not apply.
+func handleSessionDirect(port Port, firstByte byte, source types.Transport) {
 	var fullMessage strings.Builder
+	frames := 0 // intermediate frames received so far
 	buf := make([]byte, 1)
 
 	readByte := func() (byte, bool) {
-		port.SetReadTimeout(10 * time.Second)
+		port.SetReadTimeout(config.Get().ASTMSessionTimeout)
 		n, err := port.Read(buf)
 		if err != nil {
 			log.Printf("⚠️  [ASTM] Session read error: %v\n", err)
 			return 0, false
 		}
 		if n == 0 {
-			log.Println("⚠️  [ASTM] Session timed out — no data for 10s")
+			sessionTimedOut(source, frames)
 			return 0, false
 		}
 		return buf[0], true
 	}
 
 	// Process the first STX we already received
+	// betweenFrames is set after an ETB, while the intermediate frame's
+	// trailer is skipped until the STX opening the next frame
+	betweenFrames := false
 
 	for {
 		b, ok := readByte()
@@ -220,12 +570,26 @@ func handleSessionDirect(port Port, firstByte byte) {
 			return
 		}
 
-		log.Printf("[ASTM] State=direct Byte=0x%02X (%s)\n", b, byteDesc(b))
+		if !config.Get().RedactPHI || b < 32 {
+			slog.Debug("byte received", "protocol", "astm", "state", "direct", "byte", fmt.Sprintf("0x%02X", b), "desc", byteDesc(b))
+		}
 
-		if b == config.ETX || b == config.ETB {
+		if betweenFrames {
+			betweenFrames = b != config.STX
+			continue
+		}
+
+		if b == config.ETB {
+			// Intermediate frame: the record continues in the next frame
+			log.Println("📦 [ASTM] Intermediate frame (ETB) — waiting for continuation")
+			framesReceived.Inc()
+			frames++
+			betweenFrames = true
+		} else if b == config.ETX {
+			framesReceived.Inc()
 			log.Println("📭 [ASTM] Transmission complete — processing message")
 			if fullMessage.Len() > 0 {
-				ProcessMessage(fullMessage.String())
+				processMessage(fullMessage.String(), source)
 			} else {
 				log.Println("⚠️  [ASTM] No data collected")
 			}
@@ -239,6 +603,216 @@ func handleSessionDirect(port Port, firstByte byte) {
 	}
 }
 
+// sessionTimeouts counts transmissions abandoned after astm_session_timeout
+var sessionTimeouts = metrics.NewCounter("astm_session_timeouts_total", "ASTM transmissions abandoned because the instrument went silent")
+
+// sessionTimedOut records a transmission abandoned mid-way. Its frames are
+// discarded with the session and the link returns to waiting for ENQ; the
+// instrument's own timeout makes it restart the transmission.
+func sessionTimedOut(source types.Transport, frames int) {
+	sessionTimeouts.Inc()
+	detail := fmt.Sprintf("no data for %s, %d frame(s) discarded", config.Get().ASTMSessionTimeout, frames)
+	log.Printf("⚠️  [ASTM] Session timed out — %s\n", detail)
+	publish(events.SessionTimeout, source, detail)
+}
+
+// publish emits an ASTM session lifecycle event for source
+func publish(eventType string, source types.Transport, detail string) {
+	events.Publish(events.Event{Type: eventType, Protocol: "astm", Source: source.Address, Detail: detail})
+}
+
+// writeTimeouter is implemented by ports that can bound a blocking write
+type writeTimeouter interface {
+	SetWriteTimeout(t time.Duration) error
+}
+
+// outputResetter is implemented by ports that can discard output not yet
+// sent (serial)
+type outputResetter interface {
+	ResetOutputBuffer() error
+}
+
+// stalledWrites holds, per port, a channel closed once a write abandoned
+// on timeout returns; no further reply is written to the port until then
+var (
+	stalledMu     sync.Mutex
+	stalledWrites = map[Port]chan struct{}{}
+)
+
+// writeWithTimeout writes b, giving up after config.Get().ACKWriteTimeout so an
+// instrument that stops reading cannot stall the read loop. Ports without
+// write deadlines (serial) are written from a goroutine; on timeout their
+// unsent output is discarded and later writes wait for that goroutine, so
+// a stale ACK/NAK is never sent after a newer reply.
+func writeWithTimeout(port Port, b []byte) error {
+	timeout := config.Get().ACKWriteTimeout
+	if w, ok := port.(writeTimeouter); ok {
+		if err := w.SetWriteTimeout(timeout); err == nil {
+			_, err := port.Write(b)
+			return err
+		}
+	}
+
+	stalledMu.Lock()
+	stalled := stalledWrites[port]
+	stalledMu.Unlock()
+	if stalled != nil {
+		select {
+		case <-stalled:
+		case <-time.After(timeout):
+			return fmt.Errorf("earlier write still blocked after %s", timeout)
+		}
+	}
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := port.Write(b)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(timeout):
+	}
+
+	if r, ok := port.(outputResetter); ok {
+		if err := r.ResetOutputBuffer(); err != nil {
+			log.Println("⚠️  [ASTM] Failed to discard unsent output:", err)
+		}
+	}
+	finished := make(chan struct{})
+	stalledMu.Lock()
+	stalledWrites[port] = finished
+	stalledMu.Unlock()
+	go func() {
+		<-done
+		stalledMu.Lock()
+		delete(stalledWrites, port)
+		stalledMu.Unlock()
+		close(finished)
+	}()
+	return fmt.Errorf("write timed out after %s", timeout)
+}
+
+// isKeepalive reports whether b is a configured between-session keepalive byte
+func isKeepalive(b byte) bool {
+	for _, k := range config.Get().KeepaliveBytes {
+		if b == k {
+			return true
+		}
+	}
+	return false
+}
+
+// handleKeepalive answers a keepalive byte per config without starting a session
+func handleKeepalive(port Port, b byte) {
+	slog.Debug("keepalive byte", "protocol", "astm", "byte", fmt.Sprintf("0x%02X", b))
+	if config.Get().KeepaliveACK {
+		if err := writeWithTimeout(port, []byte{config.ACK}); err != nil {
+			log.Println("❌ [ASTM] Failed to ACK keepalive:", err)
+		}
+	}
+}
+
+// warmupPort discards bytes read before until, which are usually stale
+// data the serial driver buffered before the port was opened. An ENQ ends
+// the warm-up early since it starts a clean session.
+type warmupPort struct {
+	Port
+	until     time.Time
+	done      bool
+	discarded int
+}
+
+func (p *warmupPort) Read(b []byte) (int, error) {
+	for {
+		n, err := p.Port.Read(b)
+		if p.done || n == 0 || err != nil {
+			return n, err
+		}
+		for i, c := range b[:n] {
+			if c == config.ENQ || !clock().Before(p.until) {
+				p.finish()
+				m := copy(b, b[i:n])
+				return m, err
+			}
+			p.discarded++
+		}
+	}
+}
+
+func (p *warmupPort) finish() {
+	p.done = true
+	if p.discarded > 0 {
+		log.Printf("🧹 [ASTM] Discarded %d stale byte(s) received during warm-up\n", p.discarded)
+	}
+}
+
+func (p *warmupPort) SetWriteTimeout(t time.Duration) error {
+	if w, ok := p.Port.(writeTimeouter); ok {
+		return w.SetWriteTimeout(t)
+	}
+	return fmt.Errorf("write timeout not supported")
+}
+
+// timelinePort records control characters passing through a port in both directions
+type timelinePort struct {
+	Port
+	timeline *logger.Timeline
+}
+
+func (p *timelinePort) Read(b []byte) (int, error) {
+	n, err := p.Port.Read(b)
+	for _, c := range b[:n] {
+		if c < 0x20 {
+			p.timeline.Add(byteDesc(c))
+		}
+	}
+	return n, err
+}
+
+func (p *timelinePort) SetWriteTimeout(t time.Duration) error {
+	if w, ok := p.Port.(writeTimeouter); ok {
+		return w.SetWriteTimeout(t)
+	}
+	return fmt.Errorf("write timeout not supported")
+}
+
+func (p *timelinePort) Write(b []byte) (int, error) {
+	for _, c := range b {
+		if c < 0x20 {
+			p.timeline.Add("tx:" + byteDesc(c))
+		}
+	}
+	return p.Port.Write(b)
+}
+
+// capturePort tees the bytes passing through a port in both directions
+// into the capture file
+type capturePort struct {
+	Port
+	recorder *capture.Recorder
+}
+
+func (p *capturePort) Read(b []byte) (int, error) {
+	n, err := p.Port.Read(b)
+	p.recorder.Record(capture.RX, b[:n])
+	return n, err
+}
+
+func (p *capturePort) SetWriteTimeout(t time.Duration) error {
+	if w, ok := p.Port.(writeTimeouter); ok {
+		return w.SetWriteTimeout(t)
+	}
+	return fmt.Errorf("write timeout not supported")
+}
+
+func (p *capturePort) Write(b []byte) (int, error) {
+	n, err := p.Port.Write(b)
+	p.recorder.Record(capture.TX, b[:n])
+	return n, err
+}
+
 func byteDesc(b byte) string {
 	switch b {
 	case config.ENQ:
@@ -1,11 +1,14 @@
 package astm
 
 import (
+	"context"
+	"fmt"
 	"log"
 	"net"
 	"time"
 
 	"lightbaseEMRProxy/internal/config"
+	"lightbaseEMRProxy/types"
 )
 
 // TCPConn wraps a net.Conn to satisfy the Port interface
@@ -32,28 +35,89 @@ func (t *TCPConn) SetReadTimeout(d time.Duration) error {
 	return t.conn.SetReadDeadline(time.Now().Add(d))
 }
 
-// StartTCPListener starts the ASTM TCP listener
-func StartTCPListener() {
-	addr := config.PCIP + ":" + config.ASTMTCPPort
+func (t *TCPConn) SetWriteTimeout(d time.Duration) error {
+	return t.conn.SetWriteDeadline(time.Now().Add(d))
+}
+
+// StartTCPDialer connects out to an analyzer that listens for the gateway,
+// redialling whenever the connection drops, until ctx is canceled (blocks)
+func StartTCPDialer(ctx context.Context, address string) {
+	for {
+		conn, err := dialWithRetry(ctx, address)
+		if err != nil {
+			if ctx.Err() == nil {
+				log.Printf("❌ [ASTM-TCP] Giving up on %s: %v\n", address, err)
+			}
+			return
+		}
+		active.Add()
+		HandlePort(ctx, &TCPConn{conn: conn}, types.Transport{Kind: "tcp", Address: conn.RemoteAddr().String(), ConnectedAt: time.Now()})
+		conn.Close()
+		active.Done()
+		if ctx.Err() != nil {
+			return
+		}
+		log.Printf("🔌 [ASTM-TCP] Analyzer %s disconnected — redialling\n", address)
+	}
+}
+
+// dialWithRetry dials address until it answers, backing off between
+// attempts, or until config.Get().ASTMDialMaxAttempts is reached or ctx is
+// canceled
+func dialWithRetry(ctx context.Context, address string) (net.Conn, error) {
+	delay := config.Get().ASTMDialBackoffMin
+	for attempt := 1; ; attempt++ {
+		log.Printf("📞 [ASTM-TCP] Dialling analyzer %s (attempt %d)\n", address, attempt)
+		dialer := net.Dialer{Timeout: 10 * time.Second}
+		conn, err := dialer.DialContext(ctx, "tcp", address)
+		if err == nil {
+			log.Printf("🔌 [ASTM-TCP] Connected to analyzer %s\n", conn.RemoteAddr())
+			return conn, nil
+		}
+		if config.Get().ASTMDialMaxAttempts > 0 && attempt >= config.Get().ASTMDialMaxAttempts {
+			return nil, fmt.Errorf("%d dial attempts failed: %w", attempt, err)
+		}
+		log.Printf("⏳ [ASTM-TCP] Dial failed: %v — retrying in %s\n", err, delay)
+		if !sleep(ctx, delay) {
+			return nil, ctx.Err()
+		}
+		delay = min(delay*2, config.Get().ASTMDialBackoffMax)
+	}
+}
+
+// StartTCPListener starts the ASTM TCP listener and stops accepting
+// instruments once ctx is canceled
+func StartTCPListener(ctx context.Context) {
+	addr := config.Get().PCIP + ":" + config.Get().ASTMTCPPort
 	ln, err := net.Listen("tcp", addr)
 	if err != nil {
 		log.Printf("❌ [ASTM-TCP] Could not bind %s: %v\n", addr, err)
 		return
 	}
 	defer ln.Close()
+	context.AfterFunc(ctx, func() { ln.Close() })
 	log.Printf("📡 [ASTM-TCP] Listening on %s — waiting for instrument...\n", addr)
 
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
 			log.Println("❌ [ASTM-TCP] Accept error:", err)
 			continue
 		}
 		log.Printf("🔌 [ASTM-TCP] Instrument connected: %s\n", conn.RemoteAddr())
-		go func(c net.Conn) {
-			defer c.Close()
-			HandlePort(&TCPConn{conn: c})
-			log.Printf("🔌 [ASTM-TCP] Instrument disconnected: %s\n", c.RemoteAddr())
-		}(conn)
+		go HandleConnection(ctx, conn)
 	}
 }
+
+// HandleConnection runs ASTM sessions on an accepted instrument connection
+// until it closes or ctx is canceled
+func HandleConnection(ctx context.Context, conn net.Conn) {
+	active.Add()
+	defer active.Done()
+	defer conn.Close()
+	HandlePort(ctx, &TCPConn{conn: conn}, types.Transport{Kind: "tcp", Address: conn.RemoteAddr().String(), ConnectedAt: time.Now()})
+	log.Printf("🔌 [ASTM-TCP] Instrument disconnected: %s\n", conn.RemoteAddr())
+}
@@ -0,0 +1,113 @@
+package astm
+
+import (
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"lightbaseEMRProxy/internal/config"
+)
+
+const (
+	// maxFrameText is the most record text one frame carries; longer
+	// records continue in further frames ended with ETB
+	maxFrameText = 240
+
+	// replyTimeout is how long the sender waits for the instrument to answer
+	// ENQ or a frame
+	replyTimeout = 15 * time.Second
+)
+
+// frame builds a wire frame: STX, frame number, text, end byte, checksum, CR LF
+func frame(number byte, text string, end byte) string {
+	body := string(number) + text + string(end)
+	return string(rune(config.STX)) + body + frameChecksum(body) + "\r\n"
+}
+
+// transmit sends records to the instrument as one ASTM transmission: ENQ,
+// the framed records, then EOT. A frame the instrument NAKs is sent again
+// up to config.Get().ASTMSendRetryLimit times before the transmission is
+// aborted with EOT.
+func transmit(port Port, records []string) error {
+	if err := writeWithTimeout(port, []byte{config.ENQ}); err != nil {
+		return fmt.Errorf("failed to send ENQ: %w", err)
+	}
+	reply, err := readReply(port)
+	if err != nil {
+		return fmt.Errorf("no answer to ENQ: %w", err)
+	}
+	if reply != config.ACK {
+		// NAK: the instrument is busy; the caller retries later
+		writeWithTimeout(port, []byte{config.EOT})
+		return fmt.Errorf("instrument answered ENQ with %s", byteDesc(reply))
+	}
+
+	var number byte
+	for _, f := range frames(records) {
+		number = nextFrameNumber(number)
+		wire := frame(number, f.text, f.end)
+		for attempt := 0; ; attempt++ {
+			if err := writeWithTimeout(port, []byte(wire)); err != nil {
+				return fmt.Errorf("failed to send frame %c: %w", number, err)
+			}
+			reply, err := readReply(port)
+			if err != nil {
+				writeWithTimeout(port, []byte{config.EOT})
+				return fmt.Errorf("no answer to frame %c: %w", number, err)
+			}
+			// EOT in place of ACK asks the sender to stop after this frame
+			if reply == config.ACK || reply == config.EOT {
+				break
+			}
+			if attempt >= config.Get().ASTMSendRetryLimit {
+				writeWithTimeout(port, []byte{config.EOT})
+				return fmt.Errorf("frame %c refused %d times — transmission aborted", number, attempt+1)
+			}
+			log.Printf("🔁 [ASTM] Instrument answered frame %c with %s — resending (%d/%d)\n", number, byteDesc(reply), attempt+1, config.Get().ASTMSendRetryLimit)
+		}
+	}
+
+	if err := writeWithTimeout(port, []byte{config.EOT}); err != nil {
+		return fmt.Errorf("failed to send EOT: %w", err)
+	}
+	return nil
+}
+
+// outFrame is the text of one outgoing frame and the byte that ends it
+type outFrame struct {
+	text string
+	end  byte
+}
+
+// frames splits records, each ended with CR, into frames of at most
+// maxFrameText characters; a record that does not fit continues over ETB
+// frames and its last frame ends with ETX
+func frames(records []string) []outFrame {
+	var out []outFrame
+	for _, record := range records {
+		if !strings.HasSuffix(record, "\r") {
+			record += "\r"
+		}
+		for len(record) > maxFrameText {
+			out = append(out, outFrame{text: record[:maxFrameText], end: config.ETB})
+			record = record[maxFrameText:]
+		}
+		out = append(out, outFrame{text: record, end: config.ETX})
+	}
+	return out
+}
+
+// readReply waits for the instrument's single-byte answer
+func readReply(port Port) (byte, error) {
+	buf := make([]byte, 1)
+	port.SetReadTimeout(replyTimeout)
+	n, err := port.Read(buf)
+	if err != nil {
+		return 0, err
+	}
+	if n == 0 {
+		return 0, fmt.Errorf("timed out after %s", replyTimeout)
+	}
+	return buf[0], nil
+}
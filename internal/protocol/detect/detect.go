@@ -0,0 +1,113 @@
+package detect
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"time"
+
+	"lightbaseEMRProxy/internal/config"
+	"lightbaseEMRProxy/internal/protocol/astm"
+	"lightbaseEMRProxy/internal/protocol/hl7"
+)
+
+// Protocols a connection can be detected as
+const (
+	ProtocolASTM = "astm"
+	ProtocolHL7  = "hl7"
+)
+
+// peekedConn replays the bytes inspected during detection before reading
+// from the connection itself
+type peekedConn struct {
+	net.Conn
+	reader *bufio.Reader
+}
+
+func (c *peekedConn) Read(b []byte) (int, error) { return c.reader.Read(b) }
+
+// StartListener accepts instrument connections on address and hands each
+// to the ASTM or HL7 handler according to its leading bytes, until ctx is
+// canceled (blocks)
+func StartListener(ctx context.Context, address string) {
+	ln, err := net.Listen("tcp", address)
+	if err != nil {
+		log.Printf("❌ [DETECT] Could not bind %s: %v\n", address, err)
+		return
+	}
+	defer ln.Close()
+	context.AfterFunc(ctx, func() { ln.Close() })
+	log.Printf("📡 [DETECT] Listening on %s — protocol detected per connection\n", address)
+
+	for {
+		conn, err := ln.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
+			log.Println("❌ [DETECT] Accept error:", err)
+			continue
+		}
+		go handle(ctx, conn)
+	}
+}
+
+func handle(ctx context.Context, conn net.Conn) {
+	reader := bufio.NewReader(conn)
+	conn.SetReadDeadline(time.Now().Add(config.Get().AutoDetectTimeout))
+	protocol, err := Detect(reader)
+	conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		log.Printf("❓ [DETECT] %s: %v — closing\n", conn.RemoteAddr(), err)
+		conn.Close()
+		return
+	}
+
+	log.Printf("🔒 [DETECT] %s speaks %s — locked for this connection\n", conn.RemoteAddr(), protocol)
+	peeked := &peekedConn{Conn: conn, reader: reader}
+	switch protocol {
+	case ProtocolASTM:
+		astm.HandleConnection(ctx, peeked)
+	case ProtocolHL7:
+		hl7.HandleConnection(ctx, peeked)
+	}
+}
+
+// Detect inspects the leading bytes of a session without consuming them:
+// ENQ or STX means ASTM, VT or an unframed MSH segment means HL7.
+// Keepalive bytes and line endings before the session are skipped.
+func Detect(reader *bufio.Reader) (string, error) {
+	for {
+		lead, err := reader.Peek(1)
+		if err != nil {
+			return "", fmt.Errorf("no session start received: %w", err)
+		}
+
+		switch b := lead[0]; {
+		case b == config.ENQ || b == config.STX:
+			return ProtocolASTM, nil
+		case b == config.VT:
+			return ProtocolHL7, nil
+		case b == 'M':
+			if head, err := reader.Peek(3); err == nil && string(head) == "MSH" {
+				return ProtocolHL7, nil
+			}
+			return "", fmt.Errorf("unrecognised leading bytes")
+		case b == config.CR || b == config.LF || isKeepalive(b):
+			reader.Discard(1)
+		default:
+			return "", fmt.Errorf("unrecognised leading byte 0x%02X", b)
+		}
+	}
+}
+
+func isKeepalive(b byte) bool {
+	for _, k := range config.Get().KeepaliveBytes {
+		if b == k {
+			return true
+		}
+	}
+	return false
+}
@@ -2,41 +2,49 @@ package hl7
 
 import (
 	"fmt"
+	"log"
 	"strings"
 	"time"
 
 	"lightbaseEMRProxy/internal/config"
 )
 
-// GenerateACK creates an HL7 acknowledgment message
+// GenerateACK creates an HL7 accept (AA) acknowledgment message
 func GenerateACK(originalMessage string) string {
-	originalMessage = strings.ReplaceAll(originalMessage, "\r\n", "\r")
-	segments := strings.Split(originalMessage, string(config.CR))
+	return GenerateACKCode(originalMessage, "AA", "")
+}
 
-	var mshFields []string
-	for _, segment := range segments {
-		segment = strings.TrimSpace(segment)
-		if strings.HasPrefix(segment, "MSH") {
-			mshFields = strings.Split(segment, "|")
-			break
-		}
-	}
+// GenerateACKCode creates an HL7 acknowledgment message with the given
+// MSA-1 acknowledgment code (AA, AE or AR); text, if any, is sent in MSA-3
+// to tell the sender why its message was not accepted
+func GenerateACKCode(originalMessage, code, text string) string {
+	return generateResponse(originalMessage, code, text, "ACK")
+}
 
+// generateResponse builds the MSH and MSA segments of a reply of
+// messageType to originalMessage, using the field separator (MSH-1) and
+// encoding characters (MSH-2) the sender declared
+func generateResponse(originalMessage, code, text, messageType string) string {
+	mshFields, fieldSeparator, componentSeparator := mshFields(originalMessage)
 	if len(mshFields) < 10 {
 		return ""
 	}
 
-	fieldSeparator := "|"
+	if componentSeparator != "^" {
+		messageType = strings.ReplaceAll(messageType, "^", componentSeparator)
+	}
 	encodingChars := getField(mshFields, 1)
 	sendingApp := getField(mshFields, 2)
 	sendingFacility := getField(mshFields, 3)
 	receivingApp := getField(mshFields, 4)
 	receivingFacility := getField(mshFields, 5)
 	messageControlID := getField(mshFields, 9)
+	processingID := getField(mshFields, 10)
+	versionID := getField(mshFields, 11)
 
 	timestamp := time.Now().Format("20060102150405")
 
-	ack := fmt.Sprintf("MSH%s%s%s%s%s%s%s%s%s%sACK%s%s%sAL%s",
+	ack := fmt.Sprintf("MSH%s%s%s%s%s%s%s%s%s%s%s%s%s%s%s%s%s%s%s%s%s",
 		fieldSeparator,
 		encodingChars,
 		fieldSeparator,
@@ -51,15 +59,84 @@ func GenerateACK(originalMessage string) string {
 		timestamp,
 		fieldSeparator,
 		fieldSeparator,
+		messageType,
+		fieldSeparator,
+		messageControlID,
+		fieldSeparator,
+		processingID,
 		fieldSeparator,
+		versionID,
 	)
-	ack += string(config.CR)
+	ack += string(rune(config.CR))
 
-	ack += fmt.Sprintf("MSA%sAA%s%s",
+	ack += fmt.Sprintf("MSA%s%s%s%s",
 		fieldSeparator,
+		code,
 		fieldSeparator,
 		messageControlID,
 	)
+	if text != "" {
+		// Delimiters in the reason would corrupt the segment
+		text = strings.Map(func(r rune) rune {
+			if r == rune(config.CR) || strings.ContainsRune(fieldSeparator+encodingChars, r) {
+				return ' '
+			}
+			return r
+		}, text)
+		ack += fieldSeparator + text
+	}
 
 	return ack
 }
+
+// HeaderRejection builds the AE reply to a message whose MSH header is
+// unusable. The reply answers the first valid MSH segment in message when
+// there is one, so the sender can match it to its control ID, and
+// otherwise uses default delimiters and an empty MSA-2.
+func HeaderRejection(message, text string) string {
+	if start := strings.Index(message, "MSH"); start > 0 && ValidateHeader(message[start:]) == nil {
+		if ack := GenerateACKCode(message[start:], "AE", text); ack != "" {
+			return ack
+		}
+	}
+	text = strings.NewReplacer("|", " ", "^", " ", "~", " ", "\\", " ", "&", " ", "\r", " ").Replace(text)
+	return "MSH|^~\\&|LIGHTBASE|" + hl7Escaper.Replace(config.Get().LABSLUG) + "|||" +
+		time.Now().Format("20060102150405") + "||ACK||P|2.3\rMSA|AE||" + text
+}
+
+// LogACK generates the ACK for message and logs it, MLLP framing
+// included, without sending it over any transport
+func LogACK(message string) bool {
+	ack := GenerateACK(message)
+	if ack == "" {
+		log.Println("⚠️ Could not generate ACK - invalid message")
+		return false
+	}
+	framed := FrameMLLP(ack)
+	log.Printf("📝 [HL7] ACK that would be sent (%d bytes):\n%q\n", len(framed), framed)
+	log.Println(strings.ReplaceAll(ack, "\r", "\n"))
+	return true
+}
+
+// FrameMLLP wraps an HL7 message in MLLP start and end blocks
+func FrameMLLP(message string) []byte {
+	framed := []byte{config.VT}
+	framed = append(framed, message...)
+	return append(framed, mllpTrailer()...)
+}
+
+// StripMLLP removes MLLP framing and normalises line endings to CR so a
+// message saved to a file can be fed to the parser
+func StripMLLP(raw []byte) string {
+	message := strings.Trim(string(raw), string([]byte{config.VT, config.FS, config.CR, config.LF}))
+	message = strings.ReplaceAll(message, "\r\n", "\r")
+	return strings.ReplaceAll(message, "\n", "\r")
+}
+
+// mllpTrailer returns the configured outbound MLLP end block
+func mllpTrailer() []byte {
+	if config.Get().MLLPTrailerCR {
+		return []byte{config.FS, config.CR}
+	}
+	return []byte{config.FS}
+}
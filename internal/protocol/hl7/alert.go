@@ -0,0 +1,75 @@
+package hl7
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+
+	"lightbaseEMRProxy/internal/config"
+	"lightbaseEMRProxy/types"
+)
+
+// Alert is posted to config.Get().AlertWebhookURL when a session looks wrong
+type Alert struct {
+	Kind       string `json:"kind"`
+	Instrument string `json:"instrument"`
+	MessageID  string `json:"message_id"`
+	Detail     string `json:"detail"`
+	RaisedAt   string `json:"raised_at"`
+}
+
+// checkResultCount raises an alert when the number of results in payload
+// falls outside the expected range configured for its instrument. The
+// payload is forwarded regardless.
+func checkResultCount(payload types.HL7Message) {
+	bound, ok := config.Get().ResultCountBounds[payload.Instrument]
+	if !ok {
+		bound, ok = config.Get().ResultCountBounds["*"]
+	}
+	if !ok {
+		return
+	}
+
+	n := len(payload.Results)
+	if n >= bound.Min && (bound.Max == 0 || n <= bound.Max) {
+		return
+	}
+
+	raiseAlert(Alert{
+		Kind:       "result_count",
+		Instrument: payload.Instrument,
+		MessageID:  payload.MessageID,
+		Detail:     fmt.Sprintf("%d result(s), expected %d-%d", n, bound.Min, bound.Max),
+		RaisedAt:   time.Now().Format(time.RFC3339),
+	})
+}
+
+// raiseAlert logs alert and, when a webhook is configured, posts it there
+// in the background so forwarding is never held up
+func raiseAlert(alert Alert) {
+	log.Printf("🚨 [ALERT] %s from %q [%s]: %s\n", alert.Kind, alert.Instrument, alert.MessageID, alert.Detail)
+	if config.Get().AlertWebhookURL == "" {
+		return
+	}
+
+	go func() {
+		body, err := json.Marshal(alert)
+		if err != nil {
+			log.Println("❌ [ALERT] Failed to marshal alert:", err)
+			return
+		}
+		client := &http.Client{Timeout: 10 * time.Second}
+		resp, err := client.Post(config.Get().AlertWebhookURL, "application/json", bytes.NewReader(body))
+		if err != nil {
+			log.Println("❌ [ALERT] Webhook request failed:", err)
+			return
+		}
+		resp.Body.Close()
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			log.Printf("❌ [ALERT] Webhook returned status %d\n", resp.StatusCode)
+		}
+	}()
+}
@@ -0,0 +1,90 @@
+package hl7
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+
+	"lightbaseEMRProxy/internal/config"
+	"lightbaseEMRProxy/types"
+)
+
+// hl7Escaper escapes the HL7 delimiters in a field value
+var hl7Escaper = strings.NewReplacer(
+	`\`, `\E\`,
+	"|", `\F\`,
+	"^", `\S\`,
+	"&", `\T\`,
+	"~", `\R\`,
+)
+
+// componentEscaper escapes a value that already carries ^-separated components
+var componentEscaper = strings.NewReplacer(
+	`\`, `\E\`,
+	"|", `\F\`,
+	"&", `\T\`,
+	"~", `\R\`,
+)
+
+// BuildORU renders payload as an HL7 v2.3 ORU^R01 message with one OBX per
+// result, segments separated by CR
+func BuildORU(payload types.HL7Message) string {
+	esc := hl7Escaper.Replace
+	msh := "MSH|^~\\&|LIGHTBASE|" + esc(config.Get().LABSLUG) + "|" + esc(payload.Instrument) + "||" +
+		time.Now().Format("20060102150405") + "||ORU^R01|" + esc(payload.MessageID) + "|P|2.3"
+	return strings.Join(append([]string{msh}, resultSegments(payload)...), "\r") + "\r"
+}
+
+// resultSegments renders the PID, OBR and OBX segments carrying payload
+func resultSegments(payload types.HL7Message) []string {
+	esc := hl7Escaper.Replace
+	segments := []string{
+		"PID|1||" + esc(payload.Patient.ID) + "||" + componentEscaper.Replace(payload.Patient.Name) + "||" +
+			strings.ReplaceAll(payload.Patient.BirthDate, "-", ""),
+		"OBR|1|" + esc(payload.Order.AccessionNumber) + "||||" + esc(payload.Order.Priority),
+	}
+
+	for i, r := range payload.Results {
+		valueType := "ST"
+		if _, err := strconv.ParseFloat(strings.TrimSpace(r.Value), 64); err == nil {
+			valueType = "NM"
+		}
+		fields := []string{
+			"OBX",
+			strconv.Itoa(i + 1),
+			valueType,
+			esc(r.TestCode) + "^" + esc(r.TestName),
+			"",
+			esc(r.Value),
+			esc(r.Units),
+			esc(r.ReferenceRange),
+			esc(r.AbnormalFlags),
+			"",
+			"",
+			esc(r.Status),
+			"",
+			"",
+			hl7Timestamp(r.Timestamp),
+		}
+		segments = append(segments, strings.Join(fields, "|"))
+	}
+	return segments
+}
+
+// hl7Timestamp converts an RFC 3339 timestamp to HL7 TS format
+func hl7Timestamp(rfc3339 string) string {
+	t, err := time.Parse(time.RFC3339, rfc3339)
+	if err != nil {
+		return ""
+	}
+	return t.Format("20060102150405")
+}
+
+// validateORU is a cheap sanity check that a built message parses back
+func validateORU(message string) error {
+	if code, trigger := MessageType(message); code != "ORU" || trigger != "R01" {
+		return fmt.Errorf("built message has type %s^%s", code, trigger)
+	}
+	return nil
+}
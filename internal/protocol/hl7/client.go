@@ -0,0 +1,77 @@
+package hl7
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"lightbaseEMRProxy/internal/config"
+)
+
+// Ping sends a minimal ORU^R01 with no observations to an HL7 peer and
+// waits for its ACK, returning the round-trip time. It validates the
+// outbound MLLP path before go-live.
+func Ping(address string, timeout time.Duration) (time.Duration, error) {
+	controlID := "PING" + time.Now().Format("20060102150405")
+	message := strings.Join([]string{
+		"MSH|^~\\&|LIGHTBASE|" + config.Get().LABSLUG + "|||" + time.Now().Format("20060102150405") + "||ORU^R01|" + controlID + "|P|2.3",
+		"PID|||PING",
+		"OBR|1|PING",
+	}, "\r")
+
+	start := time.Now()
+	conn, err := net.DialTimeout("tcp", address, timeout)
+	if err != nil {
+		return 0, fmt.Errorf("connect failed: %w", err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(start.Add(timeout))
+
+	if _, err := conn.Write(FrameMLLP(message)); err != nil {
+		return 0, fmt.Errorf("send failed: %w", err)
+	}
+
+	reply, err := readMLLP(bufio.NewReader(conn))
+	if err != nil {
+		return 0, fmt.Errorf("no ACK received: %w", err)
+	}
+	rtt := time.Since(start)
+
+	code, ackedID := ackStatus(reply)
+	if ackedID != controlID {
+		return rtt, fmt.Errorf("ACK is for control ID %q, expected %q", ackedID, controlID)
+	}
+	if code != "AA" && code != "CA" {
+		return rtt, fmt.Errorf("peer answered %s", code)
+	}
+	return rtt, nil
+}
+
+// readMLLP reads one VT...FS framed message, skipping anything before VT
+func readMLLP(r *bufio.Reader) (string, error) {
+	if _, err := r.ReadBytes(config.VT); err != nil {
+		return "", err
+	}
+	body, err := r.ReadBytes(config.FS)
+	if err != nil {
+		return "", err
+	}
+	return string(bytes.TrimSuffix(body, []byte{config.FS})), nil
+}
+
+// ackStatus returns MSA-1 (acknowledgment code) and MSA-2 (control ID) of an ACK
+func ackStatus(ack string) (code, controlID string) {
+	_, fieldSep, _ := mshFields(ack)
+	ack = strings.ReplaceAll(ack, "\r\n", "\r")
+	for _, segment := range strings.Split(ack, "\r") {
+		segment = strings.TrimSpace(segment)
+		if strings.HasPrefix(segment, "MSA") {
+			fields := strings.Split(segment, fieldSep)
+			return getField(fields, 1), getField(fields, 2)
+		}
+	}
+	return "", ""
+}
@@ -0,0 +1,99 @@
+package hl7
+
+import (
+	"bytes"
+	"compress/gzip"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"lightbaseEMRProxy/internal/config"
+)
+
+// capabilities is the body served by config.Get().CapabilitiesEndpoint
+type capabilities struct {
+	ContentEncodings []string `json:"content_encodings"`
+}
+
+var (
+	gzipMu      sync.Mutex
+	gzipChecked bool
+	gzipEnabled bool
+)
+
+// useGzip reports whether forwarded bodies should be gzip-compressed. In
+// "negotiate" mode the server's capabilities are fetched once and the
+// answer cached; a failed check falls back to uncompressed and is retried
+// on the next send.
+func useGzip() bool {
+	switch config.Get().ForwardCompression {
+	case "gzip":
+		return true
+	case "negotiate":
+	default:
+		return false
+	}
+
+	gzipMu.Lock()
+	defer gzipMu.Unlock()
+	if gzipChecked {
+		return gzipEnabled
+	}
+
+	enabled, err := fetchGzipCapability(config.Get().ExternalServerURL + config.Get().CapabilitiesEndpoint)
+	if err != nil {
+		log.Println("⚠️  [FWD] Capability check failed, sending uncompressed:", err)
+		return false
+	}
+	gzipChecked, gzipEnabled = true, enabled
+	log.Printf("🗜️  [FWD] Server gzip support: %v\n", enabled)
+	return enabled
+}
+
+func fetchGzipCapability(url string) (bool, error) {
+	transport, err := serverTransport()
+	if err != nil {
+		return false, err
+	}
+	client := &http.Client{Timeout: 10 * time.Second, Transport: transport}
+	resp, err := client.Get(url)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	// A server without the endpoint does not support compression
+	if resp.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return false, fmt.Errorf("capabilities returned status %d", resp.StatusCode)
+	}
+
+	var caps capabilities
+	if err := json.NewDecoder(resp.Body).Decode(&caps); err != nil {
+		return false, fmt.Errorf("failed to decode capabilities: %w", err)
+	}
+	for _, enc := range caps.ContentEncodings {
+		if strings.EqualFold(enc, "gzip") {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+func gzipBody(body []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	zw := gzip.NewWriter(&buf)
+	if _, err := zw.Write(body); err != nil {
+		return nil, err
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
@@ -0,0 +1,631 @@
+package hl7
+
+import (
+	"bufio"
+	"container/heap"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"lightbaseEMRProxy/internal/config"
+	"lightbaseEMRProxy/internal/conformance"
+	"lightbaseEMRProxy/types"
+)
+
+// exchange sends raw bytes to the connection handler as an LIS would and
+// returns "code controlID" for every ACK it answers with
+func exchange(raw ...string) []string {
+	client, server := net.Pipe()
+	defer client.Close()
+	go HandleConnection(context.Background(), server)
+	go func() {
+		// Each part is a separate write, so the listener sees it in its own read
+		for _, part := range raw {
+			client.Write([]byte(part))
+		}
+	}()
+
+	reader := bufio.NewReader(client)
+	var acks []string
+	for {
+		client.SetReadDeadline(time.Now().Add(500 * time.Millisecond))
+		reply, err := readMLLP(reader)
+		if err != nil {
+			return acks
+		}
+		code, controlID := ackStatus(reply)
+		acks = append(acks, code+" "+controlID)
+	}
+}
+
+// conformanceMessage is a minimal ORU^R01 (or other type) with controlID
+func conformanceMessage(messageType, controlID string) string {
+	return strings.Join([]string{
+		"MSH|^~\\&|CONFORMANCE|LAB|||" + time.Now().Format("20060102150405") + "||" + messageType + "|" + controlID + "|P|2.3",
+		"PID|||" + controlID,
+		"OBR|1|" + controlID,
+		"OBX|1|NM|GLU^Glucose||5.2|mmol/L|3.9-5.5|N|||F",
+	}, "\r")
+}
+
+func expectACKs(got []string, want ...string) error {
+	if strings.Join(got, ", ") != strings.Join(want, ", ") {
+		return fmt.Errorf("ACKs [%s], want [%s]", strings.Join(got, ", "), strings.Join(want, ", "))
+	}
+	return nil
+}
+
+// ConformanceCases returns the HL7 MLLP reader conformance battery
+func ConformanceCases() []conformance.Case {
+	vt, fs, cr := string(rune(config.VT)), string(rune(config.FS)), string(rune(config.CR))
+	id := func(n int) string { return fmt.Sprintf("CONF%s%d", time.Now().Format("150405.000"), n) }
+
+	return []conformance.Case{
+		{Protocol: "hl7", Name: "good_message", Expect: "framed ORU answered AA", Run: func() error {
+			c := id(1)
+			return expectACKs(exchange(vt+conformanceMessage("ORU^R01", c)+fs+cr), "AA "+c)
+		}},
+		{Protocol: "hl7", Name: "fs_only_trailer", Expect: "message ending FS without CR answered AA", Run: func() error {
+			c := id(2)
+			return expectACKs(exchange(vt+conformanceMessage("ORU^R01", c)+fs), "AA "+c)
+		}},
+		{Protocol: "hl7", Name: "split_trailer", Expect: "message, FS and CR split across reads each answered once", Run: func() error {
+			a, b := id(15), id(16)
+			message := conformanceMessage("ORU^R01", a)
+			half := len(message) / 2
+			return expectACKs(exchange(vt+message[:half], message[half:], fs, cr+vt+conformanceMessage("ORU^R01", b)+fs, cr), "AA "+a, "AA "+b)
+		}},
+		{Protocol: "hl7", Name: "back_to_back_messages", Expect: "two messages in one write each answered", Run: func() error {
+			a, b := id(3), id(4)
+			return expectACKs(exchange(vt+conformanceMessage("ORU^R01", a)+fs+cr+vt+conformanceMessage("ORU^R01", b)+fs+cr), "AA "+a, "AA "+b)
+		}},
+		{Protocol: "hl7", Name: "missing_start_block", Expect: "message after lost VT recovered and answered", Run: func() error {
+			c := id(5)
+			return expectACKs(exchange(conformanceMessage("ORU^R01", c)+fs+cr), "AA "+c)
+		}},
+		{Protocol: "hl7", Name: "partial_message", Expect: "message without FS not answered", Run: func() error {
+			return expectACKs(exchange(vt + conformanceMessage("ORU^R01", id(6))))
+		}},
+		{Protocol: "hl7", Name: "unaccepted_type", Expect: "message type not accepted answered AR", Run: func() error {
+			c := id(7)
+			return expectACKs(exchange(vt+conformanceMessage("ADT^A01", c)+fs+cr), "AR "+c)
+		}},
+		{Protocol: "hl7", Name: "accepted_trigger", Expect: "only the configured trigger event of ORU accepted", Run: func() error {
+			cfg := *config.Get()
+			cfg.HL7AcceptedMessageTypes = []string{"ORU^R01"}
+			config.Set(&cfg)
+			a, b := id(13), id(14)
+			return expectACKs(exchange(vt+conformanceMessage("ORU^R01", a)+fs+cr+vt+conformanceMessage("ORU^R30", b)+fs+cr), "AA "+a, "AR "+b)
+		}},
+		{Protocol: "hl7", Name: "not_msh", Expect: "message not starting with MSH answered AE", Run: func() error {
+			c := id(17)
+			if err := expectACKs(exchange(vt+"\x00\x00GARBAGE"+fs+cr), "AE "); err != nil {
+				return err
+			}
+			return expectACKs(exchange(vt+"JUNK\r"+conformanceMessage("ORU^R01", c)+fs+cr), "AE "+c)
+		}},
+		{Protocol: "hl7", Name: "bad_delimiters", Expect: "MSH with unusable MSH-1/MSH-2 answered AE", Run: func() error {
+			message := strings.Replace(conformanceMessage("ORU^R01", id(18)), "MSH|^~\\&|", "MSH|^^|", 1)
+			return expectACKs(exchange(vt+message+fs+cr), "AE ")
+		}},
+		{Protocol: "hl7", Name: "no_results", Expect: "ORU without parseable OBX answered AE", Run: func() error {
+			c := id(8)
+			message := strings.Join(strings.Split(conformanceMessage("ORU^R01", c), "\r")[:3], "\r")
+			return expectACKs(exchange(vt+message+fs+cr), "AE "+c)
+		}},
+		{Protocol: "hl7", Name: "duplicate_results", Expect: "result sent again under a new control ID posted once, replicates kept", Run: func() error {
+			c := id(10)
+			message := conformanceMessage("ORU^R01", c) + "|||20261015120000"
+			first := BuildPayload(message, types.Transport{})
+			again := BuildPayload(strings.Replace(message, "|"+c+"|P|", "|"+c+"R|P|", 1), types.Transport{})
+			if n := len(prepare(first, ResultsEndpoint(config.Get().HL7Endpoint))); n != 1 {
+				return fmt.Errorf("first message made %d POST(s), want 1", n)
+			}
+			if n := len(prepare(again, ResultsEndpoint(config.Get().HL7Endpoint))); n != 0 {
+				return fmt.Errorf("retransmission made %d POST(s), want 0", n)
+			}
+
+			// Replicates within one message are not duplicates of each other
+			r := id(22)
+			replicates := conformanceMessage("ORU^R01", r) + "|||20261015120000\rOBX|2|NM|GLU^Glucose||5.2|mmol/L|3.9-5.5|N|||F|||20261015120000"
+			jobs := prepare(BuildPayload(replicates, types.Transport{}), ResultsEndpoint(config.Get().HL7Endpoint))
+			if len(jobs) != 1 || len(jobs[0].payload.Results) != 2 {
+				return fmt.Errorf("replicate results not both kept")
+			}
+			if n := len(prepare(BuildPayload(replicates, types.Transport{}), ResultsEndpoint(config.Get().HL7Endpoint))); n != 0 {
+				return fmt.Errorf("retransmitted replicates made %d POST(s), want 0", n)
+			}
+			return nil
+		}},
+		{Protocol: "hl7", Name: "results_outside_orders", Expect: "results with no accession kept out of another order's group and dedup key", Run: func() error {
+			// As the ASTM parser reports P1 O S1 R, O S2 R, P2 R (no O)
+			payload := types.HL7Message{
+				Order: types.HL7Order{AccessionNumber: "S2"},
+				Results: []types.HL7Result{
+					{AccessionNumber: "S1", TestCode: "GLU"},
+					{AccessionNumber: "S2", TestCode: "HBA1C"},
+					{TestCode: "NA"},
+				},
+			}
+			var got []string
+			for _, order := range nestResults(payload).Orders {
+				for _, r := range order.Results {
+					got = append(got, r.TestCode+"@"+order.AccessionNumber)
+				}
+			}
+			if want := "GLU@S1 HBA1C@S2 NA@"; strings.Join(got, " ") != want {
+				return fmt.Errorf("nested %s, want %s", strings.Join(got, " "), want)
+			}
+			if _, ok := resultKey(payload.Results[2], sampleFallback(payload)); ok {
+				return fmt.Errorf("result outside any order given a dedup key")
+			}
+			// A single-order message whose results carry no accession keeps its order
+			single := types.HL7Message{Order: types.HL7Order{AccessionNumber: "S3"}, Results: []types.HL7Result{{TestCode: "K"}}}
+			if orders := nestResults(single).Orders; len(orders) != 1 || orders[0].AccessionNumber != "S3" {
+				return fmt.Errorf("single-order results not nested under S3")
+			}
+			return nil
+		}},
+		{Protocol: "hl7", Name: "instrument_routes", Expect: "results routed by sender, unrouted senders to the default", Run: func() error {
+			cfg := *config.Get()
+			cfg.InstrumentRoutes = map[string]string{"CHEM1": "https://chemistry.example/results", "HEME1": "/hematology"}
+			config.Set(&cfg)
+			for sender, want := range map[string]string{
+				"CHEM1": "https://chemistry.example/results",
+				"HEME1": cfg.ExternalServerURL + "/hematology",
+				"OTHER": ResultsEndpoint(cfg.HL7Endpoint),
+			} {
+				message := strings.Replace(conformanceMessage("ORU^R01", id(11)+sender), "|CONFORMANCE|", "|"+sender+"|", 1)
+				payload := BuildPayload(message, types.Transport{})
+				jobs := prepare(payload, ResultsEndpoint(cfg.HL7Endpoint))
+				if len(jobs) != 1 {
+					return fmt.Errorf("%s made %d POST(s), want 1", sender, len(jobs))
+				}
+				if jobs[0].endpoint != want {
+					return fmt.Errorf("%s routed to %s, want %s", sender, jobs[0].endpoint, want)
+				}
+			}
+			return nil
+		}},
+		{Protocol: "hl7", Name: "code_mapping", Expect: "test codes and units mapped per instrument, then by \"*\"; unmapped codes kept", Run: func() error {
+			cfg := *config.Get()
+			cfg.TestCodeMap = map[string]map[string]string{
+				"CONFORMANCE": {"GLU": "GLUCOSE"},
+				"*":           {"GLU": "GLU-ANY", "NA": "SODIUM"},
+			}
+			cfg.UnitMap = map[string]map[string]string{"*": {"mmol/L": "mmol/l"}}
+			config.Set(&cfg)
+			message := conformanceMessage("ORU^R01", id(19)) + "\rOBX|2|NM|K^Potassium||4.1|mmol/L|||||F"
+			for sender, want := range map[string]string{
+				"CONFORMANCE": "GLUCOSE(GLU) mmol/l(mmol/L) K() mmol/l(mmol/L)",
+				"OTHER":       "GLU-ANY(GLU) mmol/l(mmol/L) K() mmol/l(mmol/L)",
+			} {
+				payload := BuildPayload(strings.Replace(message, "|CONFORMANCE|", "|"+sender+"|", 1), types.Transport{})
+				var got []string
+				for _, r := range payload.Results {
+					got = append(got, r.TestCode+"("+r.RawTestCode+") "+r.Units+"("+r.RawUnits+")")
+				}
+				if strings.Join(got, " ") != want {
+					return fmt.Errorf("%s results %s, want %s", sender, strings.Join(got, " "), want)
+				}
+			}
+			return nil
+		}},
+		{Protocol: "hl7", Name: "age_reference_range", Expect: "PID-7 birth date gives the age that selects age-specific ranges", Run: func() error {
+			cfg := *config.Get()
+			cfg.ReferenceRanges = map[string][]config.ReferenceRangeRule{
+				"GLU": {{Range: "3.3-5.6", MaxAge: 17, Override: true}, {Range: "4.0-6.0", MinAge: 65, Override: true}},
+			}
+			config.Set(&cfg)
+			c := id(23)
+			for birth, want := range map[string]string{"20100315": "3.3-5.6", "195001021230+0100": "4.0-6.0", "19800102": "3.9-5.5"} {
+				message := strings.Replace(conformanceMessage("ORU^R01", c), "PID|||"+c, "PID|||"+c+"||DOE^JANE||"+birth+"|F", 1) + "|||20261015120000"
+				payload := BuildPayload(message, types.Transport{})
+				if payload.Patient.AgeYears == nil {
+					return fmt.Errorf("birth date %s gave no age", birth)
+				}
+				if got := payload.Results[0].ReferenceRange; got != want {
+					return fmt.Errorf("born %s (age %d) given range %s, want %s", birth, *payload.Patient.AgeYears, got, want)
+				}
+			}
+			return nil
+		}},
+		{Protocol: "hl7", Name: "numeric_values", Expect: "comparators split from numbers, decimal commas read, text left alone, transforms followed", Run: func() error {
+			for _, tc := range []struct{ value, want string }{
+				{"5.2", "5.2"},
+				{">10.0", "> 10"},
+				{"<0.5", "< 0.5"},
+				{"<=3", "<= 3"},
+				{">= 1.5", ">= 1.5"},
+				{"5,6", "5.6"},
+				{"-0,25", "-0.25"},
+				{"POSITIVE", "none"},
+				{"1,234.5", "none"},
+				{"<", "none"},
+			} {
+				message := strings.Replace(conformanceMessage("ORU^R01", id(20)), "|5.2|", "|"+tc.value+"|", 1)
+				r := BuildPayload(message, types.Transport{}).Results[0]
+				got := "none"
+				if r.ValueNumeric != nil {
+					got = strings.TrimSpace(r.Comparator + " " + strconv.FormatFloat(*r.ValueNumeric, 'g', -1, 64))
+				}
+				if got != tc.want || r.Value != tc.value {
+					return fmt.Errorf("%q parsed as %s (value %q), want %s", tc.value, got, r.Value, tc.want)
+				}
+			}
+
+			// A transform that converts the value has value_numeric follow it
+			cfg := *config.Get()
+			cfg.ResultTransforms = map[string]string{"*": `{"value": "<0.1"}`}
+			config.Set(&cfg)
+			jobs := prepare(BuildPayload(conformanceMessage("ORU^R01", id(21)), types.Transport{}), ResultsEndpoint(cfg.HL7Endpoint))
+			if len(jobs) != 1 {
+				return fmt.Errorf("transformed message made %d POST(s), want 1", len(jobs))
+			}
+			if r := jobs[0].payload.Results[0]; r.ValueNumeric == nil || *r.ValueNumeric != 0.1 || r.Comparator != "<" {
+				return fmt.Errorf("value %q after transform kept value_numeric %v comparator %q", r.Value, r.ValueNumeric, r.Comparator)
+			}
+			return nil
+		}},
+		{Protocol: "hl7", Name: "declared_delimiters", Expect: "components and repetitions split on the separators declared in MSH-2", Run: func() error {
+			c := id(26)
+			message := strings.NewReplacer(
+				"MSH|^~\\&", "MSH|$%\\&",
+				"PID|||"+c, "PID|||"+c+"%MRN7||DOE$JANE",
+				"GLU^Glucose||5.2|", "GLU$Glucose||A$1%B$2|",
+			).Replace(conformanceMessage("ORU^R01", c))
+			payload := BuildPayload(message, types.Transport{})
+			if p := payload.Patient; p.ID != c || len(p.IDs) != 2 || p.IDs[1] != "MRN7" || p.LastName != "DOE" || p.FirstName != "JANE" {
+				return fmt.Errorf("PID parsed as ID %q IDs %v name %q %q", p.ID, p.IDs, p.LastName, p.FirstName)
+			}
+			if len(payload.Results) != 1 {
+				return fmt.Errorf("%d results parsed, want 1", len(payload.Results))
+			}
+			if r := payload.Results[0]; r.TestCode != "GLU" || r.TestName != "Glucose" || fmt.Sprint(r.Values) != "[[A 1] [B 2]]" {
+				return fmt.Errorf("OBX parsed as code %q name %q values %v", r.TestCode, r.TestName, r.Values)
+			}
+			return nil
+		}},
+		{Protocol: "hl7", Name: "declared_field_separator", Expect: "ORU with a \"#\" field separator parsed and answered AA", Run: func() error {
+			c := id(27)
+			message := strings.ReplaceAll(conformanceMessage("ORU^R01", c), "|", "#")
+			if r := BuildPayload(message, types.Transport{}).Results; len(r) != 1 || r[0].TestCode != "GLU" || r[0].Value != "5.2" {
+				return fmt.Errorf("OBX parsed as %+v", r)
+			}
+			return expectACKs(exchange(vt+message+fs+cr), "AA "+c)
+		}},
+		{Protocol: "hl7", Name: "dry_run", Expect: "dry run logs the payload and makes no HTTP request", Run: func() error {
+			cfg := *config.Get()
+			cfg.DryRun = true
+			config.Set(&cfg)
+
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				return err
+			}
+			defer ln.Close()
+			connected := make(chan struct{}, 1)
+			go func() {
+				if conn, err := ln.Accept(); err == nil {
+					conn.Close()
+					connected <- struct{}{}
+				}
+			}()
+
+			payload := BuildPayload(conformanceMessage("ORU^R01", id(12)), types.Transport{})
+			if err := deliver(newJob(payload, "http://"+ln.Addr().String()+"/results")); err != nil {
+				return fmt.Errorf("dry-run delivery failed: %v", err)
+			}
+			select {
+			case <-connected:
+				return fmt.Errorf("server was contacted")
+			case <-time.After(100 * time.Millisecond):
+				return nil
+			}
+		}},
+		{Protocol: "hl7", Name: "ndjson_checkpoint", Expect: "stream lines kept until the response confirms them, spooled when it fails", Run: func() error {
+			dir, err := os.MkdirTemp("", "ndjson")
+			if err != nil {
+				return err
+			}
+			defer os.RemoveAll(dir)
+			cfg := *config.Get()
+			cfg.ForwardMode, cfg.NDJSONCheckpoint, cfg.SpoolDir = "ndjson", 2, dir
+			config.Set(&cfg)
+
+			var mu sync.Mutex
+			status := http.StatusInternalServerError
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				return err
+			}
+			defer ln.Close()
+			go http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				io.Copy(io.Discard, r.Body)
+				mu.Lock()
+				defer mu.Unlock()
+				w.WriteHeader(status)
+			}))
+			endpoint := "http://" + ln.Addr().String() + "/stream"
+
+			// spooled waits for the stream ended at the checkpoint to settle
+			spooled := func(want int) error {
+				var n int
+				for deadline := time.Now().Add(2 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+					entries, _ := os.ReadDir(spoolDir(endpoint))
+					if n = len(entries); n == want {
+						return nil
+					}
+				}
+				return fmt.Errorf("%d line(s) spooled, want %d", n, want)
+			}
+			c := id(28)
+			for i := 0; i < 2; i++ {
+				if err := SendNDJSON(types.HL7Message{MessageID: fmt.Sprintf("%s-%d", c, i)}, endpoint); err != nil {
+					return fmt.Errorf("stream write failed: %v", err)
+				}
+			}
+			if err := spooled(2); err != nil {
+				return fmt.Errorf("stream answered 500: %v", err)
+			}
+
+			mu.Lock()
+			status = http.StatusOK
+			mu.Unlock()
+			for i := 2; i < 4; i++ {
+				if err := SendNDJSON(types.HL7Message{MessageID: fmt.Sprintf("%s-%d", c, i)}, endpoint); err != nil {
+					return fmt.Errorf("stream write failed: %v", err)
+				}
+			}
+			time.Sleep(100 * time.Millisecond)
+			if err := spooled(2); err != nil {
+				return fmt.Errorf("stream answered 200: %v", err)
+			}
+			return nil
+		}},
+		{Protocol: "hl7", Name: "form_partial_failure", Expect: "form results posted before a failure not posted again on retry", Run: func() error {
+			var mu sync.Mutex
+			var posts []string
+			failed := false
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				return err
+			}
+			defer ln.Close()
+			go http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				r.ParseForm()
+				mu.Lock()
+				defer mu.Unlock()
+				code := r.PostForm.Get("test_code")
+				posts = append(posts, code)
+				if code == "B" && !failed {
+					failed = true
+					w.WriteHeader(http.StatusServiceUnavailable)
+				}
+			}))
+
+			cfg := *config.Get()
+			cfg.ForwardMode, cfg.ForwardRetryAttempts = "form", 2
+			cfg.ForwardRetryBackoff, cfg.ForwardRetryMaxBackoff = time.Millisecond, time.Millisecond
+			config.Set(&cfg)
+			payload := types.HL7Message{MessageID: id(24), Results: []types.HL7Result{{TestCode: "A"}, {TestCode: "B"}, {TestCode: "C"}}}
+			if err := deliver(newJob(payload, "http://"+ln.Addr().String()+"/results")); err != nil {
+				return err
+			}
+			mu.Lock()
+			defer mu.Unlock()
+			if got := strings.Join(posts, " "); got != "A B B C" {
+				return fmt.Errorf("posted %s, want A B B C", got)
+			}
+			return nil
+		}},
+		{Protocol: "hl7", Name: "file_drop_unique", Expect: "second drop for a sample in the same second kept beside the first", Run: func() error {
+			dir, err := os.MkdirTemp("", "filedrop")
+			if err != nil {
+				return err
+			}
+			defer os.RemoveAll(dir)
+			cfg := *config.Get()
+			cfg.FileDropDir = dir
+			config.Set(&cfg)
+			payload := BuildPayload(conformanceMessage("ORU^R01", id(25)), types.Transport{})
+			for range 2 {
+				if err := DropFile(payload); err != nil {
+					return err
+				}
+			}
+			if entries, _ := os.ReadDir(dir); len(entries) != 2 {
+				return fmt.Errorf("%d file(s) in the drop directory, want 2", len(entries))
+			}
+			return nil
+		}},
+		{Protocol: "hl7", Name: "worker_pool", Expect: "concurrent workers forward every payload, each sample's in order", Run: func() error {
+			received := make(chan string, 8)
+			ln, err := net.Listen("tcp", "127.0.0.1:0")
+			if err != nil {
+				return err
+			}
+			defer ln.Close()
+			go http.Serve(ln, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				var payload types.HL7Message
+				json.NewDecoder(r.Body).Decode(&payload)
+				// Slow enough that a sample's jobs would overlap if workers raced
+				time.Sleep(20 * time.Millisecond)
+				received <- payload.MessageID
+			}))
+
+			queueMu.Lock()
+			saved := queue
+			queue = nil
+			queueMu.Unlock()
+			defer func() {
+				queueMu.Lock()
+				queue = saved
+				queueMu.Unlock()
+			}()
+
+			sent := []string{"S1-1", "S2-1", "S1-2", "S1-3", "S2-2", "S3-1"}
+			for _, messageID := range sent {
+				sample, _, _ := strings.Cut(messageID, "-")
+				push(newJob(types.HL7Message{MessageID: messageID, Order: types.HL7Order{AccessionNumber: sample}}, "http://"+ln.Addr().String()+"/results"))
+			}
+			// One delivery per worker, so every worker ends once the queue is empty
+			var workers sync.WaitGroup
+			for range sent {
+				workers.Add(1)
+				go func() {
+					defer workers.Done()
+					forwardNext()
+				}()
+			}
+			workers.Wait()
+			close(received)
+
+			last := map[string]string{}
+			n := 0
+			for messageID := range received {
+				sample, _, _ := strings.Cut(messageID, "-")
+				if messageID < last[sample] {
+					return fmt.Errorf("%s forwarded after %s", messageID, last[sample])
+				}
+				last[sample] = messageID
+				n++
+			}
+			if n != len(sent) {
+				return fmt.Errorf("%d of %d payloads forwarded", n, len(sent))
+			}
+			return nil
+		}},
+		{Protocol: "hl7", Name: "batch_size", Expect: "batch sent as soon as it holds forward_batch_size payloads", Run: func() error {
+			return collectBatch(2, time.Second, 3, 0, func(batch int, took time.Duration) error {
+				if batch != 2 || took >= time.Second {
+					return fmt.Errorf("batch of %d after %s, want 2 at once", batch, took)
+				}
+				return nil
+			})
+		}},
+		{Protocol: "hl7", Name: "batch_window", Expect: "partial batch sent when forward_batch_window ends", Run: func() error {
+			return collectBatch(10, 100*time.Millisecond, 1, 1, func(batch int, took time.Duration) error {
+				if batch != 2 || took < 100*time.Millisecond {
+					return fmt.Errorf("batch of %d after %s, want 2 after the window", batch, took)
+				}
+				return nil
+			})
+		}},
+		{Protocol: "hl7", Name: "orm_build", Expect: "pending orders rendered as ORM^O01 with ORC/OBR per test", Run: func() error {
+			segments := strings.Split(BuildORM(sampleOrders(), "ANALYZER", "ORM1"), "\r")
+			want := []string{"PID|1||PAT1||DOE^JANE||19800102|F", "ORC|NW|S1", "OBR|1|S1||GLU|S", "ORC|NW|S1", "OBR|2|S1||HBA1C|S", ""}
+			if code, trigger := MessageType(segments[0]); code != "ORM" || trigger != "O01" || !strings.Contains(segments[0], "|ANALYZER|") {
+				return fmt.Errorf("MSH %q, want ORM^O01 to ANALYZER", segments[0])
+			}
+			if strings.Join(segments[1:], "\n") != strings.Join(want, "\n") {
+				return fmt.Errorf("segments %q, want %q", segments[1:], want)
+			}
+			// Birth dates the LIS sends in other formats are rendered as HL7 dates
+			pending := sampleOrders()
+			pending.Patient.BirthDate = "02/01/1980"
+			if pid := strings.Split(BuildORM(pending, "ANALYZER", "ORM1"), "\r")[1]; pid != want[0] {
+				return fmt.Errorf("PID %q for birth date 02/01/1980, want %q", pid, want[0])
+			}
+			return nil
+		}},
+		{Protocol: "hl7", Name: "order_query", Expect: "QRY answered QCK, then ORM^O01 sent and ACKed", Run: func() error {
+			return orderQuery(vt + strings.Join([]string{
+				"MSH|^~\\&|ANALYZER|LAB|||" + time.Now().Format("20060102150405") + "||QRY^Q02|" + id(9) + "|P|2.3",
+				"QRD|" + time.Now().Format("20060102150405") + "|R|I|Q1|||RD|S1|OTH",
+			}, "\r") + fs + cr)
+		}},
+	}
+}
+
+// collectBatch queues queued jobs and pushes late more a quarter into the
+// window, then has the forwarder collect a batch with the given size and
+// window and passes check its length and how long it took. The live
+// queue is set aside meanwhile.
+func collectBatch(size int, window time.Duration, queued, late int, check func(batch int, took time.Duration) error) error {
+	cfg := *config.Get()
+	cfg.ForwardBatchSize, cfg.ForwardBatchWindow = size, window
+	config.Set(&cfg)
+
+	queueMu.Lock()
+	saved := queue
+	queue = nil
+	for i := 0; i < queued; i++ {
+		heap.Push(&queue, newJob(types.HL7Message{MessageID: fmt.Sprintf("BATCH%d", i)}, "/batch"))
+	}
+	queueMu.Unlock()
+	defer func() {
+		queueMu.Lock()
+		queue = saved
+		queueMu.Unlock()
+	}()
+
+	for i := 0; i < late; i++ {
+		go func() {
+			time.Sleep(window / 4)
+			push(newJob(types.HL7Message{MessageID: "LATE"}, "/batch"))
+		}()
+	}
+
+	start := time.Now()
+	queueMu.Lock()
+	batch := fillBatch([]*forwardJob{heap.Pop(&queue).(*forwardJob)})
+	queueMu.Unlock()
+	return check(len(batch), time.Since(start))
+}
+
+// sampleOrders is one accession of two tests for a known patient
+func sampleOrders() types.PendingOrders {
+	return types.PendingOrders{
+		Patient: types.HL7Patient{ID: "PAT1", LastName: "DOE", FirstName: "JANE", BirthDate: "1980-01-02", Sex: "F"},
+		Orders:  []types.OrderRequest{{AccessionNumber: "S1", Priority: "S", Tests: []string{"GLU", "HBA1C"}}},
+	}
+}
+
+// orderQuery sends query to the connection handler as an instrument would,
+// expects QCK AA then an ORM^O01, and ACKs the ORM
+func orderQuery(query string) error {
+	saved := lookupOrders
+	defer func() { lookupOrders = saved }()
+	lookupOrders = func(sampleID string) (types.PendingOrders, bool, error) {
+		return sampleOrders(), sampleID == "S1", nil
+	}
+	cfg := *config.Get()
+	cfg.HL7SendOrders = true
+	config.Set(&cfg)
+
+	client, server := net.Pipe()
+	defer client.Close()
+	go HandleConnection(context.Background(), server)
+	go client.Write([]byte(query))
+
+	reader := bufio.NewReader(client)
+	client.SetReadDeadline(time.Now().Add(2 * time.Second))
+	qck, err := readMLLP(reader)
+	if err != nil {
+		return fmt.Errorf("no QCK: %v", err)
+	}
+	if code, trigger := MessageType(qck); code != "QCK" || trigger != "Q02" {
+		return fmt.Errorf("query answered %s^%s, want QCK^Q02", code, trigger)
+	}
+	if code, _ := ackStatus(qck); code != "AA" {
+		return fmt.Errorf("QCK code %s, want AA", code)
+	}
+	orm, err := readMLLP(reader)
+	if err != nil {
+		return fmt.Errorf("no ORM: %v", err)
+	}
+	if code, trigger := MessageType(orm); code != "ORM" || trigger != "O01" {
+		return fmt.Errorf("order sent as %s^%s, want ORM^O01", code, trigger)
+	}
+	_, err = client.Write(FrameMLLP(GenerateACK(orm)))
+	return err
+}
@@ -0,0 +1,66 @@
+package hl7
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"time"
+
+	"lightbaseEMRProxy/internal/config"
+	"lightbaseEMRProxy/types"
+)
+
+// deadLetter is the on-disk record of a payload that will not be forwarded
+type deadLetter struct {
+	Reason         string           `json:"reason"`
+	Endpoint       string           `json:"endpoint"`
+	DeadLetteredAt string           `json:"dead_lettered_at"`
+	Payload        types.HL7Message `json:"payload"`
+
+	// RawPayload replaces Payload when the payload itself cannot be encoded
+	RawPayload string `json:"raw_payload,omitempty"`
+}
+
+var unsafeFileChars = regexp.MustCompile(`[^A-Za-z0-9._-]+`)
+
+// DeadLetter writes payload and the reason it was not forwarded to the
+// dead-letter directory for manual review. Its results are let through the
+// duplicate check again, as they never reached the server.
+func DeadLetter(payload types.HL7Message, endpoint, reason string) {
+	forgetResults(payload)
+	now := time.Now()
+	record := deadLetter{
+		Reason:         reason,
+		Endpoint:       endpoint,
+		DeadLetteredAt: now.Format(time.RFC3339),
+		Payload:        payload,
+	}
+
+	data, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		// Keep a readable dump rather than losing the results
+		record.Payload = types.HL7Message{MessageID: payload.MessageID}
+		record.RawPayload = fmt.Sprintf("%+v", payload)
+		if data, err = json.MarshalIndent(record, "", "  "); err != nil {
+			log.Printf("❌ [DLQ] Could not encode dead letter [%s]: %v\n", payload.MessageID, err)
+			return
+		}
+	}
+
+	if err := os.MkdirAll(config.Get().DeadLetterDir, 0o755); err != nil {
+		log.Printf("❌ [DLQ] Could not create %s: %v\n", config.Get().DeadLetterDir, err)
+		return
+	}
+
+	name := fmt.Sprintf("%s_%s.json", now.Format("20060102T150405.000000000"), unsafeFileChars.ReplaceAllString(payload.MessageID, "_"))
+	path := filepath.Join(config.Get().DeadLetterDir, name)
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		log.Printf("❌ [DLQ] Could not write %s: %v\n", path, err)
+		return
+	}
+
+	log.Printf("🪦 [DLQ] Dead-lettered [%s]: %s → %s\n", payload.MessageID, reason, path)
+}
@@ -0,0 +1,39 @@
+package hl7
+
+import (
+	"bytes"
+	"encoding/json"
+	"log"
+
+	"lightbaseEMRProxy/internal/logger"
+)
+
+// logDryRun logs the JSON job would be posted with, pretty-printed and
+// with PHI masked as configured, in place of posting it. A payload that
+// cannot be encoded fails as it would if posted.
+func logDryRun(job *forwardJob) error {
+	payload := job.payload
+	payload.Patient.ID = logger.Redact(logger.PHIID, payload.Patient.ID)
+	ids := make([]string, len(payload.Patient.IDs))
+	for i, id := range payload.Patient.IDs {
+		ids[i] = logger.Redact(logger.PHIID, id)
+	}
+	if len(ids) > 0 {
+		payload.Patient.IDs = ids
+	}
+	for _, name := range []*string{&payload.Patient.Name, &payload.Patient.LastName, &payload.Patient.FirstName, &payload.Patient.MiddleName} {
+		*name = logger.Redact(logger.PHIName, *name)
+	}
+	payload.Patient.BirthDate = logger.Redact(logger.PHIBirthDate, payload.Patient.BirthDate)
+
+	body, err := marshalPayload(payload)
+	if err != nil {
+		return err
+	}
+	var pretty bytes.Buffer
+	if err := json.Indent(&pretty, body, "", "  "); err != nil {
+		pretty.Write(body)
+	}
+	log.Printf("🧪 [DRY-RUN] Not sent — would POST to %s:\n%s\n", job.endpoint, pretty.String())
+	return nil
+}
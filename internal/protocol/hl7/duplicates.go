@@ -0,0 +1,73 @@
+package hl7
+
+import (
+	"log"
+	"strings"
+	"time"
+
+	"lightbaseEMRProxy/internal/config"
+	"lightbaseEMRProxy/internal/dedup"
+	"lightbaseEMRProxy/internal/metrics"
+	"lightbaseEMRProxy/types"
+)
+
+// forwardedResults remembers recently forwarded results, so a result an
+// instrument sends again (after a NAK, a timeout or a resent session that
+// differs in framing) is not posted twice
+var forwardedResults = dedup.NewLimited(
+	func() time.Duration { return config.Get().ResultDedupWindow },
+	func() int { return config.Get().ResultDedupSize },
+)
+
+// duplicateResults counts results dropped as already forwarded
+var duplicateResults = metrics.NewCounter("duplicate_results_total", "Results dropped because the same result was forwarded recently")
+
+// resultKey is the stable identity of a result: sample, test code, value
+// and time, with fallback (see sampleFallback) as the sample of results
+// that carry none. Results without a sample ID have no key, since results
+// of different patients could not be told apart.
+func resultKey(r types.HL7Result, fallback string) (string, bool) {
+	sample := r.AccessionNumber
+	if sample == "" {
+		sample = fallback
+	}
+	if sample == "" {
+		return "", false
+	}
+	return dedup.Hash(strings.Join([]string{sample, r.TestCode, r.Value, r.Timestamp}, "\x00")), true
+}
+
+// dropDuplicates removes the results of payload forwarded within
+// config.Get().ResultDedupWindow. Identical results within payload itself
+// (replicates) are not duplicates of each other and are all kept.
+func dropDuplicates(payload types.HL7Message) types.HL7Message {
+	kept := payload.Results[:0:0]
+	fallback := sampleFallback(payload)
+	keptKeys := map[string]bool{}
+	for _, r := range payload.Results {
+		key, ok := resultKey(r, fallback)
+		if ok && !keptKeys[key] && forwardedResults.Seen(key) {
+			duplicateResults.Inc()
+			log.Printf("♻️  [FWD] Duplicate result %s=%s for %s dropped [%s]\n", r.TestCode, r.Value, payload.Order.AccessionNumber, payload.MessageID)
+			continue
+		}
+		if ok {
+			keptKeys[key] = true
+		}
+		kept = append(kept, r)
+	}
+	payload.Results = kept
+	return payload
+}
+
+// forgetResults lets the results of payload through the duplicate check
+// again, for a forward that failed or was dead-lettered, so the
+// instrument's retransmission is not dropped
+func forgetResults(payload types.HL7Message) {
+	fallback := sampleFallback(payload)
+	for _, r := range payload.Results {
+		if key, ok := resultKey(r, fallback); ok {
+			forwardedResults.Forget(key)
+		}
+	}
+}
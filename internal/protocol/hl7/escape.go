@@ -0,0 +1,67 @@
+package hl7
+
+import (
+	"encoding/hex"
+	"strings"
+)
+
+// unescape decodes the HL7 escape sequences in value. delimiters is MSH-1
+// followed by MSH-2 (e.g. "|^~\&"), so messages declaring their own
+// encoding characters decode correctly. Sequences it does not know, such
+// as highlighting (\H\ and \N\), are kept verbatim.
+func unescape(value, delimiters string) string {
+	if len(delimiters) < 4 {
+		delimiters = `|^~\&`
+	}
+	field, component, repetition, esc := delimiters[0:1], delimiters[1:2], delimiters[2:3], delimiters[3:4]
+	subcomponent := "&"
+	if len(delimiters) > 4 {
+		subcomponent = delimiters[4:5]
+	}
+	if !strings.Contains(value, esc) {
+		return value
+	}
+
+	var b strings.Builder
+	for {
+		start := strings.Index(value, esc)
+		if start < 0 {
+			break
+		}
+		end := strings.Index(value[start+1:], esc)
+		if end < 0 {
+			break
+		}
+		end += start + 1
+
+		b.WriteString(value[:start])
+		switch seq := value[start+1 : end]; {
+		case seq == "F":
+			b.WriteString(field)
+		case seq == "S":
+			b.WriteString(component)
+		case seq == "R":
+			b.WriteString(repetition)
+		case seq == "E":
+			b.WriteString(esc)
+		case seq == "T":
+			b.WriteString(subcomponent)
+		case seq == ".br":
+			b.WriteString("\n")
+		case strings.HasPrefix(seq, "X") && len(seq) > 1 && hexDecodes(seq[1:]):
+			decoded, _ := hex.DecodeString(seq[1:])
+			b.Write(decoded)
+		default:
+			b.WriteString(value[start : end+1])
+		}
+		value = value[end+1:]
+	}
+	b.WriteString(value)
+	return b.String()
+}
+
+// hexDecodes reports whether s is an even-length run of hex digits
+func hexDecodes(s string) bool {
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
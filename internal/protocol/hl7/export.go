@@ -2,20 +2,42 @@ package hl7
 
 import (
 	"bytes"
-	"encoding/json"
 	"fmt"
 	"io"
+	"lightbaseEMRProxy/internal/metrics"
 	"lightbaseEMRProxy/types"
 	"log"
 	"net/http"
 	"time"
 )
 
+// requestSeconds times each POST to the external server
+var requestSeconds = metrics.NewHistogram("forward_request_seconds", "Latency of POST requests to the external server",
+	[]float64{0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10, 30, 60})
+
 // SendToExternalSaver sends parsed HL7 data to an external persistence service
 func SendToExternalSaver(payload types.HL7Message, endpoint string) error {
-	jsonBody, err := json.Marshal(payload)
+	jsonBody, err := marshalPayload(payload)
 	if err != nil {
-		return fmt.Errorf("failed to marshal payload: %w", err)
+		return err
+	}
+	return postJSON(jsonBody, endpoint)
+}
+
+// SendBatch posts already-encoded payloads to endpoint as one JSON array
+func SendBatch(bodies [][]byte, endpoint string) error {
+	return postJSON(append(append([]byte{'['}, bytes.Join(bodies, []byte{','})...), ']'), endpoint)
+}
+
+// postJSON POSTs jsonBody to endpoint, compressed when negotiated, and
+// fails on any non-2xx answer
+func postJSON(jsonBody []byte, endpoint string) error {
+	var err error
+	compressed := useGzip()
+	if compressed {
+		if jsonBody, err = gzipBody(jsonBody); err != nil {
+			return fmt.Errorf("failed to compress payload: %w", err)
+		}
 	}
 
 	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewBuffer(jsonBody))
@@ -24,13 +46,19 @@ func SendToExternalSaver(payload types.HL7Message, endpoint string) error {
 	}
 
 	req.Header.Set("Content-Type", "application/json")
+	if compressed {
+		req.Header.Set("Content-Encoding", "gzip")
+	}
 	req.Header.Set("X-Source", "hl7-bridge")
 
-	client := &http.Client{
-		Timeout: 60 * time.Second,
+	client, err := serverClient()
+	if err != nil {
+		return err
 	}
 
+	start := time.Now()
 	resp, err := client.Do(req)
+	requestSeconds.Observe(time.Since(start).Seconds())
 	if err != nil {
 		return fmt.Errorf("external saver request failed: %w", err)
 	}
@@ -44,7 +72,7 @@ func SendToExternalSaver(payload types.HL7Message, endpoint string) error {
 	log.Printf("\n🌐 API Response [%d]:\n%s\n", resp.StatusCode, string(rawBody))
 
 	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		return fmt.Errorf("API returned status %d", resp.StatusCode)
+		return &statusError{code: resp.StatusCode}
 	}
 
 	return nil
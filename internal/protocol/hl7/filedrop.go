@@ -0,0 +1,80 @@
+package hl7
+
+import (
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"lightbaseEMRProxy/internal/config"
+	"lightbaseEMRProxy/types"
+)
+
+// DropFile writes payload as an HL7 ORU file into config.Get().FileDropDir for
+// LIS systems that ingest from a watched folder. The file is written under
+// a hidden temporary name and linked into place, so the watcher never
+// sees a partial file. A name already taken gets a -2, -3, ... suffix.
+func DropFile(payload types.HL7Message) error {
+	message := BuildORU(payload)
+	if err := validateORU(message); err != nil {
+		return err
+	}
+
+	if err := os.MkdirAll(config.Get().FileDropDir, 0o755); err != nil {
+		return fmt.Errorf("failed to create drop directory: %w", err)
+	}
+
+	name := dropFileName(payload, time.Now())
+	tmp, err := os.CreateTemp(config.Get().FileDropDir, ".drop-*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer os.Remove(tmp.Name())
+
+	if _, err := tmp.WriteString(message); err != nil {
+		tmp.Close()
+		return fmt.Errorf("failed to write %s: %w", tmp.Name(), err)
+	}
+	if err := tmp.Close(); err != nil {
+		return fmt.Errorf("failed to write %s: %w", tmp.Name(), err)
+	}
+
+	// Linking, unlike renaming, never replaces a file of the same name, as
+	// a second result set for the sample within the same second would have
+	ext := filepath.Ext(name)
+	path := filepath.Join(config.Get().FileDropDir, name)
+	for n := 2; ; n++ {
+		err := os.Link(tmp.Name(), path)
+		if err == nil {
+			break
+		}
+		if !os.IsExist(err) {
+			return fmt.Errorf("failed to move file into place: %w", err)
+		}
+		path = filepath.Join(config.Get().FileDropDir, fmt.Sprintf("%s-%d%s", strings.TrimSuffix(name, ext), n, ext))
+	}
+
+	log.Printf("📂 [DROP] Wrote [%s] → %s\n", payload.MessageID, path)
+	return nil
+}
+
+// dropFileName expands config.Get().FileDropName. Placeholders: {sample}
+// (accession number), {message_id}, {instrument}, {patient_id} and
+// {timestamp} (YYYYMMDDHHMMSS).
+func dropFileName(payload types.HL7Message, now time.Time) string {
+	safe := func(s string) string {
+		if s == "" {
+			return "unknown"
+		}
+		return unsafeFileChars.ReplaceAllString(s, "_")
+	}
+	return strings.NewReplacer(
+		"{sample}", safe(payload.Order.AccessionNumber),
+		"{message_id}", safe(payload.MessageID),
+		"{instrument}", safe(payload.Instrument),
+		"{patient_id}", safe(payload.Patient.ID),
+		"{timestamp}", now.Format("20060102150405"),
+	).Replace(config.Get().FileDropName)
+}
@@ -0,0 +1,101 @@
+package hl7
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"lightbaseEMRProxy/internal/config"
+	"lightbaseEMRProxy/types"
+)
+
+// SendForm posts each result of payload to endpoint as a flat
+// application/x-www-form-urlencoded body, for backends that cannot read
+// JSON, and returns how many results were posted before any failure
+func SendForm(payload types.HL7Message, endpoint string) (posted int, err error) {
+	client, err := serverClient()
+	if err != nil {
+		return 0, err
+	}
+
+	for i, r := range payload.Results {
+		body := formValues(payload, r).Encode()
+		req, err := http.NewRequest(http.MethodPost, endpoint, strings.NewReader(body))
+		if err != nil {
+			return i, fmt.Errorf("failed to create request: %w", err)
+		}
+		req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		req.Header.Set("X-Source", "hl7-bridge")
+
+		start := time.Now()
+		resp, err := client.Do(req)
+		requestSeconds.Observe(time.Since(start).Seconds())
+		if err != nil {
+			return i, fmt.Errorf("external saver request failed on result %d: %w", i+1, err)
+		}
+		rawBody, _ := io.ReadAll(resp.Body)
+		resp.Body.Close()
+
+		log.Printf("\n🌐 API Response [%d] (result %d/%d):\n%s\n", resp.StatusCode, i+1, len(payload.Results), string(rawBody))
+		if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+			return i, &statusError{code: resp.StatusCode, detail: fmt.Sprintf(" on result %d", i+1)}
+		}
+	}
+	return len(payload.Results), nil
+}
+
+// sendFormRemaining posts the results of job form-encoded. On failure the
+// results already posted are removed from job.payload, so the retry, the
+// spool and the dead letter carry only the ones the server has not got.
+func sendFormRemaining(job *forwardJob) error {
+	posted, err := SendForm(job.payload, job.endpoint)
+	if err != nil && posted > 0 {
+		log.Printf("✂️  [FWD] %d of %d result(s) posted before the failure — only the rest will be retried [%s]\n", posted, len(job.payload.Results), job.payload.MessageID)
+		job.payload.Results = job.payload.Results[posted:]
+	}
+	return err
+}
+
+// formValues flattens one result and its message context into key-value
+// pairs. When config.Get().FormFields is set only the listed keys are sent,
+// renamed to the form keys the backend expects.
+func formValues(payload types.HL7Message, r types.HL7Result) url.Values {
+	flat := url.Values{}
+	for key, value := range map[string]string{
+		"message_id":       payload.MessageID,
+		"source":           payload.Source,
+		"protocol":         payload.Protocol,
+		"instrument":       payload.Instrument,
+		"patient_id":       payload.Patient.ID,
+		"patient_name":     payload.Patient.Name,
+		"accession_number": payload.Order.AccessionNumber,
+		"priority":         payload.Order.Priority,
+		"received_at":      formatTimestamp(payload.ReceivedAt),
+		"test_code":        r.TestCode,
+		"test_name":        r.TestName,
+		"value":            r.Value,
+		"raw_value":        r.RawValue,
+		"units":            r.Units,
+		"reference_range":  r.ReferenceRange,
+		"abnormal_flags":   r.AbnormalFlags,
+		"status":           r.Status,
+		"timestamp":        formatTimestamp(r.Timestamp),
+	} {
+		if value != "" {
+			flat.Set(key, value)
+		}
+	}
+
+	if len(config.Get().FormFields) == 0 {
+		return flat
+	}
+	mapped := url.Values{}
+	for formKey, key := range config.Get().FormFields {
+		mapped.Set(formKey, flat.Get(key))
+	}
+	return mapped
+}
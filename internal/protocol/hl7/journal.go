@@ -0,0 +1,104 @@
+package hl7
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"time"
+
+	"lightbaseEMRProxy/internal/config"
+)
+
+// journal writes a copy of a queued job to config.Get().QueueDir so it
+// survives a restart; the copy is removed once the job is delivered,
+// spooled or dead-lettered. File names sort in queue order.
+func journal(job *forwardJob) {
+	dir := config.Get().QueueDir
+	if dir == "" || job.journal != "" {
+		return
+	}
+
+	now := time.Now()
+	data, err := json.MarshalIndent(spooled{
+		Endpoint:  job.endpoint,
+		SpooledAt: now.Format(time.RFC3339),
+		Payload:   job.payload,
+	}, "", "  ")
+	if err != nil {
+		log.Printf("❌ [QUEUE] Could not encode [%s]: %v\n", job.payload.MessageID, err)
+		return
+	}
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		log.Printf("❌ [QUEUE] Could not create %s: %v\n", dir, err)
+		return
+	}
+
+	name := fmt.Sprintf("%s_%08d_%s.json", now.Format("20060102T150405.000000000"), job.seq, unsafeFileChars.ReplaceAllString(job.payload.MessageID, "_"))
+	path := filepath.Join(dir, name)
+	// Write then rename, so a crash never leaves a half-written entry
+	if err := os.WriteFile(path+".tmp", data, 0o644); err != nil {
+		log.Printf("❌ [QUEUE] Could not write %s: %v\n", path, err)
+		return
+	}
+	if err := os.Rename(path+".tmp", path); err != nil {
+		log.Printf("❌ [QUEUE] Could not write %s: %v\n", path, err)
+		return
+	}
+	job.journal = path
+}
+
+// unjournal removes a finished job's copy from the queue directory
+func unjournal(job *forwardJob) {
+	if job.journal == "" {
+		return
+	}
+	if err := os.Remove(job.journal); err != nil && !os.IsNotExist(err) {
+		log.Printf("❌ [QUEUE] Could not remove %s: %v\n", job.journal, err)
+	}
+}
+
+// RecoverQueue re-queues the jobs left in the queue directory by a previous
+// run, in their original order. Call it before anything else is queued.
+func RecoverQueue() {
+	dir := config.Get().QueueDir
+	if dir == "" {
+		return
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("❌ [QUEUE] Could not read %s: %v\n", dir, err)
+		}
+		return
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+	recovered := 0
+	for _, entry := range entries {
+		if entry.IsDir() || filepath.Ext(entry.Name()) != ".json" {
+			continue
+		}
+		path := filepath.Join(dir, entry.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			log.Printf("❌ [QUEUE] Could not read %s: %v\n", path, err)
+			continue
+		}
+		var record spooled
+		if err := json.Unmarshal(data, &record); err != nil {
+			log.Printf("❌ [QUEUE] Could not decode %s: %v\n", path, err)
+			continue
+		}
+
+		job := newJob(record.Payload, record.Endpoint)
+		job.journal = path
+		push(job)
+		recovered++
+	}
+	if recovered > 0 {
+		log.Printf("♻️  [QUEUE] Recovered %d queued deliveries from %s\n", recovered, dir)
+	}
+}
@@ -0,0 +1,73 @@
+package hl7
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"lightbaseEMRProxy/internal/config"
+	"lightbaseEMRProxy/types"
+)
+
+// payloadSize returns the size of payload as forwarded
+func payloadSize(payload types.HL7Message) int {
+	body, err := json.Marshal(payload)
+	if err != nil {
+		return 0
+	}
+	return len(body)
+}
+
+// limitSize enforces config.Get().ForwardMaxBytes on a delivery. Oversize
+// payloads are either routed whole to the large-object endpoint or split
+// into payloads carrying as many results as fit; a single result too
+// large on its own, or a payload with no results to split, is dead-lettered.
+func limitSize(job *forwardJob) []*forwardJob {
+	if config.Get().ForwardMaxBytes <= 0 {
+		return []*forwardJob{job}
+	}
+	size := payloadSize(job.payload)
+	if size <= config.Get().ForwardMaxBytes {
+		return []*forwardJob{job}
+	}
+
+	if config.Get().OversizeMode == "route" {
+		log.Printf("📦 [FWD] Payload [%s] is %d bytes (limit %d) — routing to large-object endpoint\n", job.payload.MessageID, size, config.Get().ForwardMaxBytes)
+		return []*forwardJob{newJob(job.payload, config.Get().ExternalServerURL+config.Get().LargeObjectEndpoint)}
+	}
+
+	// With no results to split, what is oversize (e.g. unknown_records) goes
+	// into every chunk, so the payload cannot be made to fit
+	if len(job.payload.Results) == 0 {
+		DeadLetter(job.payload, job.endpoint, fmt.Sprintf("oversize: %d bytes with no results to split, limit %d", size, config.Get().ForwardMaxBytes))
+		return nil
+	}
+
+	var jobs []*forwardJob
+	chunk := job.payload
+	chunk.Results = nil
+	for _, r := range job.payload.Results {
+		next := chunk
+		next.Results = append(append([]types.HL7Result{}, chunk.Results...), r)
+		if len(chunk.Results) > 0 && payloadSize(next) > config.Get().ForwardMaxBytes {
+			jobs = append(jobs, newJob(chunk, job.endpoint))
+			next.Results = []types.HL7Result{r}
+		}
+		chunk = next
+	}
+
+	if len(chunk.Results) > 0 {
+		jobs = append(jobs, newJob(chunk, job.endpoint))
+	}
+
+	var fitting []*forwardJob
+	for _, j := range jobs {
+		if n := payloadSize(j.payload); n > config.Get().ForwardMaxBytes {
+			DeadLetter(j.payload, j.endpoint, fmt.Sprintf("oversize: single result is %d bytes, limit %d", n, config.Get().ForwardMaxBytes))
+			continue
+		}
+		fitting = append(fitting, j)
+	}
+	log.Printf("✂️  [FWD] Payload [%s] is %d bytes (limit %d) — split into %d request(s)\n", job.payload.MessageID, size, config.Get().ForwardMaxBytes, len(fitting))
+	return fitting
+}
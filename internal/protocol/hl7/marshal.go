@@ -0,0 +1,53 @@
+package hl7
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+
+	"lightbaseEMRProxy/internal/config"
+	"lightbaseEMRProxy/internal/metrics"
+	"lightbaseEMRProxy/types"
+)
+
+// marshalFailures counts payloads that could not be encoded for forwarding
+var marshalFailures = metrics.NewCounter("forward_marshal_failures_total", "Payloads that could not be JSON-encoded and were dead-lettered")
+
+// marshalError is a payload that cannot be encoded; retrying will not help,
+// so it is dead-lettered rather than spooled
+type marshalError struct {
+	err       error
+	offending []int // indexes of results that fail to encode on their own
+}
+
+func (e *marshalError) Error() string {
+	if len(e.offending) > 0 {
+		return fmt.Sprintf("failed to marshal payload (results %v): %v", e.offending, e.err)
+	}
+	return fmt.Sprintf("failed to marshal payload: %v", e.err)
+}
+
+func (e *marshalError) Unwrap() error { return e.err }
+
+// marshalPayload encodes payload for forwarding, counting failures and
+// identifying the results responsible
+func marshalPayload(payload types.HL7Message) ([]byte, error) {
+	payload = formatTimestamps(payload)
+	if config.Get().NestResultsByOrder {
+		payload = nestResults(payload)
+	}
+	body, err := json.Marshal(payload)
+	if err == nil {
+		return body, nil
+	}
+
+	marshalFailures.Inc()
+	merr := &marshalError{err: err}
+	for i, r := range payload.Results {
+		if _, rerr := json.Marshal(r); rerr != nil {
+			merr.offending = append(merr.offending, i)
+		}
+	}
+	log.Printf("❌ [FWD] %v [%s]\n", merr, payload.MessageID)
+	return nil, merr
+}
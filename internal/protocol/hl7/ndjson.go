@@ -0,0 +1,178 @@
+package hl7
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"sync"
+	"time"
+
+	"lightbaseEMRProxy/internal/config"
+	"lightbaseEMRProxy/types"
+)
+
+// ndjsonStream is a long-lived chunked POST carrying one JSON payload per line
+type ndjsonStream struct {
+	pw *io.PipeWriter
+
+	// mu guards unacked, the lines written but not yet confirmed by the
+	// server's response, with the endpoint each was delivered for
+	mu      sync.Mutex
+	unacked []streamedLine
+}
+
+// streamedLine is a payload written on a stream, kept until confirmed
+type streamedLine struct {
+	payload  types.HL7Message
+	endpoint string
+}
+
+// streams holds one persistent stream per endpoint, so routed, review,
+// fan-out and large-object deliveries keep their own destination
+var (
+	streamMu sync.Mutex
+	streams  = map[string]*ndjsonStream{}
+)
+
+// ndjsonEndpoint returns where a delivery for endpoint is streamed: the
+// protocol results endpoints share config.Get().NDJSONEndpoint, and any
+// other endpoint gets a stream of its own
+func ndjsonEndpoint(endpoint string) string {
+	switch endpoint {
+	case ResultsEndpoint(config.Get().HL7Endpoint), ResultsEndpoint(config.Get().ASTMEndpoint):
+		return config.Get().ExternalServerURL + config.Get().NDJSONEndpoint
+	}
+	return endpoint
+}
+
+// SendNDJSON writes payload, delivered for endpoint, as a single line on
+// the persistent NDJSON stream to ndjsonEndpoint(endpoint), reconnecting
+// once if the stream has broken. The line is kept until the server's
+// response confirms it; every config.Get().NDJSONCheckpoint lines the
+// stream is ended to get that response.
+func SendNDJSON(payload types.HL7Message, endpoint string) error {
+	line, err := marshalPayload(payload)
+	if err != nil {
+		return err
+	}
+	line = append(line, '\n')
+	url := ndjsonEndpoint(endpoint)
+
+	streamMu.Lock()
+	defer streamMu.Unlock()
+
+	for attempt := 0; attempt < 2; attempt++ {
+		stream := streams[url]
+		if stream == nil {
+			stream = openNDJSONStream(url)
+			streams[url] = stream
+		}
+		var ended bool
+		if ended, err = stream.write(line, streamedLine{payload, endpoint}); err == nil {
+			if ended {
+				delete(streams, url)
+			}
+			return nil
+		}
+		log.Printf("⚠️  [NDJSON] Stream to %s write failed, reconnecting: %v\n", url, err)
+		stream.pw.Close()
+		delete(streams, url)
+	}
+	return fmt.Errorf("ndjson stream write failed: %w", err)
+}
+
+// write writes line on s, giving up after config.Get().NDJSONWriteTimeout,
+// and keeps sent as unconfirmed. Once s holds config.Get().NDJSONCheckpoint
+// unconfirmed lines its request body is ended so the server responds, and
+// ended reports that s takes no more lines.
+func (s *ndjsonStream) write(line []byte, sent streamedLine) (ended bool, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	done := make(chan error, 1)
+	go func() {
+		_, err := s.pw.Write(line)
+		done <- err
+	}()
+	select {
+	case err = <-done:
+		if err != nil {
+			return false, err
+		}
+	case <-time.After(config.Get().NDJSONWriteTimeout):
+		// Closing the pipe fails the blocked write and the request with it
+		err = fmt.Errorf("write timed out after %s", config.Get().NDJSONWriteTimeout)
+		s.pw.CloseWithError(err)
+		<-done
+		return false, err
+	}
+
+	s.unacked = append(s.unacked, sent)
+	if len(s.unacked) < config.Get().NDJSONCheckpoint {
+		return false, nil
+	}
+	s.pw.Close()
+	return true, nil
+}
+
+// settle handles the lines s carried once its request has ended: a 2xx
+// response confirms them, and on any other outcome they are spooled for
+// redelivery
+func (s *ndjsonStream) settle(url string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if err == nil {
+		log.Printf("✅ [NDJSON] Stream to %s confirmed %d line(s)\n", url, len(s.unacked))
+	} else if len(s.unacked) > 0 {
+		log.Printf("❌ [NDJSON] Stream to %s failed with %d unconfirmed line(s), spooling: %v\n", url, len(s.unacked), err)
+		for _, line := range s.unacked {
+			Spool(line.payload, line.endpoint, err)
+		}
+	}
+	s.unacked = nil
+}
+
+func openNDJSONStream(endpoint string) *ndjsonStream {
+	pr, pw := io.Pipe()
+	s := &ndjsonStream{pw: pw}
+
+	go func() {
+		err := streamRequest(endpoint, pr)
+		pr.CloseWithError(err)
+		s.settle(endpoint, err)
+	}()
+
+	log.Printf("🌐 [NDJSON] Opened stream to %s\n", endpoint)
+	return s
+}
+
+// streamRequest POSTs body to endpoint until either side ends it,
+// returning nil only for a 2xx response
+func streamRequest(endpoint string, body io.Reader) error {
+	req, err := http.NewRequest(http.MethodPost, endpoint, body)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-ndjson")
+	req.Header.Set("X-Source", "hl7-bridge")
+
+	transport, err := serverTransport()
+	if err != nil {
+		return err
+	}
+
+	// No client timeout: the request stays open for the life of the stream
+	client := &http.Client{Transport: transport}
+	resp, err := client.Do(req)
+	if err != nil {
+		return fmt.Errorf("stream request failed: %w", err)
+	}
+	defer resp.Body.Close()
+	io.Copy(io.Discard, resp.Body)
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("stream closed by server with status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,47 @@
+package hl7
+
+import "lightbaseEMRProxy/types"
+
+// nestResults returns payload with its results grouped under the order
+// (OBR) they were reported for, in the order each accession first appears.
+// Results with no accession of their own are grouped as sampleFallback says.
+func nestResults(payload types.HL7Message) types.HL7Message {
+	var orders []types.HL7Order
+	index := map[string]int{}
+	fallback := sampleFallback(payload)
+	for _, r := range payload.Results {
+		accession := r.AccessionNumber
+		if accession == "" {
+			accession = fallback
+		}
+		i, ok := index[accession]
+		if !ok {
+			order := types.HL7Order{AccessionNumber: accession}
+			if accession == payload.Order.AccessionNumber {
+				order = payload.Order
+			}
+			i = len(orders)
+			index[accession] = i
+			orders = append(orders, order)
+		}
+		orders[i].Results = append(orders[i].Results, r)
+	}
+
+	payload.Orders = orders
+	payload.Results = []types.HL7Result{}
+	return payload
+}
+
+// sampleFallback is the accession for results of payload that carry none.
+// When no result carries one, they all belong to payload.Order. Otherwise
+// a blank accession is a result reported outside any order (an ASTM P
+// record with no O after it), which must not be filed under the last
+// patient's order, so it stays blank.
+func sampleFallback(payload types.HL7Message) string {
+	for _, r := range payload.Results {
+		if r.AccessionNumber != "" {
+			return ""
+		}
+	}
+	return payload.Order.AccessionNumber
+}
@@ -0,0 +1,125 @@
+package hl7
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"log"
+	"net"
+	"strconv"
+	"strings"
+	"time"
+
+	"lightbaseEMRProxy/internal/config"
+	"lightbaseEMRProxy/types"
+)
+
+// lookupOrders fetches a sample's pending orders; replaceable so the
+// conformance suite can answer order queries without a server
+var lookupOrders = LookupOrders
+
+// BuildORM renders pending as an HL7 v2.3 ORM^O01 new-order message for
+// receiver: MSH and PID, then an ORC and OBR for every ordered test,
+// segments separated by CR
+func BuildORM(pending types.PendingOrders, receiver, controlID string) string {
+	esc := hl7Escaper.Replace
+	patient := pending.Patient
+	name := componentEscaper.Replace(patient.Name)
+	if patient.LastName != "" || patient.FirstName != "" {
+		name = strings.TrimRight(esc(patient.LastName)+"^"+esc(patient.FirstName)+"^"+esc(patient.MiddleName), "^")
+	}
+	var dob string
+	if t, ok := parseBirthDate(patient.BirthDate); ok {
+		dob = t.Format("20060102")
+	}
+
+	segments := []string{
+		"MSH|^~\\&|LIGHTBASE|" + esc(config.Get().LABSLUG) + "|" + esc(receiver) + "||" +
+			time.Now().Format("20060102150405") + "||ORM^O01|" + esc(controlID) + "|P|2.3",
+		"PID|1||" + esc(patient.ID) + "||" + name + "||" + dob + "|" + esc(patient.Sex),
+	}
+	n := 0
+	for _, order := range pending.Orders {
+		for _, test := range order.Tests {
+			n++
+			segments = append(segments,
+				"ORC|NW|"+esc(order.AccessionNumber),
+				"OBR|"+strconv.Itoa(n)+"|"+esc(order.AccessionNumber)+"||"+esc(test)+"|"+esc(order.Priority))
+		}
+	}
+	return strings.Join(segments, "\r") + "\r"
+}
+
+// queriedSample returns the sample ID or accession number an order query
+// asks for, from QRD-8 (who subject filter)
+func queriedSample(message string) string {
+	_, fieldSep, componentSep := mshFields(message)
+	message = strings.ReplaceAll(message, "\r\n", "\r")
+	for _, segment := range strings.Split(message, "\r") {
+		segment = strings.TrimSpace(segment)
+		if strings.HasPrefix(segment, "QRD") {
+			filter := getField(strings.Split(segment, fieldSep), 8)
+			return strings.TrimSpace(strings.Split(filter, componentSep)[0])
+		}
+	}
+	return ""
+}
+
+// answerOrderQuery acknowledges a QRY order query with QCK^Q02 and, when
+// the server has pending orders for the queried sample, sends them as
+// ORM^O01 and waits for the instrument's ACK. reader is the connection's
+// reader, so the ACK is taken from the same stream as the query.
+func answerOrderQuery(ctx context.Context, message string, conn net.Conn, reader *bufio.Reader) {
+	sampleID := queriedSample(message)
+	code := "AA"
+	var pending types.PendingOrders
+	found := false
+	if sampleID == "" {
+		log.Println("❌ [ORDERS] Order query without a QRD-8 sample ID")
+		code = "AE"
+	} else if orders, ok, err := lookupOrders(sampleID); err != nil {
+		log.Printf("❌ [ORDERS] Could not look up orders for %s: %v\n", sampleID, err)
+		code = "AE"
+	} else {
+		pending, found = orders, ok
+	}
+
+	writeReply(conn, generateResponse(message, code, "", "QCK^Q02"))
+	if !found {
+		log.Printf("🔎 [ORDERS] No pending orders for %q\n", sampleID)
+		return
+	}
+
+	sender, _ := ControlID(message)
+	if err := sendORM(ctx, conn, reader, BuildORM(pending, sender, "ORM"+time.Now().Format("20060102150405"))); err != nil {
+		log.Printf("❌ [ORDERS] Order download for %s failed: %v\n", sampleID, err)
+		return
+	}
+	log.Printf("📤 [ORDERS] %d pending order(s) for %s downloaded\n", len(pending.Orders), sampleID)
+}
+
+// sendORM writes an order message and waits up to
+// config.Get().HL7OrderACKTimeout for the instrument to accept it
+func sendORM(ctx context.Context, conn net.Conn, reader *bufio.Reader, message string) error {
+	conn.SetWriteDeadline(time.Now().Add(config.Get().ACKWriteTimeout))
+	if _, err := conn.Write(FrameMLLP(message)); err != nil {
+		return fmt.Errorf("send failed: %w", err)
+	}
+
+	conn.SetReadDeadline(time.Now().Add(config.Get().HL7OrderACKTimeout))
+	defer restoreIdleDeadline(ctx, conn)
+	reply, err := readMLLP(reader)
+	if err != nil {
+		return fmt.Errorf("no ACK received: %w", err)
+	}
+
+	_, controlID := ControlID(message)
+	code, ackedID := ackStatus(reply)
+	if ackedID != controlID {
+		return fmt.Errorf("ACK is for control ID %q, expected %q", ackedID, controlID)
+	}
+	if code != "AA" && code != "CA" {
+		return fmt.Errorf("instrument answered %s", code)
+	}
+	return nil
+}
@@ -1,28 +1,46 @@
 package hl7
 
 import (
-	"log"
+	"regexp"
 	"strings"
 	"time"
 
 	"lightbaseEMRProxy/internal/config"
+	"lightbaseEMRProxy/internal/normalize"
 	"lightbaseEMRProxy/types"
 )
 
-// ParseMessage parses an HL7 message and extracts lab results
-func ParseMessage(message string) []map[string]interface{} {
+// ParseMessage parses an HL7 message received over source, queues it for
+// forwarding and returns the extracted lab results
+func ParseMessage(message string, source types.Transport) []types.HL7Result {
+	payload := BuildPayload(message, source)
+	Enqueue(payload, ResultsEndpoint(config.Get().HL7Endpoint))
+	return payload.Results
+}
+
+// BuildPayload parses an HL7 message received over source into the
+// forwarding payload
+func BuildPayload(message string, source types.Transport) types.HL7Message {
 	message = strings.ReplaceAll(message, "\r\n", "\r")
-	segments := strings.Split(message, string(config.CR))
+	segments := strings.Split(message, string(rune(config.CR)))
 
-	results := []map[string]interface{}{}
-	var patientID, patientName, accessionNumber, messageControlID string
+	// Components and repetitions are split, and OBX text fields unescaped,
+	// with the delimiters the sender declared
+	msh, fieldSep, _ := mshFields(message)
+	delimiters := fieldSep + getField(msh, 1)
+	text := func(s string) string { return unescape(s, delimiters) }
+
+	var results []types.HL7Result
+	var patientID, patientName, birthDate, sex, accessionNumber, priority, messageControlID, sendingApp string
+	var patientIDs, patientComments, orderComments []string
+	parent := "" // segment an NTE comments on: the last PID, OBR or OBX
 
 	for _, segment := range segments {
 		segment = strings.TrimSpace(segment)
 		if segment == "" {
 			continue
 		}
-		fields := strings.Split(segment, "|")
+		fields := strings.Split(segment, fieldSep)
 		if len(fields) == 0 {
 			continue
 		}
@@ -30,23 +48,76 @@ func ParseMessage(message string) []map[string]interface{} {
 
 		switch segmentType {
 		case "MSH":
+			sendingApp = parseComponent(getField(fields, 2), 0, delimiters)
 			messageControlID = getField(fields, 9)
 		case "PID":
-			patientID = getField(fields, 3)
+			parent = segmentType
+			// PID-3 may repeat, listing the patient's identifiers in several domains
+			patientIDs = parseRepetitions(getField(fields, 3), delimiters)
+			for i := range patientIDs {
+				patientIDs[i] = strings.TrimSpace(patientIDs[i])
+			}
+			patientID = patientIDs[0]
+			if len(patientIDs) == 1 {
+				patientIDs = nil
+			}
+			// PID-5: family^given^middle^suffix^prefix
 			patientName = getField(fields, 5)
+			// PID-7: date/time of birth, a TS whose first component is the time
+			birthDate = parseComponent(getField(fields, 7), 0, delimiters)
+			sex = getField(fields, 8)
 		case "OBR":
+			parent = segmentType
 			accessionNumber = getField(fields, 2)
+			// OBR-5 priority, falling back to the priority component of OBR-27 quantity/timing
+			priority = getField(fields, 5)
+			if priority == "" {
+				priority = parseComponent(getField(fields, 27), 5, delimiters)
+			}
+		case "NTE":
+			// NTE-3 comment, one line per repetition
+			for _, line := range parseRepetitions(getField(fields, 3), delimiters) {
+				if line = text(line); line == "" {
+					continue
+				}
+				switch parent {
+				case "PID":
+					patientComments = append(patientComments, line)
+				case "OBR":
+					orderComments = append(orderComments, line)
+				case "OBX":
+					last := &results[len(results)-1]
+					last.Comments = append(last.Comments, line)
+				}
+			}
 		case "OBX":
-			result := map[string]interface{}{
-				"observation_id":  getField(fields, 1),
-				"test_code":       parseComponent(getField(fields, 3), 0),
-				"test_name":       parseComponent(getField(fields, 3), 1),
-				"value":           getField(fields, 5),
-				"units":           getField(fields, 6),
-				"reference_range": getField(fields, 7),
-				"abnormal_flags":  getField(fields, 8),
-				"result_status":   getField(fields, 11),
-				"timestamp":       parseDateTime(getField(fields, 14)),
+			parent = segmentType
+			timestamp, fallback := parseDateTime(getField(fields, 14))
+			result := types.HL7Result{
+				ObservationID:       getField(fields, 1),
+				SubID:               text(getField(fields, 4)),
+				AccessionNumber:     accessionNumber,
+				TestCode:            text(parseComponent(getField(fields, 3), 0, delimiters)),
+				TestName:            text(parseComponent(getField(fields, 3), 1, delimiters)),
+				Value:               text(getField(fields, 5)),
+				Units:               text(getField(fields, 6)),
+				ReferenceRange:      text(getField(fields, 7)),
+				AbnormalFlags:       text(getField(fields, 8)),
+				Status:              getField(fields, 11),
+				Timestamp:           timestamp,
+				ResponsibleObserver: text(parseName(getField(fields, 16), delimiters)), // ID^family^given^...
+			}
+			if value := getField(fields, 5); strings.ContainsAny(value, separator(delimiters, 1, "^")+separator(delimiters, 2, "~")) {
+				values := parseStructuredValue(value, delimiters)
+				for _, rep := range values {
+					for i := range rep {
+						rep[i] = text(rep[i])
+					}
+				}
+				result.Values = values
+			}
+			if fallback {
+				result.Warnings = []string{types.WarningTimestampFallback}
 			}
 			results = append(results, result)
 		}
@@ -55,40 +126,76 @@ func ParseMessage(message string) []map[string]interface{} {
 	// Build HL7Message (matches server's expected type exactly)
 	now := time.Now().Format(time.RFC3339)
 	payload := types.HL7Message{
-		Source:     config.LABSLUG,
+		Source:     config.Get().LABSLUG,
+		Protocol:   "hl7",
+		Instrument: sendingApp,
 		MessageID:  messageControlID,
 		ReceivedAt: now,
 		CreatedAt:  now,
 		Patient: types.HL7Patient{
-			ID:   patientID,
-			Name: patientName,
+			ID:         patientID,
+			IDs:        patientIDs,
+			Name:       patientName,
+			LastName:   parseComponent(patientName, 0, delimiters),
+			FirstName:  parseComponent(patientName, 1, delimiters),
+			MiddleName: parseComponent(patientName, 2, delimiters),
+			Sex:        sex,
+			Comments:   patientComments,
 		},
 		Order: types.HL7Order{
 			AccessionNumber: accessionNumber,
+			Priority:        priority,
+			Comments:        orderComments,
 		},
+		Results:   results,
+		Transport: source.Stamp(),
 	}
-
-	for _, r := range results {
-		payload.Results = append(payload.Results, types.HL7Result{
-			ObservationID:  r["observation_id"].(string),
-			TestCode:       r["test_code"].(string),
-			TestName:       r["test_name"].(string),
-			Value:          r["value"].(string),
-			Units:          r["units"].(string),
-			ReferenceRange: r["reference_range"].(string),
-			AbnormalFlags:  r["abnormal_flags"].(string),
-			Status:         r["result_status"].(string),
-			Timestamp:      r["timestamp"].(string),
-		})
+	if dob, ok := parseBirthDate(birthDate); ok {
+		payload.Patient.BirthDate = dob.Format("2006-01-02")
+		age := ageAt(dob, resultTime(results))
+		payload.Patient.AgeYears = &age
 	}
+	normalize.MapCodes(&payload)
+	normalize.CoerceQualitative(&payload)
+	normalize.TrimNumericPadding(&payload)
+	normalize.ParseNumericValues(&payload)
+	normalize.ApplyReferenceRanges(&payload)
 
-	go func() {
-		if err := SendToExternalSaver(payload, config.ExternalServerURL+"/hl7/receive"); err != nil {
-			log.Printf("HL7 forward failed [%s]: %v", messageControlID, err)
+	return payload
+}
+
+// mshFields splits the MSH segment of message on the field separator it
+// declares in MSH-1, returning the fields (MSH-2 at index 1) and the
+// separator and component characters, or nil if there is no MSH segment
+func mshFields(message string) (fields []string, fieldSep, componentSep string) {
+	message = strings.ReplaceAll(message, "\r\n", "\r")
+	for _, segment := range strings.Split(message, string(rune(config.CR))) {
+		segment = strings.TrimSpace(segment)
+		if !strings.HasPrefix(segment, "MSH") || len(segment) < 4 {
+			continue
+		}
+		fieldSep = segment[3:4]
+		fields = strings.Split(segment, fieldSep)
+		componentSep = "^"
+		if encoding := getField(fields, 1); encoding != "" {
+			componentSep = encoding[:1]
 		}
-	}()
+		return fields, fieldSep, componentSep
+	}
+	return nil, "|", "^"
+}
+
+// MessageType returns the message code and trigger event from MSH-9
+func MessageType(message string) (code, trigger string) {
+	fields, _, componentSep := mshFields(message)
+	msgType := strings.Split(getField(fields, 8), componentSep)
+	return getField(msgType, 0), getField(msgType, 1)
+}
 
-	return results
+// ControlID returns the sending application (MSH-3) and message control ID (MSH-10)
+func ControlID(message string) (sender, id string) {
+	fields, _, componentSep := mshFields(message)
+	return getField(strings.Split(getField(fields, 2), componentSep), 0), getField(fields, 9)
 }
 
 func getField(fields []string, index int) string {
@@ -98,33 +205,123 @@ func getField(fields []string, index int) string {
 	return strings.TrimSpace(fields[index])
 }
 
-func parseComponent(field string, componentIndex int) string {
-	components := strings.Split(field, "^")
+// separator returns delimiter i of delimiters, which is MSH-1 followed by
+// MSH-2 (e.g. "|^~\\&"), or def when the sender declared none
+func separator(delimiters string, i int, def string) string {
+	if i < len(delimiters) {
+		return delimiters[i : i+1]
+	}
+	return def
+}
+
+// parseComponent returns component componentIndex of field, split on the
+// component separator in delimiters
+func parseComponent(field string, componentIndex int, delimiters string) string {
+	components := strings.Split(field, separator(delimiters, 1, "^"))
 	if componentIndex >= len(components) {
 		return ""
 	}
 	return strings.TrimSpace(components[componentIndex])
 }
 
-func parseDateTime(hl7DateTime string) string {
+// parseRepetitions splits a field into its repetitions, on the repetition
+// separator in delimiters
+func parseRepetitions(field, delimiters string) []string {
+	return strings.Split(field, separator(delimiters, 2, "~"))
+}
+
+// parseComponents splits a single repetition into its components, on the
+// component separator in delimiters
+func parseComponents(repetition, delimiters string) []string {
+	components := strings.Split(repetition, separator(delimiters, 1, "^"))
+	for i := range components {
+		components[i] = strings.TrimSpace(components[i])
+	}
+	return components
+}
+
+// parseStructuredValue splits an OBX-5 value into repetitions, each a list
+// of components, e.g. "A^1~B^2" becomes [[A 1] [B 2]]
+func parseStructuredValue(field, delimiters string) [][]string {
+	var values [][]string
+	for _, rep := range parseRepetitions(field, delimiters) {
+		values = append(values, parseComponents(rep, delimiters))
+	}
+	return values
+}
+
+// parseName joins the non-empty components of a component-delimited
+// name field (e.g. "1234^SMITH^JOHN") into a single readable string.
+func parseName(field, delimiters string) string {
+	var parts []string
+	for _, c := range strings.Split(field, separator(delimiters, 1, "^")) {
+		if c = strings.TrimSpace(c); c != "" {
+			parts = append(parts, c)
+		}
+	}
+	return strings.Join(parts, " ")
+}
+
+// birthDateLayouts are the birthdate formats accepted, most specific first:
+// HL7 TS precisions, then the dates an LIS may send in order lookups
+var birthDateLayouts = []string{"20060102150405", "200601021504", "20060102", "2006-01-02", "02/01/2006", "02.01.2006"}
+
+// tsSuffix matches the fractional seconds and time zone a TS may carry
+var tsSuffix = regexp.MustCompile(`^(\d{8,14})(\.\d+)?([+-]\d{4})?$`)
+
+func parseBirthDate(value string) (time.Time, bool) {
+	value = strings.TrimSpace(value)
+	if m := tsSuffix.FindStringSubmatch(value); m != nil {
+		value = m[1]
+	}
+	for _, layout := range birthDateLayouts {
+		if t, err := time.Parse(layout, value); err == nil {
+			return t, true
+		}
+	}
+	return time.Time{}, false
+}
+
+// resultTime is the observation time of the first result, or now when there is none
+func resultTime(results []types.HL7Result) time.Time {
+	if len(results) > 0 {
+		if t, err := time.Parse(time.RFC3339, results[0].Timestamp); err == nil {
+			return t
+		}
+	}
+	return time.Now()
+}
+
+// ageAt returns the age in whole years of someone born on dob at time at
+func ageAt(dob, at time.Time) int {
+	age := at.Year() - dob.Year()
+	if at.Month() < dob.Month() || (at.Month() == dob.Month() && at.Day() < dob.Day()) {
+		age--
+	}
+	return age
+}
+
+// parseDateTime converts an HL7 timestamp to RFC 3339, falling back to the
+// current time (and reporting fallback) when it is missing or unparseable
+func parseDateTime(hl7DateTime string) (formatted string, fallback bool) {
 	hl7DateTime = strings.TrimSpace(hl7DateTime)
 	if len(hl7DateTime) < 8 {
-		return time.Now().Format(time.RFC3339)
+		return time.Now().Format(time.RFC3339), true
 	}
 
 	layout := "20060102150405"
 	if len(hl7DateTime) >= 14 {
 		t, err := time.Parse(layout, hl7DateTime[:14])
 		if err == nil {
-			return t.Format(time.RFC3339)
+			return t.Format(time.RFC3339), false
 		}
 	}
 
 	layout = "20060102"
 	t, err := time.Parse(layout, hl7DateTime[:8])
 	if err == nil {
-		return t.Format(time.RFC3339)
+		return t.Format(time.RFC3339), false
 	}
 
-	return time.Now().Format(time.RFC3339)
+	return time.Now().Format(time.RFC3339), true
 }
@@ -0,0 +1,75 @@
+package hl7
+
+import (
+	"fmt"
+	"strings"
+
+	"lightbaseEMRProxy/internal/config"
+)
+
+// ValidateSegments checks message against the required-segment profile for
+// its MSH-9 message code: every listed segment must be present, and their
+// first occurrences must appear in the listed order
+func ValidateSegments(message string) error {
+	code, _ := MessageType(message)
+	profile, ok := config.Get().HL7SegmentProfiles[strings.ToUpper(code)]
+	if !ok {
+		return nil
+	}
+
+	first := map[string]int{}
+	message = strings.ReplaceAll(message, "\r\n", "\r")
+	_, fieldSep, _ := mshFields(message)
+	for i, segment := range strings.Split(message, string(rune(config.CR))) {
+		segment = strings.TrimSpace(segment)
+		if segment == "" {
+			continue
+		}
+		name := strings.SplitN(segment, fieldSep, 2)[0]
+		if _, seen := first[name]; !seen {
+			first[name] = i
+		}
+	}
+
+	last, lastName := -1, ""
+	for _, name := range profile {
+		at, ok := first[name]
+		if !ok {
+			return fmt.Errorf("%s message missing required %s segment", code, name)
+		}
+		if at < last {
+			return fmt.Errorf("%s message has %s segment before %s", code, name, lastName)
+		}
+		last, lastName = at, name
+	}
+	return nil
+}
+
+// ValidateHeader checks that message starts with an MSH segment declaring
+// usable delimiters: an MSH-1 field separator and two to five distinct
+// MSH-2 encoding characters, none of them letters, digits or whitespace
+func ValidateHeader(message string) error {
+	message = strings.TrimLeft(message, " \t\r\n")
+	if !strings.HasPrefix(message, "MSH") {
+		return fmt.Errorf("message does not start with MSH")
+	}
+	if len(message) < 4 || !isDelimiter(message[3]) {
+		return fmt.Errorf("MSH-1 field separator missing or invalid")
+	}
+	fieldSep := message[3]
+	encoding, _, _ := strings.Cut(message[4:], string(fieldSep))
+	if len(encoding) < 2 || len(encoding) > 5 {
+		return fmt.Errorf("MSH-2 encoding characters %q must be 2 to 5 characters", encoding)
+	}
+	for i := 0; i < len(encoding); i++ {
+		if !isDelimiter(encoding[i]) || strings.IndexByte(encoding[i+1:], encoding[i]) >= 0 {
+			return fmt.Errorf("MSH-2 encoding characters %q are not distinct delimiters", encoding)
+		}
+	}
+	return nil
+}
+
+func isDelimiter(c byte) bool {
+	return c > ' ' && c < 0x7F &&
+		!(c >= '0' && c <= '9') && !(c >= 'A' && c <= 'Z') && !(c >= 'a' && c <= 'z')
+}
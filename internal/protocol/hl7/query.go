@@ -0,0 +1,163 @@
+package hl7
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"lightbaseEMRProxy/internal/config"
+	"lightbaseEMRProxy/types"
+)
+
+type cachedResults struct {
+	payload  types.HL7Message
+	storedAt time.Time
+}
+
+var (
+	resultCacheMu sync.Mutex
+	resultCache   = map[string]cachedResults{}
+)
+
+// cacheResults remembers a payload by sample ID as it is queued for
+// forwarding, so analyzer queries can be answered while the server is slow
+// or offline
+func cacheResults(payload types.HL7Message) {
+	if config.Get().QueryCacheTTL <= 0 || payload.Order.AccessionNumber == "" {
+		return
+	}
+	resultCacheMu.Lock()
+	defer resultCacheMu.Unlock()
+
+	now := time.Now()
+	for id, entry := range resultCache {
+		if now.Sub(entry.storedAt) > config.Get().QueryCacheTTL {
+			delete(resultCache, id)
+		}
+	}
+	resultCache[payload.Order.AccessionNumber] = cachedResults{payload: payload, storedAt: now}
+}
+
+// cachedQuery returns the cached results for sampleID if they are within the TTL
+func cachedQuery(sampleID string) (types.HL7Message, bool) {
+	resultCacheMu.Lock()
+	defer resultCacheMu.Unlock()
+	entry, ok := resultCache[sampleID]
+	if !ok || time.Since(entry.storedAt) > config.Get().QueryCacheTTL {
+		return types.HL7Message{}, false
+	}
+	return entry.payload, true
+}
+
+// LookupResults finds prior results for sampleID, from the cache when
+// fresh and otherwise from the external server
+func LookupResults(sampleID string) (types.HL7Message, bool, error) {
+	if payload, ok := cachedQuery(sampleID); ok {
+		log.Printf("🗃️  [QUERY] Results for %s served from cache\n", sampleID)
+		return payload, true, nil
+	}
+
+	transport, err := serverTransport()
+	if err != nil {
+		return types.HL7Message{}, false, err
+	}
+	client := &http.Client{Timeout: config.Get().QueryTimeout, Transport: transport}
+	resp, err := client.Get(config.Get().ExternalServerURL + config.Get().QueryEndpoint + "?sample_id=" + url.QueryEscape(sampleID))
+	if err != nil {
+		return types.HL7Message{}, false, fmt.Errorf("results query failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return types.HL7Message{}, false, nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return types.HL7Message{}, false, fmt.Errorf("results query returned status %d", resp.StatusCode)
+	}
+
+	var payload types.HL7Message
+	if err := json.NewDecoder(resp.Body).Decode(&payload); err != nil {
+		return types.HL7Message{}, false, fmt.Errorf("failed to decode results: %w", err)
+	}
+	log.Printf("🌐 [QUERY] Results for %s fetched from server\n", sampleID)
+	return payload, true, nil
+}
+
+// LookupOrders fetches the pending orders for sampleID from the external
+// server; ok is false when the server has none
+func LookupOrders(sampleID string) (types.PendingOrders, bool, error) {
+	transport, err := serverTransport()
+	if err != nil {
+		return types.PendingOrders{}, false, err
+	}
+	client := &http.Client{Timeout: config.Get().QueryTimeout, Transport: transport}
+	resp, err := client.Get(config.Get().ExternalServerURL + config.Get().OrdersEndpoint + "?sample_id=" + url.QueryEscape(sampleID))
+	if err != nil {
+		return types.PendingOrders{}, false, fmt.Errorf("orders query failed: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return types.PendingOrders{}, false, nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return types.PendingOrders{}, false, fmt.Errorf("orders query returned status %d", resp.StatusCode)
+	}
+
+	var orders types.PendingOrders
+	if err := json.NewDecoder(resp.Body).Decode(&orders); err != nil {
+		return types.PendingOrders{}, false, fmt.Errorf("failed to decode orders: %w", err)
+	}
+	log.Printf("🌐 [QUERY] %d pending order(s) for %s fetched from server\n", len(orders.Orders), sampleID)
+	return orders, len(orders.Orders) > 0, nil
+}
+
+// AnswerQuery builds the RSP^K11 reply to a QBP query for a sample's
+// results. QPD-3 carries the sample ID; QAK-2 is OK, NF (no data found)
+// or AE when the lookup failed.
+func AnswerQuery(message string) string {
+	var qpd []string
+	message = strings.ReplaceAll(message, "\r\n", "\r")
+	msh, fieldSep, _ := mshFields(message)
+	for _, segment := range strings.Split(message, string(rune(config.CR))) {
+		segment = strings.TrimSpace(segment)
+		if strings.HasPrefix(segment, "QPD") {
+			qpd = strings.Split(segment, fieldSep)
+			break
+		}
+	}
+	queryTag := getField(qpd, 2)
+	sampleID := parseComponent(getField(qpd, 3), 0, fieldSep+getField(msh, 1))
+
+	code, status := "AA", "OK"
+	var payload types.HL7Message
+	if sampleID == "" {
+		code, status = "AE", "AE"
+	} else if found, ok, err := LookupResults(sampleID); err != nil {
+		log.Printf("❌ [QUERY] Could not look up %s: %v\n", sampleID, err)
+		code, status = "AE", "AE"
+	} else if !ok {
+		status = "NF"
+	} else {
+		payload = found
+	}
+
+	header := generateResponse(message, code, "", "RSP^K11")
+	if header == "" {
+		return ""
+	}
+	segments := []string{header, "QAK|" + queryTag + "|" + status}
+	if qpd != nil {
+		segments = append(segments, strings.Join(qpd, "|"))
+	}
+	if status == "OK" {
+		segments = append(segments, resultSegments(payload)...)
+	}
+	log.Printf("🔎 [QUERY] Answered query for %q: %s (%d results)\n", sampleID, status, len(payload.Results))
+	return strings.Join(segments, "\r")
+}
@@ -0,0 +1,532 @@
+package hl7
+
+import (
+	"container/heap"
+	"errors"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"lightbaseEMRProxy/internal/config"
+	"lightbaseEMRProxy/internal/events"
+	"lightbaseEMRProxy/internal/metrics"
+	"lightbaseEMRProxy/internal/normalize"
+	"lightbaseEMRProxy/types"
+)
+
+// Forwarding priorities, highest first
+const (
+	priorityRoutine = iota
+	priorityUrgent
+)
+
+type forwardJob struct {
+	payload  types.HL7Message
+	endpoint string
+	priority int
+	seq      uint64
+	journal  string // queue directory copy, removed once the job is finished
+}
+
+// jobQueue orders jobs by priority (when enabled) and then by arrival
+type jobQueue []*forwardJob
+
+func (q jobQueue) Len() int { return len(q) }
+
+func (q jobQueue) Less(i, j int) bool {
+	if config.Get().ForwardPriority && q[i].priority != q[j].priority {
+		return q[i].priority > q[j].priority
+	}
+	return q[i].seq < q[j].seq
+}
+
+func (q jobQueue) Swap(i, j int) { q[i], q[j] = q[j], q[i] }
+
+func (q *jobQueue) Push(x any) { *q = append(*q, x.(*forwardJob)) }
+
+func (q *jobQueue) Pop() any {
+	old := *q
+	n := len(old)
+	job := old[n-1]
+	old[n-1] = nil
+	*q = old[:n-1]
+	return job
+}
+
+var (
+	queueMu   sync.Mutex
+	queueCond = sync.NewCond(&queueMu)
+	queue     jobQueue
+	queueSeq  uint64
+	busy      int                 // workers delivering jobs they have popped
+	inFlight  = map[string]bool{} // samples with a job being delivered, so their later jobs wait
+	flushing  bool                // shutdown is waiting on the queue, so batches are not held back
+)
+
+// queueOverflows counts jobs spooled because the queue was full
+var queueOverflows = metrics.NewCounter("forward_queue_overflows_total", "Payloads spooled instead of queued because forward_queue_limit was reached")
+
+// errQueueFull is recorded as the cause of a job spooled on overflow
+var errQueueFull = errors.New("forward queue full")
+
+// ResultsEndpoint returns the URL for results normally posted to path,
+// or the unified endpoint when ASTM and HL7 results are merged
+func ResultsEndpoint(path string) string {
+	if config.Get().MergeResults {
+		return config.Get().ExternalServerURL + config.Get().UnifiedEndpoint
+	}
+	return config.Get().ExternalServerURL + path
+}
+
+// Enqueue queues a parsed payload for delivery to endpoint
+func Enqueue(payload types.HL7Message, endpoint string) {
+	for _, job := range prepare(payload, endpoint) {
+		push(job)
+	}
+}
+
+// ForwardWithin delivers payload immediately instead of queueing it, for
+// ACK-after-forward mode, and returns the delivery error. If delivery has
+// not finished within deadline it carries on in the background, falling
+// back to the queue if it fails, and ForwardWithin returns nil so the
+// instrument can still be ACKed inside its own timeout.
+func ForwardWithin(payload types.HL7Message, endpoint string, deadline time.Duration) error {
+	jobs := prepare(payload, endpoint)
+
+	var mu sync.Mutex
+	deferred := false
+	done := make(chan error, 1)
+
+	go func() {
+		var failed []*forwardJob
+		var firstErr error
+		for _, job := range jobs {
+			if err := deliver(job); err != nil {
+				failed = append(failed, job)
+				if firstErr == nil {
+					firstErr = err
+				}
+			}
+		}
+
+		mu.Lock()
+		defer mu.Unlock()
+		if !deferred {
+			// The instrument is told to retransmit, so let its results through again
+			for _, job := range failed {
+				forgetResults(job.payload)
+			}
+			done <- firstErr
+			return
+		}
+		if firstErr != nil {
+			log.Printf("❌ [FWD] Deferred forward failed [%s]: %v — queueing for retry\n", payload.MessageID, firstErr)
+			for _, job := range failed {
+				push(job)
+			}
+		} else {
+			log.Printf("✅ [FWD] Deferred forward completed [%s]\n", payload.MessageID)
+		}
+	}()
+
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(deadline):
+		mu.Lock()
+		defer mu.Unlock()
+		select {
+		case err := <-done:
+			return err
+		default:
+			deferred = true
+			log.Printf("⏳ [FWD] Forward of [%s] exceeded %s — ACKing and finishing in background\n", payload.MessageID, deadline)
+			return nil
+		}
+	}
+}
+
+// prepare applies the pre-forwarding transforms and routing to payload and
+// returns the deliveries to make
+func prepare(payload types.HL7Message, endpoint string) []*forwardJob {
+	if config.Get().EmbedSchemaVersion {
+		payload.SchemaVersion = types.SchemaVersion
+	}
+	checkResultCount(payload)
+	normalize.ApplyTransforms(&payload)
+	normalize.Sanitize(&payload)
+	normalize.Enrich(&payload)
+
+	if len(payload.Results) > 0 {
+		if payload = dropDuplicates(payload); len(payload.Results) == 0 {
+			log.Printf("♻️  [FWD] Every result of [%s] was already forwarded — nothing to send\n", payload.MessageID)
+			return nil
+		}
+	}
+
+	if config.Get().FileDropDir != "" {
+		if err := DropFile(payload); err != nil {
+			log.Printf("❌ [DROP] Could not write HL7 file [%s]: %v\n", payload.MessageID, err)
+		}
+	}
+
+	// Cached whole, before the payload is split into several deliveries
+	cacheResults(payload)
+	endpoint = routeEndpoint(payload, endpoint)
+
+	var jobs []*forwardJob
+	if normalize.FlagImplausible(&payload) && config.Get().RouteSuspectToReview {
+		clean, suspect := normalize.SplitSuspect(payload)
+		jobs = append(jobs, limitSize(newJob(suspect, config.Get().ExternalServerURL+config.Get().ReviewEndpoint))...)
+		if len(clean.Results) == 0 {
+			return jobs
+		}
+		payload = clean
+	}
+	jobs = append(jobs, limitSize(newJob(payload, endpoint))...)
+	for _, extra := range config.Get().FanOutEndpoints {
+		jobs = append(jobs, limitSize(newJob(payload, endpointURL(extra)))...)
+	}
+	return jobs
+}
+
+// routeEndpoint returns the endpoint config.Get().InstrumentRoutes gives
+// the sender of payload, or endpoint when the sender has no route. Like
+// every sender-keyed table, the sender must match exactly.
+func routeEndpoint(payload types.HL7Message, endpoint string) string {
+	if route, ok := config.Get().InstrumentRoutes[payload.Instrument]; ok && payload.Instrument != "" {
+		return endpointURL(route)
+	}
+	return endpoint
+}
+
+func newJob(payload types.HL7Message, endpoint string) *forwardJob {
+	return &forwardJob{
+		payload:  payload,
+		endpoint: endpoint,
+		priority: payloadPriority(payload),
+	}
+}
+
+// push queues job, or spools it for the retry loop when the queue already
+// holds config.Get().ForwardQueueLimit jobs, so a stalled server cannot
+// grow the queue without bound or hold up the instrument links
+func push(job *forwardJob) {
+	queueMu.Lock()
+	if limit := config.Get().ForwardQueueLimit; limit > 0 && queue.Len() >= limit {
+		queueMu.Unlock()
+		queueOverflows.Inc()
+		log.Printf("⚠️  [FWD] Queue full (%d) — [%s] spooled for retry\n", limit, job.payload.MessageID)
+		Spool(job.payload, job.endpoint, errQueueFull)
+		unjournal(job)
+		return
+	}
+	queueSeq++
+	job.seq = queueSeq
+	journal(job)
+	heap.Push(&queue, job)
+	depth := queue.Len()
+	queueMu.Unlock()
+	queueCond.Broadcast()
+
+	if depth > 1 {
+		log.Printf("📥 [FWD] Queued [%s] (queue depth %d)\n", job.payload.MessageID, depth)
+	}
+}
+
+// sample is the accession number a job carries results for; a sample's
+// jobs are delivered one at a time, in queue order. Jobs without one are
+// not held back.
+func (j *forwardJob) sample() string {
+	return j.payload.Order.AccessionNumber
+}
+
+// nextJob pops the first job in queue order whose sample no worker is
+// delivering and claims its sample, or returns nil when there is none.
+// It is called with queueMu held.
+func nextJob() *forwardJob {
+	var held []*forwardJob
+	defer func() {
+		for _, job := range held {
+			heap.Push(&queue, job)
+		}
+	}()
+	for queue.Len() > 0 {
+		job := heap.Pop(&queue).(*forwardJob)
+		if sample := job.sample(); sample != "" {
+			if inFlight[sample] {
+				held = append(held, job)
+				continue
+			}
+			inFlight[sample] = true
+		}
+		return job
+	}
+	return nil
+}
+
+// release ends a worker's delivery of batch, letting the queued jobs of
+// its samples be taken
+func release(batch []*forwardJob) {
+	queueMu.Lock()
+	for _, job := range batch {
+		delete(inFlight, job.sample())
+	}
+	busy--
+	queueMu.Unlock()
+	queueCond.Broadcast()
+}
+
+// StartForwarder delivers queued payloads to the external server with
+// config.Get().ForwardWorkers workers (blocks)
+func StartForwarder() {
+	for i := 1; i < config.Get().ForwardWorkers; i++ {
+		go forwardWorker()
+	}
+	forwardWorker()
+}
+
+// forwardWorker takes jobs, or batches of them, off the queue and
+// delivers them
+func forwardWorker() {
+	for {
+		forwardNext()
+	}
+}
+
+// forwardNext waits for a job it may deliver, collects a batch around it
+// when batching, and delivers it
+func forwardNext() {
+	queueMu.Lock()
+	job := nextJob()
+	for job == nil {
+		queueCond.Wait()
+		job = nextJob()
+	}
+	batch := []*forwardJob{job}
+	busy++
+	if config.Get().ForwardBatchSize > 1 {
+		batch = fillBatch(batch)
+	}
+	queueMu.Unlock()
+
+	var live []*forwardJob
+	for _, job := range batch {
+		if age, expired := payloadAge(job.payload); expired {
+			DeadLetter(job.payload, job.endpoint, fmt.Sprintf("expired: received %s ago, limit %s", age.Round(time.Second), config.Get().ForwardMaxAge))
+			unjournal(job)
+			continue
+		}
+		live = append(live, job)
+	}
+
+	if len(live) == 1 {
+		finish(live[0], deliver(live[0]))
+	} else if len(live) > 1 {
+		deliverBatch(live)
+	}
+
+	release(batch)
+}
+
+// finish settles a delivered job: a failure is spooled for retry, or
+// dead-lettered when the payload cannot be encoded
+func finish(job *forwardJob, err error) {
+	if err != nil {
+		log.Printf("❌ [FWD] Forward failed [%s]: %v\n", job.payload.MessageID, err)
+		var merr *marshalError
+		if errors.As(err, &merr) {
+			DeadLetter(job.payload, job.endpoint, "unencodable: "+err.Error())
+		} else {
+			Spool(job.payload, job.endpoint, err)
+		}
+	} else {
+		log.Printf("✅ [FWD] Data forwarded successfully [%s]\n", job.payload.MessageID)
+	}
+	unjournal(job)
+}
+
+// fillBatch adds queued jobs for the same endpoint to batch until it holds
+// config.Get().ForwardBatchSize jobs, config.Get().ForwardBatchWindow has
+// passed, the next job is for another endpoint or a flush is requested.
+// It is called with queueMu held.
+func fillBatch(batch []*forwardJob) []*forwardJob {
+	window := config.Get().ForwardBatchWindow
+	deadline := time.Now().Add(window)
+	timer := time.AfterFunc(window, func() {
+		queueMu.Lock()
+		queueCond.Broadcast()
+		queueMu.Unlock()
+	})
+	defer timer.Stop()
+
+	for len(batch) < config.Get().ForwardBatchSize && !flushing && time.Now().Before(deadline) {
+		job := nextJob()
+		if job == nil {
+			queueCond.Wait()
+			continue
+		}
+		if job.endpoint != batch[0].endpoint {
+			heap.Push(&queue, job)
+			delete(inFlight, job.sample())
+			break
+		}
+		batch = append(batch, job)
+	}
+	return batch
+}
+
+// FlushQueue waits up to timeout for the forwarder to empty the queue,
+// reporting how many deliveries are still queued. A batch being collected
+// is sent at once. Deliveries still queued stay in config.Get().QueueDir
+// and are sent after the next start.
+func FlushQueue(timeout time.Duration) int {
+	queueMu.Lock()
+	flushing = true
+	queueCond.Broadcast()
+	queueMu.Unlock()
+	defer func() {
+		queueMu.Lock()
+		flushing = false
+		queueMu.Unlock()
+	}()
+
+	deadline := time.Now().Add(timeout)
+	for {
+		queueMu.Lock()
+		left := queue.Len() + busy
+		queueMu.Unlock()
+
+		if left == 0 || time.Now().After(deadline) {
+			return left
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+// payloadAge reports how long ago payload was received and whether that
+// exceeds config.Get().ForwardMaxAge
+func payloadAge(payload types.HL7Message) (time.Duration, bool) {
+	if config.Get().ForwardMaxAge <= 0 {
+		return 0, false
+	}
+	received, err := time.Parse(time.RFC3339, payload.ReceivedAt)
+	if err != nil {
+		return 0, false
+	}
+	age := time.Since(received)
+	return age, age > config.Get().ForwardMaxAge
+}
+
+var (
+	resultsForwarded = metrics.NewCounter("results_forwarded_total", "Results delivered to an endpoint")
+	forwardErrors    = metrics.NewCounter("forward_errors_total", "Deliveries that failed after all retries")
+)
+
+// deliver sends job in the configured forward mode, retrying transient
+// failures, and publishes the outcome
+func deliver(job *forwardJob) error {
+	if config.Get().DryRun {
+		return logDryRun(job)
+	}
+
+	err := withRetry(job.payload.MessageID, func() error {
+		switch config.Get().ForwardMode {
+		case "ndjson":
+			return SendNDJSON(job.payload, job.endpoint)
+		case "form":
+			return sendFormRemaining(job)
+		default:
+			return SendToExternalSaver(job.payload, job.endpoint)
+		}
+	})
+
+	publishOutcome(job, err)
+	return err
+}
+
+// publishOutcome publishes the forwarded or failed event for job and
+// counts it
+func publishOutcome(job *forwardJob, err error) {
+	e := events.Event{Type: events.Forwarded, Protocol: job.payload.Protocol, MessageID: job.payload.MessageID, Detail: job.endpoint}
+	if job.payload.Transport != nil {
+		e.Source = job.payload.Transport.Address
+	}
+	if err != nil {
+		e.Type, e.Detail = events.Failed, err.Error()
+		forwardErrors.Inc()
+	} else {
+		resultsForwarded.Add(uint64(len(job.payload.Results)))
+	}
+	events.Publish(e)
+}
+
+// deliverBatch sends jobs, all for one endpoint, as a single JSON array,
+// retrying transient failures, and settles each job with the outcome
+func deliverBatch(jobs []*forwardJob) {
+	var bodies [][]byte
+	var encoded []*forwardJob
+	for _, job := range jobs {
+		body, err := marshalPayload(job.payload)
+		if err != nil {
+			finish(job, err)
+			continue
+		}
+		bodies = append(bodies, body)
+		encoded = append(encoded, job)
+	}
+	if len(encoded) == 0 {
+		return
+	}
+
+	if config.Get().DryRun {
+		for _, job := range encoded {
+			finish(job, logDryRun(job))
+		}
+		return
+	}
+
+	label := fmt.Sprintf("batch of %d from %s", len(encoded), encoded[0].payload.MessageID)
+	err := withRetry(label, func() error { return SendBatch(bodies, encoded[0].endpoint) })
+	if err == nil {
+		log.Printf("📦 [FWD] Sent %s\n", label)
+	}
+	for _, job := range encoded {
+		publishOutcome(job, err)
+		finish(job, err)
+	}
+}
+
+// payloadPriority ranks a payload as urgent when its order is STAT/ASAP
+// or any of its results carries a critical abnormal flag
+func payloadPriority(payload types.HL7Message) int {
+	if isUrgentPriority(payload.Order.Priority) {
+		return priorityUrgent
+	}
+	for _, r := range payload.Results {
+		if isCriticalFlag(r.AbnormalFlags) {
+			return priorityUrgent
+		}
+	}
+	return priorityRoutine
+}
+
+func isUrgentPriority(priority string) bool {
+	switch strings.ToUpper(strings.TrimSpace(priority)) {
+	case "S", "STAT", "A", "ASAP", "C", "CRITICAL":
+		return true
+	}
+	return false
+}
+
+func isCriticalFlag(flags string) bool {
+	for _, flag := range strings.Split(strings.ToUpper(flags), "~") {
+		switch strings.TrimSpace(flag) {
+		case "HH", "LL", "AA", "C":
+			return true
+		}
+	}
+	return false
+}
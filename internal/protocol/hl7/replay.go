@@ -0,0 +1,30 @@
+package hl7
+
+import (
+	"bufio"
+	"context"
+	"net"
+
+	"lightbaseEMRProxy/types"
+)
+
+// Replay runs bytes an LIS sent over source through the same MLLP framing
+// as a live connection and passes each message's parsed payload to emit
+// instead of ACKing and forwarding it
+func Replay(rx []byte, source string, emit func(types.HL7Message)) {
+	saved := handleMessage
+	defer func() { handleMessage = saved }()
+	handleMessage = func(_ context.Context, message string, conn net.Conn, reader *bufio.Reader, link types.Transport, warnings []string) {
+		link.Kind, link.Address = "replay", source
+		payload := BuildPayload(message, link)
+		payload.Warn(warnings...)
+		emit(payload)
+	}
+
+	client, server := net.Pipe()
+	go func() {
+		client.Write(rx)
+		client.Close()
+	}()
+	HandleConnection(context.Background(), server)
+}
@@ -0,0 +1,60 @@
+package hl7
+
+import (
+	"errors"
+	"fmt"
+	"log"
+	"math/rand"
+	"time"
+
+	"lightbaseEMRProxy/internal/config"
+)
+
+// statusError is a non-2xx answer from the external server
+type statusError struct {
+	code   int
+	detail string
+}
+
+func (e *statusError) Error() string {
+	return fmt.Sprintf("API returned status %d%s", e.code, e.detail)
+}
+
+// retryable reports whether a failed delivery may succeed if sent again:
+// network errors and 5xx answers are retried, while 4xx answers and
+// payloads that cannot be encoded are not
+func retryable(err error) bool {
+	var serr *statusError
+	if errors.As(err, &serr) {
+		return serr.code >= 500
+	}
+	var merr *marshalError
+	return !errors.As(err, &merr)
+}
+
+// withRetry calls send until it succeeds, fails with an error that is not
+// retryable, or has been tried config.Get().ForwardRetryAttempts times,
+// backing off exponentially with jitter between attempts
+func withRetry(messageID string, send func() error) error {
+	backoff := config.Get().ForwardRetryBackoff
+	for attempt := 1; ; attempt++ {
+		err := send()
+		if err == nil || !retryable(err) || attempt >= config.Get().ForwardRetryAttempts {
+			return err
+		}
+
+		// Up to 50% jitter keeps instruments recovering together from
+		// retrying in lockstep
+		wait := backoff
+		if backoff > 0 {
+			wait += time.Duration(rand.Int63n(int64(backoff)/2 + 1))
+		}
+		log.Printf("🔁 [FWD] Attempt %d for [%s] failed: %v — retrying in %s\n", attempt, messageID, err, wait.Round(time.Millisecond))
+		time.Sleep(wait)
+
+		backoff *= 2
+		if backoff > config.Get().ForwardRetryMaxBackoff {
+			backoff = config.Get().ForwardRetryMaxBackoff
+		}
+	}
+}
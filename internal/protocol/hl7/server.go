@@ -3,40 +3,85 @@ package hl7
 import (
 	"bufio"
 	"bytes"
+	"context"
 	"encoding/hex"
 	"fmt"
 	"log"
+	"log/slog"
 	"net"
+	"slices"
 	"strings"
 	"time"
 
+	"lightbaseEMRProxy/internal/capture"
 	"lightbaseEMRProxy/internal/config"
+	"lightbaseEMRProxy/internal/dedup"
+	"lightbaseEMRProxy/internal/events"
 	"lightbaseEMRProxy/internal/logger"
+	"lightbaseEMRProxy/internal/metrics"
+	"lightbaseEMRProxy/internal/session"
+	"lightbaseEMRProxy/types"
 )
 
-// StartServer starts the HL7 TCP server
-func StartServer(address string) {
+// sessions remembers recently received messages for duplicate-session suppression
+var sessions = dedup.New(func() time.Duration { return config.Get().SessionDedupWindow })
+
+// controlIDs remembers recently seen sender/MSH-10 pairs. Byte-identical
+// retransmits are caught by sessions first, so a hit here is a different
+// message reusing a control ID.
+var controlIDs = dedup.New(func() time.Duration { return config.Get().ControlIDDedupWindow })
+
+// hl7Messages counts MLLP-framed messages taken off LIS connections
+var hl7Messages = metrics.NewCounter("hl7_messages_total", "HL7 messages received from LIS connections")
+
+// duplicateControlIDs counts messages suppressed for a reused MSH-10
+var duplicateControlIDs = metrics.NewCounter("hl7_duplicate_control_ids_total", "HL7 messages suppressed for reusing an MSH-10 control ID")
+
+// active counts open LIS connections, so shutdown can wait for messages
+// in progress to finish
+var active session.Group
+
+// WaitSessions waits up to timeout for every open LIS connection to
+// finish its message and close, reporting whether they all did
+func WaitSessions(timeout time.Duration) bool {
+	return active.Wait(timeout)
+}
+
+// StartServer starts the HL7 TCP server and returns once ctx is canceled
+func StartServer(ctx context.Context, address string) {
 	ln, err := net.Listen("tcp", address)
 	if err != nil {
 		log.Fatal("❌ Failed to start server:", err)
 	}
 	defer ln.Close()
+	context.AfterFunc(ctx, func() { ln.Close() })
 
 	log.Println("✅ HL7 Server is listening... Waiting for LIS to connect.")
 
 	for {
 		conn, err := ln.Accept()
 		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
 			log.Println("❌ Accept error:", err)
 			continue
 		}
 		log.Printf("🔌 LIS Connected: %s -> %s\n", conn.RemoteAddr(), conn.LocalAddr())
-		go handleConnection(conn)
+		go HandleConnection(ctx, conn)
 	}
 }
 
-func handleConnection(conn net.Conn) {
+// HandleConnection reads MLLP-framed messages from an LIS connection until
+// it closes, or until ctx is canceled and no message is in progress
+func HandleConnection(ctx context.Context, conn net.Conn) {
+	active.Add()
+	defer active.Done()
 	defer conn.Close()
+	if recorder := capture.New("hl7", conn.RemoteAddr().String()); recorder != nil {
+		conn = &captureConn{Conn: conn, recorder: recorder}
+		defer recorder.Flush()
+	}
 	reader := bufio.NewReader(conn)
 	var messageBuffer bytes.Buffer
 	var pingBuffer bytes.Buffer
@@ -44,12 +89,26 @@ func handleConnection(conn net.Conn) {
 	byteCount := 0
 	messagesReceived := 0
 	lastActivity := time.Now()
+	source := types.Transport{Kind: "tcp", Address: conn.RemoteAddr().String(), ConnectedAt: time.Now()}
+
+	var timeline *logger.Timeline
+	if config.Get().ControlTimeline {
+		timeline = logger.NewTimeline("HL7")
+	}
+	defer timeline.Flush()
 
 	conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+	// Wake the reader on shutdown; a message in progress is still finished
+	stop := context.AfterFunc(ctx, func() { conn.SetReadDeadline(time.Now()) })
+	defer stop()
 
 	log.Println("\n📊 Connection established, listening for HL7 data...")
 
 	for {
+		if ctx.Err() != nil && !inMessage && reader.Buffered() == 0 {
+			log.Println("🛑 Closing LIS connection for shutdown")
+			return
+		}
 		b, err := reader.ReadByte()
 		if err != nil {
 			if netErr, ok := err.(net.Error); ok && netErr.Timeout() {
@@ -60,8 +119,10 @@ func handleConnection(conn net.Conn) {
 				continue
 			}
 			if messagesReceived == 0 {
-				if pingBuffer.Len() > 0 {
+				if pingBuffer.Len() > 0 && logger.RawAllowed() {
 					log.Printf("\n🏓 [PING] LIS sent raw bytes (no HL7 framing): %q\n", pingBuffer.String())
+				} else if pingBuffer.Len() > 0 {
+					log.Printf("\n🏓 [PING] LIS sent %d raw bytes (no HL7 framing)\n", pingBuffer.Len())
 				} else {
 					log.Println("\n🏓 [PING] LIS connected and disconnected without sending HL7 data")
 				}
@@ -73,8 +134,14 @@ func handleConnection(conn net.Conn) {
 		lastActivity = time.Now()
 		byteCount++
 
-		if config.DebugMode && byteCount <= 100 {
-			log.Printf("Byte %d: 0x%02X (%s)\n", byteCount, b, byteDescription(b))
+		// Printable bytes are message content, so they are not traced while redacting
+		if byteCount <= 100 && (!config.Get().RedactPHI || b < 32) {
+			slog.Debug("byte received", "protocol", "hl7", "index", byteCount, "byte", fmt.Sprintf("0x%02X", b), "desc", byteDescription(b))
+		}
+
+		switch b {
+		case config.VT, config.FS, config.CR, config.LF:
+			timeline.Add(byteDescription(b))
 		}
 
 		switch b {
@@ -83,68 +150,237 @@ func handleConnection(conn net.Conn) {
 			messageBuffer.Reset()
 			pingBuffer.Reset()
 			log.Println("\n➡️ [HL7] Message Start (VT received)")
+			publish(events.SessionStart, source, "")
 
 		case config.FS:
 			if inMessage {
 				inMessage = false
 				messagesReceived++
 				log.Println("⬅️ [HL7] Message End (FS received)")
-				processMessage(messageBuffer.String(), conn)
+				events.Publish(events.Event{Type: events.FrameReceived, Protocol: "hl7", Source: source.Address,
+					Detail: fmt.Sprintf("%d bytes", messageBuffer.Len()), Bytes: messageBuffer.Len()})
+				handleMessage(ctx, messageBuffer.String(), conn, reader, source, nil)
+				publish(events.SessionEnd, source, "")
+				timeline.Flush()
 				messageBuffer.Reset()
 				byteCount = 0
+			} else if recoverStrayFS(ctx, pingBuffer.String(), conn, reader, source) {
+				messagesReceived++
+				timeline.Flush()
+				byteCount = 0
 			}
+			pingBuffer.Reset()
 
 		case config.CR:
+			// Outside a message this is the optional CR of an FS+CR trailer;
+			// senders that end on FS alone are handled the same way
 			if inMessage {
 				messageBuffer.WriteByte(b)
+			} else if pingBuffer.Len() > 0 {
+				pingBuffer.WriteByte(b)
 			}
 
 		case config.LF:
-			if inMessage && config.DebugMode && byteCount <= 100 {
-				log.Println("   [LF received, ignoring]")
+			if inMessage && byteCount <= 100 {
+				slog.Debug("LF ignored", "protocol", "hl7")
 			}
 
 		default:
 			if inMessage {
 				messageBuffer.WriteByte(b)
-			} else {
+			} else if !isKeepalive(b) {
 				pingBuffer.WriteByte(b)
 			}
 		}
 	}
 }
 
-func processMessage(message string, conn net.Conn) {
+// acceptedType reports whether MSH-9 message code and trigger event are
+// configured for processing
+func acceptedType(code, trigger string) bool {
+	for _, t := range config.Get().HL7AcceptedMessageTypes {
+		acceptedCode, acceptedTrigger, hasTrigger := strings.Cut(t, "^")
+		if strings.EqualFold(acceptedCode, code) && (!hasTrigger || strings.EqualFold(acceptedTrigger, trigger)) {
+			return true
+		}
+	}
+	return false
+}
+
+// validateProfile applies segment-profile validation when it is enabled
+func validateProfile(message string) error {
+	if !config.Get().HL7ValidateProfile {
+		return nil
+	}
+	return ValidateSegments(message)
+}
+
+// isKeepalive reports whether b is a configured between-message keepalive byte
+func isKeepalive(b byte) bool {
+	for _, k := range config.Get().KeepaliveBytes {
+		if b == k {
+			return true
+		}
+	}
+	return false
+}
+
+// recoverStrayFS handles an FS that arrives outside a message, which
+// usually means the VT was lost. In lenient mode the bytes buffered since
+// the last message are parsed from their MSH segment onwards.
+func recoverStrayFS(ctx context.Context, buffered string, conn net.Conn, reader *bufio.Reader, source types.Transport) bool {
+	log.Println("⚠️  [HL7] FS received outside a message (missed VT?)")
+	if buffered == "" {
+		return false
+	}
+	if logger.Debugging() && logger.RawAllowed() {
+		log.Printf("   Buffered since last message: %q\n", buffered)
+	}
+
+	start := strings.Index(buffered, "MSH")
+	if !config.Get().HL7LenientResync || start < 0 {
+		return false
+	}
+
+	log.Println("🩹 [HL7] Recovering message from bytes buffered before stray FS")
+	handleMessage(ctx, buffered[start:], conn, reader, source, []string{types.WarningFrameRecovered})
+	return true
+}
+
+// restoreIdleDeadline re-arms conn's 30s idle read deadline after an
+// exchange that shortened it, unless ctx is done: the immediate deadline
+// set on shutdown must then stand
+func restoreIdleDeadline(ctx context.Context, conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(30 * time.Second))
+	// Checked after setting, so a shutdown racing with it is not undone
+	if ctx.Err() != nil {
+		conn.SetReadDeadline(time.Now())
+	}
+}
+
+// handleMessage handles each complete message; replaceable so a replay
+// can parse messages without ACKing or forwarding them
+var handleMessage = processMessage
+
+// processMessage parses, forwards and ACKs one message; warnings are
+// message-level codes attached to every result. reader is the connection's
+// reader, for exchanges that wait on the LIS.
+func processMessage(ctx context.Context, message string, conn net.Conn, reader *bufio.Reader, source types.Transport, warnings []string) {
+	hl7Messages.Inc()
 	log.Println("\n📦 [HL7] MESSAGE RECEIVED")
-	if config.DebugMode {
+	if logger.Debugging() && logger.RawAllowed() {
 		log.Println("Raw Message:\n", message)
 		log.Println(strings.Repeat("-", 60))
 		log.Println("Hex Dump:\n", hex.Dump([]byte(message)))
 	}
 
-	results := ParseMessage(message)
+	if err := ValidateHeader(message); err != nil {
+		log.Printf("🚫 [HL7] Malformed message rejected: %v\n", err)
+		if logger.Debugging() && logger.RawAllowed() {
+			log.Printf("   Offending bytes: %q\n", message[:min(len(message), 64)])
+		}
+		writeReply(conn, HeaderRejection(message, err.Error()))
+		return
+	}
 
-	ack := GenerateACK(message)
-	if ack != "" {
-		ackBytes := []byte{config.VT}
-		ackBytes = append(ackBytes, []byte(ack)...)
-		ackBytes = append(ackBytes, config.FS, config.CR)
+	if code, _ := MessageType(message); code == "QBP" && config.Get().HL7AnswerQueries {
+		writeReply(conn, AnswerQuery(message))
+		return
+	}
+	if code, _ := MessageType(message); code == "QRY" && config.Get().HL7SendOrders {
+		answerOrderQuery(ctx, message, conn, reader)
+		return
+	}
 
-		_, err := conn.Write(ackBytes)
-		if err != nil {
-			log.Println("❌ Error sending ACK:", err)
-		} else {
-			log.Println("✅ [HL7] ACK sent to LIS")
+	var logged types.HL7Message // results shown on the terminal
+	ackCode, ackText := "AA", ""
+	sender, controlID := ControlID(message)
+	controlKey := sender + "|" + controlID
+	if code, trigger := MessageType(message); !acceptedType(code, trigger) {
+		log.Printf("🚫 [HL7] %s^%s message not in accepted types %v — rejected\n", code, trigger, config.Get().HL7AcceptedMessageTypes)
+		ackCode, ackText = "AR", fmt.Sprintf("unsupported message type %s^%s", code, trigger)
+	} else if sessions.Seen(dedup.Hash(message)) {
+		log.Println("♻️  [HL7] Duplicate session suppressed (identical message already received)")
+	} else if controlID != "" && controlIDs.Seen(controlKey) {
+		n := duplicateControlIDs.Inc()
+		log.Printf("♻️  [HL7] Duplicate control ID %q from %q suppressed (%d so far)\n", controlID, sender, n)
+	} else if err := validateProfile(message); err != nil {
+		// Let a corrected retransmission through the duplicate check
+		log.Printf("🚫 [HL7] Nonconformant message rejected: %v\n", err)
+		sessions.Forget(dedup.Hash(message))
+		controlIDs.Forget(controlKey)
+		payload := BuildPayload(message, source)
+		DeadLetter(payload, ResultsEndpoint(config.Get().HL7Endpoint), "nonconformant: "+err.Error())
+		ackCode, ackText = "AR", "nonconformant: "+err.Error()
+	} else if payload := BuildPayload(message, source); len(payload.Results) == 0 {
+		// Let a corrected retransmission through the duplicate check
+		log.Printf("❌ [HL7] No results could be parsed from [%s] — replying AE\n", payload.MessageID)
+		sessions.Forget(dedup.Hash(message))
+		controlIDs.Forget(controlKey)
+		ackCode, ackText = "AE", "no OBX results could be parsed"
+	} else if config.Get().HL7AckAfterForward {
+		payload.Warn(warnings...)
+		logged = payload
+		logged.Results = slices.Clone(payload.Results)
+		if err := ForwardWithin(payload, ResultsEndpoint(config.Get().HL7Endpoint), config.Get().HL7AckDeadline); err != nil {
+			// Let the instrument's retransmission through the duplicate check
+			log.Printf("❌ [HL7] Forward failed before ACK [%s]: %v — replying AE\n", payload.MessageID, err)
+			sessions.Forget(dedup.Hash(message))
+			controlIDs.Forget(controlKey)
+			ackCode, ackText = "AE", "forwarding failed"
 		}
 	} else {
-		log.Println("⚠️ Could not generate ACK - invalid message")
+		payload.Warn(warnings...)
+		logged = payload
+		logged.Results = slices.Clone(payload.Results)
+		Enqueue(payload, ResultsEndpoint(config.Get().HL7Endpoint))
+	}
+
+	writeReply(conn, GenerateACKCode(message, ackCode, ackText))
+
+	if config.Get().LogToTerminal && len(logged.Results) > 0 {
+		logger.LogResults(logged)
 	}
+}
 
-	if config.LogToTerminal && len(results) > 0 {
-		logger.LogResults(results)
+// writeReply sends an ACK or query response back to the LIS
+func writeReply(conn net.Conn, reply string) {
+	if reply == "" {
+		log.Println("⚠️ Could not generate ACK - invalid message")
+		return
+	}
+	conn.SetWriteDeadline(time.Now().Add(config.Get().ACKWriteTimeout))
+	if _, err := conn.Write(FrameMLLP(reply)); err != nil {
+		log.Println("❌ Error sending ACK:", err)
+	} else {
+		log.Println("✅ [HL7] ACK sent to LIS")
 	}
 }
 
+// captureConn tees the bytes passing through a connection in both
+// directions into the capture file
+type captureConn struct {
+	net.Conn
+	recorder *capture.Recorder
+}
+
+func (c *captureConn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.recorder.Record(capture.RX, b[:n])
+	return n, err
+}
+
+func (c *captureConn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	c.recorder.Record(capture.TX, b[:n])
+	return n, err
+}
+
+// publish emits an HL7 session lifecycle event for source
+func publish(eventType string, source types.Transport, detail string) {
+	events.Publish(events.Event{Type: eventType, Protocol: "hl7", Source: source.Address, Detail: detail})
+}
+
 func byteDescription(b byte) string {
 	switch b {
 	case config.VT:
@@ -0,0 +1,166 @@
+package hl7
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"lightbaseEMRProxy/internal/config"
+	"lightbaseEMRProxy/types"
+)
+
+// spoolMu keeps the periodic retry and a manual drain from delivering the
+// same spooled file twice
+var spoolMu sync.Mutex
+
+// spooled is the on-disk record of a delivery waiting to be retried
+type spooled struct {
+	Endpoint  string           `json:"endpoint"`
+	SpooledAt string           `json:"spooled_at"`
+	LastError string           `json:"last_error"`
+	Payload   types.HL7Message `json:"payload"`
+}
+
+// endpointURL resolves a configured endpoint, which is either a path on
+// ExternalServerURL or an absolute URL
+func endpointURL(endpoint string) string {
+	if strings.Contains(endpoint, "://") {
+		return endpoint
+	}
+	return config.Get().ExternalServerURL + endpoint
+}
+
+// spoolDir returns the spool subdirectory holding deliveries for endpoint,
+// so each endpoint's backlog is retried independently of the others
+func spoolDir(endpoint string) string {
+	name := strings.TrimPrefix(strings.TrimPrefix(endpoint, "https://"), "http://")
+	return filepath.Join(config.Get().SpoolDir, unsafeFileChars.ReplaceAllString(name, "_"))
+}
+
+// Spool saves a failed delivery to its endpoint's spool directory for retry
+func Spool(payload types.HL7Message, endpoint string, cause error) {
+	now := time.Now()
+	record := spooled{
+		Endpoint:  endpoint,
+		SpooledAt: now.Format(time.RFC3339),
+		LastError: cause.Error(),
+		Payload:   payload,
+	}
+
+	data, err := json.MarshalIndent(record, "", "  ")
+	if err != nil {
+		log.Printf("❌ [SPOOL] Could not encode [%s]: %v\n", payload.MessageID, err)
+		return
+	}
+
+	dir := spoolDir(endpoint)
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		log.Printf("❌ [SPOOL] Could not create %s: %v\n", dir, err)
+		return
+	}
+
+	name := fmt.Sprintf("%s_%s.json", now.Format("20060102T150405.000000000"), unsafeFileChars.ReplaceAllString(payload.MessageID, "_"))
+	path := filepath.Join(dir, name)
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		log.Printf("❌ [SPOOL] Could not write %s: %v\n", path, err)
+		return
+	}
+
+	log.Printf("💾 [SPOOL] Spooled [%s] for %s → %s\n", payload.MessageID, endpoint, path)
+}
+
+// StartSpoolRetry periodically retries spooled deliveries (blocks)
+func StartSpoolRetry() {
+	ticker := time.NewTicker(config.Get().SpoolRetryInterval)
+	defer ticker.Stop()
+	for range ticker.C {
+		RetrySpool()
+	}
+}
+
+// RetrySpool makes one pass over every endpoint's spool directory, oldest
+// first, and reports how many deliveries succeeded and how many are still
+// spooled. A failure stops the pass for that endpoint only.
+func RetrySpool() (delivered, remaining int) {
+	spoolMu.Lock()
+	defer spoolMu.Unlock()
+
+	dirs, err := os.ReadDir(config.Get().SpoolDir)
+	if err != nil {
+		if !os.IsNotExist(err) {
+			log.Printf("❌ [SPOOL] Could not read %s: %v\n", config.Get().SpoolDir, err)
+		}
+		return 0, 0
+	}
+	for _, dir := range dirs {
+		if dir.IsDir() {
+			d, r := retryEndpoint(filepath.Join(config.Get().SpoolDir, dir.Name()))
+			delivered += d
+			remaining += r
+		}
+	}
+	return delivered, remaining
+}
+
+// retryEndpoint retries the deliveries spooled in dir, returning how many
+// succeeded and how many are left
+func retryEndpoint(dir string) (delivered, remaining int) {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		log.Printf("❌ [SPOOL] Could not read %s: %v\n", dir, err)
+		return 0, 0
+	}
+	sort.Slice(entries, func(i, j int) bool { return entries[i].Name() < entries[j].Name() })
+
+	var pending []os.DirEntry
+	for _, entry := range entries {
+		if !entry.IsDir() && filepath.Ext(entry.Name()) == ".json" {
+			pending = append(pending, entry)
+		}
+	}
+
+	for i, entry := range pending {
+		path := filepath.Join(dir, entry.Name())
+		data, err := os.ReadFile(path)
+		if err != nil {
+			log.Printf("❌ [SPOOL] Could not read %s: %v\n", path, err)
+			remaining++
+			continue
+		}
+		var record spooled
+		if err := json.Unmarshal(data, &record); err != nil {
+			log.Printf("❌ [SPOOL] Could not decode %s: %v\n", path, err)
+			remaining++
+			continue
+		}
+
+		if age, expired := payloadAge(record.Payload); expired {
+			DeadLetter(record.Payload, record.Endpoint, fmt.Sprintf("expired in spool: received %s ago, limit %s", age.Round(time.Second), config.Get().ForwardMaxAge))
+			os.Remove(path)
+			continue
+		}
+
+		job := &forwardJob{payload: record.Payload, endpoint: record.Endpoint}
+		if err := deliver(job); err != nil {
+			log.Printf("⏳ [SPOOL] Retry to %s still failing [%s]: %v\n", record.Endpoint, record.Payload.MessageID, err)
+			if len(job.payload.Results) < len(record.Payload.Results) {
+				// Results posted before the failure (form mode) are not sent again
+				record.Payload, record.LastError = job.payload, err.Error()
+				if data, err := json.MarshalIndent(record, "", "  "); err == nil {
+					os.WriteFile(path, data, 0o644)
+				}
+			}
+			return delivered, remaining + len(pending) - i
+		}
+		os.Remove(path)
+		delivered++
+		log.Printf("✅ [SPOOL] Delivered spooled [%s] to %s\n", record.Payload.MessageID, record.Endpoint)
+	}
+	return delivered, remaining
+}
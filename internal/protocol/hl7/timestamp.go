@@ -0,0 +1,50 @@
+package hl7
+
+import (
+	"strconv"
+	"time"
+
+	"lightbaseEMRProxy/internal/config"
+	"lightbaseEMRProxy/types"
+)
+
+// formatTimestamps returns payload with its timestamps rewritten from the
+// internal RFC3339 form into config.Get().TimestampFormat. Payloads are
+// kept in RFC3339 until they are encoded, since queue expiry and the spool
+// read them back.
+func formatTimestamps(payload types.HL7Message) types.HL7Message {
+	if config.Get().TimestampFormat == "rfc3339" {
+		return payload
+	}
+
+	payload.ReceivedAt = formatTimestamp(payload.ReceivedAt)
+	payload.CreatedAt = formatTimestamp(payload.CreatedAt)
+	results := make([]types.HL7Result, len(payload.Results))
+	for i, r := range payload.Results {
+		r.Timestamp = formatTimestamp(r.Timestamp)
+		results[i] = r
+	}
+	payload.Results = results
+	return payload
+}
+
+// formatTimestamp renders an RFC3339 timestamp in the configured output
+// format; values that are not RFC3339 are passed through unchanged.
+// epoch_millis gives a decimal string, not a number: the timestamp fields
+// are strings shared with form posts and the spool, and a value that is
+// not RFC3339 must still pass through, so the JSON type cannot change with
+// the format.
+func formatTimestamp(value string) string {
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return value
+	}
+	switch format := config.Get().TimestampFormat; format {
+	case "rfc3339":
+		return value
+	case "epoch_millis":
+		return strconv.FormatInt(t.UnixMilli(), 10)
+	default:
+		return t.Format(format)
+	}
+}
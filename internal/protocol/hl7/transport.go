@@ -0,0 +1,145 @@
+package hl7
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+
+	"lightbaseEMRProxy/internal/config"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+var (
+	serverTransportOnce sync.Once
+	serverTransportRT   http.RoundTripper
+	serverTransportErr  error
+
+	serverClientOnce sync.Once
+	serverClientC    *http.Client
+)
+
+// serverClient returns the client shared by every result POST to the
+// external server
+func serverClient() (*http.Client, error) {
+	transport, err := serverTransport()
+	if err != nil {
+		return nil, err
+	}
+	serverClientOnce.Do(func() {
+		serverClientC = &http.Client{Timeout: 60 * time.Second, Transport: transport}
+	})
+	return serverClientC, nil
+}
+
+// serverTransport returns the transport shared by every request to the
+// external server. It is built once with the TLS settings of
+// serverTLSConfig, and when config.Get().ServerAuthScheme is set it adds
+// the auth header to every request.
+func serverTransport() (http.RoundTripper, error) {
+	serverTransportOnce.Do(func() {
+		transport := http.DefaultTransport.(*http.Transport).Clone()
+		tlsConfig, err := serverTLSConfig()
+		if err != nil {
+			serverTransportErr = err
+			return
+		}
+		transport.TLSClientConfig = tlsConfig
+		serverTransportRT = transport
+
+		if scheme := config.Get().ServerAuthScheme; scheme != "none" {
+			token := os.Getenv(config.Get().ServerAuthTokenEnv)
+			if token == "" {
+				serverTransportErr = fmt.Errorf("server_auth_scheme is %s but %s is not set", scheme, config.Get().ServerAuthTokenEnv)
+				return
+			}
+			name, value := "Authorization", "Bearer "+token
+			if scheme == "header" {
+				name, value = config.Get().ServerAuthHeader, token
+			}
+			serverTransportRT = &authTransport{next: transport, name: name, value: value}
+		}
+	})
+	return serverTransportRT, serverTransportErr
+}
+
+// serverTLSConfig trusts the CAs in config.Get().ServerCAFile on top of
+// the system roots and presents the client identity from
+// config.Get().ClientPKCS12File or ClientCertFile/ClientKeyFile for
+// mutual TLS
+func serverTLSConfig() (*tls.Config, error) {
+	tlsConfig := &tls.Config{InsecureSkipVerify: config.Get().ServerInsecureSkipVerify}
+	if tlsConfig.InsecureSkipVerify {
+		log.Println("⚠️  [TLS] server_insecure_skip_verify is on — the external server's certificate is not checked")
+	}
+
+	if path := config.Get().ServerCAFile; path != "" {
+		pem, err := os.ReadFile(path)
+		if err != nil {
+			return nil, fmt.Errorf("failed to read CA bundle: %w", err)
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("no certificates found in CA bundle %s", path)
+		}
+		tlsConfig.RootCAs = pool
+	}
+
+	switch {
+	case config.Get().ClientPKCS12File != "":
+		cert, err := loadPKCS12(config.Get().ClientPKCS12File, os.Getenv(config.Get().ClientPKCS12PasswordEnv))
+		if err != nil {
+			return nil, err
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	case config.Get().ClientCertFile != "":
+		cert, err := tls.LoadX509KeyPair(config.Get().ClientCertFile, config.Get().ClientKeyFile)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load client certificate: %w", err)
+		}
+		tlsConfig.Certificates = []tls.Certificate{cert}
+	}
+	return tlsConfig, nil
+}
+
+// authTransport adds the configured auth header to each request. The token
+// only ever lives here, so request logging cannot leak it.
+type authTransport struct {
+	next        http.RoundTripper
+	name, value string
+}
+
+func (t *authTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set(t.name, t.value)
+	return t.next.RoundTrip(req)
+}
+
+// loadPKCS12 reads a .p12/.pfx bundle holding the client key, certificate
+// and any intermediate CAs
+func loadPKCS12(path, password string) (tls.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to read client certificate bundle: %w", err)
+	}
+
+	key, cert, chain, err := pkcs12.DecodeChain(data, password)
+	if err != nil {
+		return tls.Certificate{}, fmt.Errorf("failed to decode client certificate bundle: %w", err)
+	}
+
+	tlsCert := tls.Certificate{PrivateKey: key, Leaf: cert}
+	tlsCert.Certificate = append(tlsCert.Certificate, cert.Raw)
+	for _, ca := range chain {
+		tlsCert.Certificate = append(tlsCert.Certificate, ca.Raw)
+	}
+	return tlsCert, nil
+}
@@ -0,0 +1,55 @@
+package session
+
+import (
+	"sync"
+	"time"
+)
+
+// Group counts sessions in progress so shutdown can wait for them. Unlike
+// sync.WaitGroup, a session may start while Wait is already waiting, as
+// one accepted just as shutdown begins does.
+type Group struct {
+	mu   sync.Mutex
+	n    int
+	idle chan struct{} // closed when n drops to zero; nil while nobody waits
+}
+
+// Add records a session starting
+func (g *Group) Add() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.n++
+}
+
+// Done records a session ending
+func (g *Group) Done() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	g.n--
+	if g.n == 0 && g.idle != nil {
+		close(g.idle)
+		g.idle = nil
+	}
+}
+
+// Wait waits up to timeout for no session to be in progress, reporting
+// whether that happened
+func (g *Group) Wait(timeout time.Duration) bool {
+	g.mu.Lock()
+	if g.n == 0 {
+		g.mu.Unlock()
+		return true
+	}
+	if g.idle == nil {
+		g.idle = make(chan struct{})
+	}
+	idle := g.idle
+	g.mu.Unlock()
+
+	select {
+	case <-idle:
+		return true
+	case <-time.After(timeout):
+		return false
+	}
+}
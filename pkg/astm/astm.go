@@ -0,0 +1,51 @@
+// Package astm parses ASTM E1394 (LIS2-A2) transmissions, and the Bio-Rad
+// D-10 format, the way the gateway does, for programs that want the parsed
+// results without running the gateway.
+//
+//	results, err := astm.Parse(raw)
+//
+// Parsing uses the gateway's default configuration; nothing is queued or
+// forwarded.
+package astm
+
+import (
+	"errors"
+	"strings"
+
+	parser "lightbaseEMRProxy/internal/protocol/astm"
+	"lightbaseEMRProxy/types"
+)
+
+// Result is one R record
+type Result = types.HL7Result
+
+// Message is a whole parsed transmission: instrument, patient, order and
+// results, in the shape the gateway forwards
+type Message = types.HL7Message
+
+// ErrNoHeader is returned for input that does not start with an H record
+// or a D-10 S03 record
+var ErrNoHeader = errors.New("no ASTM H record found")
+
+// Parse returns the results of the ASTM transmission in raw. raw may be
+// the framed bytes as captured from the line (ENQ, STX-framed records with
+// checksums, EOT) or bare records separated by CR, LF or CRLF.
+func Parse(raw []byte) ([]Result, error) {
+	message, err := ParseMessage(raw)
+	if err != nil {
+		return nil, err
+	}
+	return message.Results, nil
+}
+
+// ParseMessage parses the ASTM transmission in raw into the payload the
+// gateway would forward for it
+func ParseMessage(raw []byte) (Message, error) {
+	text := parser.Deframe(raw)
+	if !strings.HasPrefix(text, "H") && !strings.HasPrefix(text, "S03") {
+		return Message{}, ErrNoHeader
+	}
+	payload, _ := parser.BuildPayload(text, types.Transport{})
+	payload.Transport = nil
+	return payload, nil
+}
@@ -0,0 +1,49 @@
+// Package hl7 parses HL7 v2.x result messages the way the gateway does,
+// for programs that want the parsed results without running the gateway.
+//
+//	results, err := hl7.Parse(raw)
+//
+// Parsing uses the gateway's default configuration; nothing is queued or
+// forwarded.
+package hl7
+
+import (
+	"errors"
+	"strings"
+
+	parser "lightbaseEMRProxy/internal/protocol/hl7"
+	"lightbaseEMRProxy/types"
+)
+
+// Result is one OBX observation
+type Result = types.HL7Result
+
+// Message is a whole parsed message: source, patient, order and results,
+// in the shape the gateway forwards
+type Message = types.HL7Message
+
+// ErrNoMSH is returned for input that holds no MSH segment
+var ErrNoMSH = errors.New("no HL7 MSH segment found")
+
+// Parse returns the results of the HL7 message in raw. MLLP framing and
+// LF or CRLF segment separators are accepted.
+func Parse(raw []byte) ([]Result, error) {
+	message, err := ParseMessage(raw)
+	if err != nil {
+		return nil, err
+	}
+	return message.Results, nil
+}
+
+// ParseMessage parses the HL7 message in raw into the payload the gateway
+// would forward for it
+func ParseMessage(raw []byte) (Message, error) {
+	text := parser.StripMLLP(raw)
+	start := strings.Index(text, "MSH")
+	if start < 0 {
+		return Message{}, ErrNoMSH
+	}
+	payload := parser.BuildPayload(text[start:], types.Transport{})
+	payload.Transport = nil
+	return payload, nil
+}
@@ -22,14 +22,14 @@ if %errorlevel% neq 0 (
     exit /b 1
 )
 
-REM Delete all files except server.exe
+REM Delete all files except server.exe and the site configuration
 for /f "delims=" %%f in ('dir /b /a-d') do (
-    if /i not "%%f"=="server.exe" del /f /q "%%f"
+    if /i not "%%f"=="server.exe" if /i not "%%f"=="gateway.yaml" del /f /q "%%f"
 )
 
-REM Delete all folders except .git
+REM Delete all folders except .git and the undelivered results
 for /d %%d in (*) do (
-    if /i not "%%d"==".git" rd /s /q "%%d"
+    if /i not "%%d"==".git" if /i not "%%d"=="queue" if /i not "%%d"=="spool" if /i not "%%d"=="deadletter" if /i not "%%d"=="capture" rd /s /q "%%d"
 )
 
 start "LightbaseERMGateway" cmd /k server.exe
\ No newline at end of file
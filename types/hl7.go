@@ -1,24 +1,83 @@
 package types
 
+import "time"
+
 type HL7Result struct {
-	ObservationID  string `bson:"observation_id" json:"observation_id"`
-	TestCode       string `bson:"test_code" json:"test_code"`
-	TestName       string `bson:"test_name" json:"test_name"`
-	Value          string `bson:"value" json:"value"`
-	Units          string `bson:"units,omitempty" json:"units,omitempty"`
-	ReferenceRange string `bson:"reference_range,omitempty" json:"reference_range,omitempty"`
-	AbnormalFlags  string `bson:"abnormal_flags,omitempty" json:"abnormal_flags,omitempty"`
-	Status         string `bson:"status" json:"status"`
-	Timestamp      string `bson:"timestamp" json:"timestamp"`
+	ObservationID       string   `bson:"observation_id" json:"observation_id"`
+	SubID               string   `bson:"sub_id,omitempty" json:"sub_id,omitempty"`
+	AccessionNumber     string   `bson:"accession_number,omitempty" json:"accession_number,omitempty"`
+	TestCode            string   `bson:"test_code" json:"test_code"`
+	RawTestCode         string   `bson:"raw_test_code,omitempty" json:"raw_test_code,omitempty"`
+	TestName            string   `bson:"test_name" json:"test_name"`
+	Value               string   `bson:"value" json:"value"`
+	RawValue            string   `bson:"raw_value,omitempty" json:"raw_value,omitempty"`
+	ValueNumeric        *float64 `bson:"value_numeric,omitempty" json:"value_numeric,omitempty"` // Value as a number, without Comparator
+	Comparator          string   `bson:"comparator,omitempty" json:"comparator,omitempty"`       // "<", ">", "<=" or ">=" when Value is a bound
+	Units               string   `bson:"units,omitempty" json:"units,omitempty"`
+	RawUnits            string   `bson:"raw_units,omitempty" json:"raw_units,omitempty"`
+	ReferenceRange      string   `bson:"reference_range,omitempty" json:"reference_range,omitempty"`
+	RawReferenceRange   string   `bson:"raw_reference_range,omitempty" json:"raw_reference_range,omitempty"`
+	AbnormalFlags       string   `bson:"abnormal_flags,omitempty" json:"abnormal_flags,omitempty"`
+	Status              string   `bson:"status" json:"status"`
+	Timestamp           string   `bson:"timestamp" json:"timestamp"`
+	AbsentFields        []string `bson:"absent_fields,omitempty" json:"absent_fields,omitempty"`
+	Suspect             bool     `bson:"suspect,omitempty" json:"suspect,omitempty"`
+	Warnings            []string `bson:"warnings,omitempty" json:"warnings,omitempty"`
+	ResponsibleObserver string   `bson:"responsible_observer,omitempty" json:"responsible_observer,omitempty"`
+	Comments            []string `bson:"comments,omitempty" json:"comments,omitempty"`
+	TestLongName        string   `bson:"test_long_name,omitempty" json:"test_long_name,omitempty"`
+	Department          string   `bson:"department,omitempty" json:"department,omitempty"`
+
+	// Values is OBX-5 split into repetitions of components when it has either
+	Values [][]string `bson:"values,omitempty" json:"values,omitempty"`
+
+	// Extra holds fields derived by configured result transforms
+	Extra map[string]string `bson:"extra,omitempty" json:"extra,omitempty"`
 }
 
 type HL7Patient struct {
-	ID   string `bson:"id,omitempty" json:"id,omitempty"`
-	Name string `bson:"name,omitempty" json:"name,omitempty"`
+	ID         string `bson:"id,omitempty" json:"id,omitempty"`
+	Name       string `bson:"name,omitempty" json:"name,omitempty"`
+	LastName   string `bson:"last_name,omitempty" json:"last_name,omitempty"`
+	FirstName  string `bson:"first_name,omitempty" json:"first_name,omitempty"`
+	MiddleName string `bson:"middle_name,omitempty" json:"middle_name,omitempty"`
+	Physician  string `bson:"physician,omitempty" json:"physician,omitempty"`
+	Location   string `bson:"location,omitempty" json:"location,omitempty"`
+	BirthDate  string `bson:"birth_date,omitempty" json:"birth_date,omitempty"`
+	Sex        string `bson:"sex,omitempty" json:"sex,omitempty"`
+	AgeYears   *int   `bson:"age_years,omitempty" json:"age_years,omitempty"`
+
+	// PhysicianID is the attending physician's ID, apart from their name in
+	// Physician
+	PhysicianID string `bson:"physician_id,omitempty" json:"physician_id,omitempty"`
+
+	// IDs lists every identifier when PID-3 repeats; ID holds the first
+	IDs []string `bson:"ids,omitempty" json:"ids,omitempty"`
+
+	Comments []string `bson:"comments,omitempty" json:"comments,omitempty"`
 }
 
 type HL7Order struct {
 	AccessionNumber string `bson:"accession_number,omitempty" json:"accession_number,omitempty"`
+	Priority        string `bson:"priority,omitempty" json:"priority,omitempty"`
+
+	Comments []string `bson:"comments,omitempty" json:"comments,omitempty"`
+
+	// Results is set only when results are nested under their orders
+	Results []HL7Result `bson:"results,omitempty" json:"results,omitempty"`
+}
+
+// PendingOrders are the tests the server has ordered for a sample and not
+// yet received results for, as downloaded to an instrument
+type PendingOrders struct {
+	Patient HL7Patient     `bson:"patient,omitempty" json:"patient,omitempty"`
+	Orders  []OrderRequest `bson:"orders" json:"orders"`
+}
+
+type OrderRequest struct {
+	AccessionNumber string   `bson:"accession_number" json:"accession_number"`
+	Priority        string   `bson:"priority,omitempty" json:"priority,omitempty"`
+	Tests           []string `bson:"tests" json:"tests"` // test codes as the instrument knows them
 }
 
 type HL7Payload struct {
@@ -30,13 +89,46 @@ type HL7Payload struct {
 	ReceivedAt string      `bson:"received_at" json:"received_at"`
 }
 
+// Transport describes the link a message arrived on
+type Transport struct {
+	Kind         string    `bson:"kind" json:"kind"`       // "tcp" or "serial"
+	Address      string    `bson:"address" json:"address"` // remote IP:port or serial port name
+	ConnectedAt  time.Time `bson:"connected_at" json:"connected_at"`
+	ConnectionMs int64     `bson:"connection_ms" json:"connection_ms"` // how long the link had been up when the message was parsed
+}
+
+// Stamp returns a copy of t with the connection duration measured up to now
+func (t Transport) Stamp() *Transport {
+	t.ConnectionMs = time.Since(t.ConnectedAt).Milliseconds()
+	return &t
+}
+
+// RawRecord is a record the parser does not understand, kept verbatim
+type RawRecord struct {
+	Type   string   `bson:"type" json:"type"`
+	Fields []string `bson:"fields" json:"fields"`
+}
+
+// SchemaVersion identifies the shape of the forwarded JSON payload. Bump it
+// whenever a field is renamed, removed or changes type, and record the
+// change in the README's payload schema section.
+const SchemaVersion = 1
+
 type HL7Message struct {
-	ID         string      `bson:"_id,omitempty" json:"id,omitempty"`
-	Source     string      `bson:"source" json:"source"`
-	MessageID  string      `bson:"message_id" json:"message_id"`
-	Patient    HL7Patient  `bson:"patient,omitempty" json:"patient,omitempty"`
-	Order      HL7Order    `bson:"order,omitempty" json:"order,omitempty"`
-	Results    []HL7Result `bson:"results" json:"results"`
-	ReceivedAt string      `bson:"received_at" json:"received_at"`
-	CreatedAt  string      `bson:"created_at,omitempty" json:"created_at,omitempty"`
+	SchemaVersion    int         `bson:"schema_version,omitempty" json:"schema_version,omitempty"`
+	ID               string      `bson:"_id,omitempty" json:"id,omitempty"`
+	Source           string      `bson:"source" json:"source"`
+	Protocol         string      `bson:"protocol,omitempty" json:"protocol,omitempty"`
+	Instrument       string      `bson:"instrument,omitempty" json:"instrument,omitempty"`
+	InstrumentSerial string      `bson:"instrument_serial,omitempty" json:"instrument_serial,omitempty"`
+	MessageID        string      `bson:"message_id" json:"message_id"`
+	Patient          HL7Patient  `bson:"patient,omitempty" json:"patient,omitempty"`
+	Order            HL7Order    `bson:"order,omitempty" json:"order,omitempty"`
+	Results          []HL7Result `bson:"results" json:"results"`
+	Orders           []HL7Order  `bson:"orders,omitempty" json:"orders,omitempty"`
+	ReceivedAt       string      `bson:"received_at" json:"received_at"`
+	CreatedAt        string      `bson:"created_at,omitempty" json:"created_at,omitempty"`
+
+	Transport      *Transport  `bson:"transport,omitempty" json:"transport,omitempty"`
+	UnknownRecords []RawRecord `bson:"unknown_records,omitempty" json:"unknown_records,omitempty"`
 }
@@ -0,0 +1,45 @@
+package types
+
+// Warning codes attached to results when the gateway had to work around a
+// data-quality problem. Codes are stable identifiers for the server; they
+// are never reworded.
+const (
+	// WarningTimestampFallback: the result timestamp was missing or
+	// unparseable and the time of receipt was used instead
+	WarningTimestampFallback = "TIMESTAMP_FALLBACK"
+
+	// WarningFrameRecovered: the message framing was damaged (e.g. a lost
+	// MLLP start byte) and the message was recovered from buffered bytes
+	WarningFrameRecovered = "FRAME_RECOVERED"
+
+	// WarningFieldsAbsent: the record was shorter than the standard layout;
+	// the missing fields are listed in absent_fields
+	WarningFieldsAbsent = "FIELDS_ABSENT"
+
+	// WarningImplausibleValue: the value is outside the physically plausible
+	// range for the test and the result is marked suspect
+	WarningImplausibleValue = "IMPLAUSIBLE_VALUE"
+
+	// WarningReferenceRangeReplaced: the instrument's reference range was
+	// replaced by the configured one; the original is in raw_reference_range
+	WarningReferenceRangeReplaced = "REFERENCE_RANGE_REPLACED"
+)
+
+// Warn adds a warning code to the result unless it is already present
+func (r *HL7Result) Warn(code string) {
+	for _, w := range r.Warnings {
+		if w == code {
+			return
+		}
+	}
+	r.Warnings = append(r.Warnings, code)
+}
+
+// Warn adds warning codes that apply to the whole message to every result
+func (m *HL7Message) Warn(codes ...string) {
+	for i := range m.Results {
+		for _, code := range codes {
+			m.Results[i].Warn(code)
+		}
+	}
+}